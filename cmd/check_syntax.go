@@ -4,7 +4,6 @@ import (
 	"io"
 	"net/http"
 	"os"
-	"strings"
 
 	"github.com/henry40408/lmb/internal/eval_context"
 	"github.com/henry40408/lmb/internal/store"
@@ -24,7 +23,7 @@ var (
 		Long:  "Check syntax of Lua script",
 		RunE: func(cmd *cobra.Command, args []string) error {
 			store, _ := store.NewStore(":memory:")
-			e := eval_context.NewEvalContext(store, strings.NewReader(""), http.DefaultClient)
+			e := eval_context.NewEvalContext(store, http.DefaultClient)
 
 			var reader io.Reader
 			if scriptPath == "-" {
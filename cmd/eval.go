@@ -2,16 +2,14 @@ package cmd
 
 import (
 	"bytes"
+	"context"
 	"encoding/json"
 	"fmt"
 	"io"
-	"net/http"
 	"os"
 	"sync"
 	"time"
 
-	"github.com/henry40408/lmb/internal/eval_context"
-	"github.com/henry40408/lmb/internal/store"
 	"github.com/rs/zerolog/log"
 	"github.com/spf13/cobra"
 )
@@ -19,30 +17,34 @@ import (
 func init() {
 	evalCmd.Flags().StringVar(&scriptPath, "file", "", "Script path (use '-' for stdin)")
 	evalCmd.MarkFlagRequired("file")
+	evalCmd.Flags().StringVar(&errorFormat, "error-format", "text", "Format of evaluation errors written to stderr, text or json")
 	rootCmd.AddCommand(evalCmd)
 }
 
 var (
-	evalCmd = &cobra.Command{
+	errorFormat string
+	evalCmd     = &cobra.Command{
 		Use:   "eval",
 		Short: "Evaluate a file",
 		Long:  "Evaluate a file",
 		RunE: func(cmd *cobra.Command, args []string) error {
 			var state sync.Map
 
-			store, err := store.NewStore(storePath)
+			if errorFormat != "text" && errorFormat != "json" {
+				return fmt.Errorf("unsupported error format: %s", errorFormat)
+			}
+
+			store, err := openStore()
 			if err != nil {
 				return err
 			}
 			defer store.Close()
-			parsedHttpTimeout, err := time.ParseDuration(httpTimeout)
+			e, err := newEvalContext(store)
 			if err != nil {
 				return err
 			}
-			httpClient := http.Client{Timeout: parsedHttpTimeout}
-			e := eval_context.NewEvalContext(store, os.Stdin, &httpClient)
 
-			ctx, cancel, err := setupTimeoutContext(timeout)
+			ctx, cancel, err := setupTimeoutContext(context.Background(), timeout)
 			if err != nil {
 				return err
 			}
@@ -65,16 +67,16 @@ var (
 
 			compiled, err := e.Compile(reader, scriptPath)
 			if err != nil {
-				return err
+				return renderEvalError(cmd, err)
 			}
 			var w bytes.Buffer
-			res, err := e.Eval(ctx, compiled, &state, &w)
+			res, err := e.Eval(ctx, compiled, &state, os.Stdin, &w)
 
 			duration := time.Since(start)
 			evalLogger.Debug().Str("duration", duration.String()).Msg("file evaluated")
 
 			if err != nil {
-				return err
+				return renderEvalError(cmd, err)
 			}
 
 			if w.Len() > 0 {
@@ -96,3 +98,16 @@ var (
 		},
 	}
 )
+
+// renderEvalError writes evaluation errors as JSON to stderr in place of the
+// usual error message when requested.
+func renderEvalError(cmd *cobra.Command, err error) error {
+	if errorFormat != "json" {
+		return err
+	}
+	if encodeEvalError(os.Stderr, err) {
+		cmd.SilenceErrors = true
+		cmd.SilenceUsage = true
+	}
+	return err
+}
@@ -0,0 +1,73 @@
+package cmd
+
+import (
+	"bytes"
+	"encoding/json"
+	"io"
+	"os"
+	"path/filepath"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+)
+
+// captureStderr returns what f wrote to stderr.
+func captureStderr(t *testing.T, f func()) string {
+	t.Helper()
+	r, w, err := os.Pipe()
+	assert.NoError(t, err)
+	output := make(chan string)
+	go func() {
+		var buf bytes.Buffer
+		io.Copy(&buf, r)
+		output <- buf.String()
+	}()
+
+	stderrBackup := os.Stderr
+	os.Stderr = w
+	f()
+	os.Stderr = stderrBackup
+	w.Close()
+	return <-output
+}
+
+func TestEvalErrorFormatJSON(t *testing.T) {
+	testCases := []struct {
+		name      string
+		script    string
+		kind      string
+		line      int
+		traceback bool
+	}{
+		{"syntax", "return return", "syntax", 1, false},
+		{"runtime", "local a = 1\nerror('boom')", "runtime", 2, true},
+	}
+	for _, tc := range testCases {
+		t.Run(tc.name, func(t *testing.T) {
+			scriptPath := filepath.Join(t.TempDir(), "script.lua")
+			assert.NoError(t, os.WriteFile(scriptPath, []byte(tc.script), 0o644))
+			dbPath := filepath.Join(t.TempDir(), "db.sqlite3")
+
+			var err error
+			stderr := captureStderr(t, func() {
+				_, err = execute(t, "", "eval", "--db-path", dbPath, "--error-format", "json", "--file", scriptPath)
+			})
+			assert.Error(t, err)
+
+			var evalErr map[string]interface{}
+			assert.NoError(t, json.Unmarshal([]byte(stderr), &evalErr), stderr)
+			assert.Equal(t, tc.kind, evalErr["kind"])
+			assert.Equal(t, scriptPath, evalErr["script"])
+			assert.Equal(t, float64(tc.line), evalErr["line"])
+			assert.NotEmpty(t, evalErr["message"])
+			if tc.traceback {
+				assert.Contains(t, evalErr["traceback"], "stack traceback")
+			} else {
+				assert.NotContains(t, evalErr, "traceback")
+			}
+		})
+	}
+
+	_, err := execute(t, "", "eval", "--error-format", "yaml", "--file", "-")
+	assert.ErrorContains(t, err, "unsupported error format: yaml")
+}
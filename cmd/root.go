@@ -8,12 +8,24 @@ import (
 )
 
 var (
-	debug       bool
-	httpTimeout string
-	storePath   string
-	scriptPath  string
-	timeout     string
-	rootCmd     = &cobra.Command{
+	debug                 bool
+	httpAllow             []string
+	httpDeny              []string
+	httpTimeout           string
+	maxInstructions       int64
+	maxMemory             int64
+	maxStackSize          int
+	storeHistory          bool
+	storeHistoryRetention string
+	storeMaxTotalSize     int64
+	storeMaxValueSize     int64
+	storeNamespace        string
+	storeNamespaces       []string
+	storePath             string
+	storeURL              string
+	scriptPath            string
+	timeout               string
+	rootCmd               = &cobra.Command{
 		Use:   "lmb",
 		Short: "A Lua function runner",
 		Long:  `Lmb is a Lua function runner`,
@@ -32,7 +44,19 @@ var (
 func init() {
 	rootCmd.PersistentFlags().BoolVarP(&debug, "debug", "d", false, "Debug")
 	rootCmd.PersistentFlags().StringVar(&storePath, "db-path", "db.sqlite3", "Path to store file")
+	rootCmd.PersistentFlags().StringVar(&storeURL, "store-url", "", "Store URL e.g. sqlite://db.sqlite3 or memory://, overrides --db-path")
+	rootCmd.PersistentFlags().Int64Var(&storeMaxValueSize, "store-max-value-size", 0, "Maximum size of a value in store in bytes (0 for unlimited)")
+	rootCmd.PersistentFlags().Int64Var(&storeMaxTotalSize, "store-max-total-size", 0, "Maximum size of all values in store in bytes (0 for unlimited)")
+	rootCmd.PersistentFlags().BoolVar(&storeHistory, "store-history", false, "Record every change of values in store with the script and the previous value")
+	rootCmd.PersistentFlags().StringVar(&storeHistoryRetention, "store-history-retention", "720h", "Keep recorded changes for duration in human-readable format e.g. 24h, 720h (0 to keep forever)")
+	rootCmd.PersistentFlags().StringVar(&storeNamespace, "store-namespace", "", "Namespace of values in store (defaults to a hash of the script path)")
+	rootCmd.PersistentFlags().StringSliceVar(&storeNamespaces, "store-allow-namespace", nil, "Other namespaces of store scripts can open with m.store:namespace(name) (* for all)")
+	rootCmd.PersistentFlags().StringSliceVar(&httpAllow, "http-allow", nil, "Hosts, wildcard hosts e.g. *.example.com, IPs or CIDRs scripts can connect to; allows loopback and link-local addresses when matched")
+	rootCmd.PersistentFlags().StringSliceVar(&httpDeny, "http-deny", nil, "Hosts, wildcard hosts e.g. *.example.com, IPs or CIDRs scripts cannot connect to")
 	rootCmd.PersistentFlags().StringVar(&httpTimeout, "http-timeout", "30s", "HTTP client timeout in human-readable format e.g. 30s, 1m30s")
+	rootCmd.PersistentFlags().Int64Var(&maxInstructions, "max-instructions", 0, "Maximum number of Lua instructions an evaluation can execute (0 for unlimited)")
+	rootCmd.PersistentFlags().Int64Var(&maxMemory, "max-memory", 0, "Maximum estimated size of Lua values an evaluation holds in bytes (0 for unlimited)")
+	rootCmd.PersistentFlags().IntVar(&maxStackSize, "max-stack-size", 0, "Maximum number of values on the Lua stack of an evaluation (0 for the default of 5120)")
 	rootCmd.PersistentFlags().StringVar(&timeout, "timeout", "30s", "Timeout in human-readable format e.g. 30s, 1m30s")
 }
 
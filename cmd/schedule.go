@@ -0,0 +1,261 @@
+package cmd
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"os"
+	"os/signal"
+	"path/filepath"
+	"sync"
+	"sync/atomic"
+	"syscall"
+	"time"
+
+	"github.com/henry40408/lmb/internal/cron"
+	"github.com/henry40408/lmb/internal/eval_context"
+	"github.com/rs/zerolog/log"
+	"github.com/spf13/cobra"
+	lua "github.com/yuin/gopher-lua"
+	"gopkg.in/yaml.v3"
+)
+
+func init() {
+	scheduleCmd.Flags().StringVar(&scheduleFilePath, "file", "", "Path to YAML schedule file")
+	scheduleCmd.MarkFlagRequired("file")
+	scheduleCmd.Flags().StringVar(&sweepInterval, "store-sweep-interval", "1m", "Interval to delete expired values from store in human-readable format e.g. 30s, 1m30s (0 to disable)")
+	rootCmd.AddCommand(scheduleCmd)
+}
+
+// job runs a script whenever its cron expression matches.
+type job struct {
+	name       string
+	schedule   *cron.Schedule
+	scriptPath string
+	timeout    string
+	compiled   *lua.FunctionProto
+	// running prevents a run from starting before the previous one finishes.
+	running atomic.Bool
+}
+
+// loadScheduleFile loads jobs from a YAML file. Script paths are relative to the
+// directory of the file, and jobs without timeout use --timeout.
+//
+//	jobs:
+//	  - name: cleanup
+//	    schedule: "*/5 * * * *"
+//	    file: cleanup.lua
+//	    timeout: 1m
+func loadScheduleFile(path string) ([]*job, error) {
+	content, err := os.ReadFile(path)
+	if err != nil {
+		return nil, err
+	}
+	var config struct {
+		Jobs []struct {
+			Name     string `yaml:"name"`
+			Schedule string `yaml:"schedule"`
+			File     string `yaml:"file"`
+			Timeout  string `yaml:"timeout"`
+		} `yaml:"jobs"`
+	}
+	if err := yaml.Unmarshal(content, &config); err != nil {
+		return nil, fmt.Errorf("%s: %w", path, err)
+	}
+
+	names := make(map[string]bool)
+	jobs := make([]*job, 0, len(config.Jobs))
+	for _, j := range config.Jobs {
+		if j.Name == "" {
+			return nil, fmt.Errorf("%s: name of job is required", path)
+		}
+		if names[j.Name] {
+			return nil, fmt.Errorf("%s: job %q is defined more than once", path, j.Name)
+		}
+		names[j.Name] = true
+		if j.File == "" {
+			return nil, fmt.Errorf("%s: script of job %q is required", path, j.Name)
+		}
+		schedule, err := cron.Parse(j.Schedule)
+		if err != nil {
+			return nil, fmt.Errorf("%s: job %q: %w", path, j.Name, err)
+		}
+		jobTimeout := j.Timeout
+		if jobTimeout == "" {
+			jobTimeout = timeout
+		}
+		if _, err := time.ParseDuration(jobTimeout); err != nil {
+			return nil, fmt.Errorf("%s: job %q: invalid timeout: %w", path, j.Name, err)
+		}
+		scriptPath := j.File
+		if !filepath.IsAbs(scriptPath) {
+			scriptPath = filepath.Join(filepath.Dir(path), scriptPath)
+		}
+		jobs = append(jobs, &job{name: j.Name, schedule: schedule, scriptPath: scriptPath, timeout: jobTimeout})
+	}
+	return jobs, nil
+}
+
+// compile compiles the script of the job once, so every run only evaluates it.
+func (j *job) compile(e *eval_context.EvalContext) error {
+	file, err := os.Open(j.scriptPath)
+	if err != nil {
+		return err
+	}
+	defer file.Close()
+	compiled, err := e.Compile(file, j.scriptPath)
+	if err != nil {
+		return err
+	}
+	j.compiled = compiled
+	return nil
+}
+
+// loop starts a run whenever the schedule matches until ctx is cancelled. A run
+// is skipped when the previous one is still running.
+func (j *job) loop(ctx context.Context, e *eval_context.EvalContext, runs *sync.WaitGroup) {
+	jobLogger := log.With().Str("job", j.name).Logger()
+	for {
+		next := j.schedule.Next(time.Now())
+		if next.IsZero() {
+			jobLogger.Warn().Msg("job will never run again")
+			return
+		}
+		jobLogger.Debug().Time("scheduled_at", next).Msg("job scheduled")
+
+		timer := time.NewTimer(time.Until(next))
+		select {
+		case <-ctx.Done():
+			timer.Stop()
+			return
+		case <-timer.C:
+		}
+
+		if !j.start(e, next, runs) {
+			jobLogger.Warn().Time("scheduled_at", next).Msg("job skipped because the previous run is still running")
+		}
+	}
+}
+
+// start starts a run in the background and reports whether it did. It does not
+// when the previous run is still running.
+func (j *job) start(e *eval_context.EvalContext, scheduledAt time.Time, runs *sync.WaitGroup) bool {
+	if !j.running.CompareAndSwap(false, true) {
+		return false
+	}
+	runs.Add(1)
+	go func() {
+		defer runs.Done()
+		defer j.running.Store(false)
+		j.run(e, scheduledAt)
+	}()
+	return true
+}
+
+// run evaluates the script once. Running jobs are not cancelled on shutdown but
+// limited by their timeouts.
+func (j *job) run(e *eval_context.EvalContext, scheduledAt time.Time) {
+	jobLogger := log.With().Str("job", j.name).Time("scheduled_at", scheduledAt).Logger()
+
+	var state sync.Map
+	state.Store("schedule", map[string]interface{}{
+		"name":         j.name,
+		"scheduled_at": scheduledAt.Format(time.RFC3339),
+	})
+
+	ctx, cancel, err := setupTimeoutContext(context.Background(), j.timeout)
+	if err != nil {
+		jobLogger.Error().Err(err).Msg("failed to set timeout")
+		return
+	}
+	defer cancel()
+
+	start := time.Now()
+	var w bytes.Buffer
+	res, err := e.Eval(ctx, j.compiled, &state, nil, &w)
+	duration := time.Since(start)
+	if err != nil {
+		jobLogger.Error().Err(err).Str("file_path", j.scriptPath).Stringer("duration", duration).Msg("job errored")
+		return
+	}
+
+	logged := jobLogger.Info().Stringer("duration", duration)
+	if w.Len() > 0 {
+		logged = logged.Str("output", w.String())
+	} else if res != nil {
+		if encoded, err := json.Marshal(res); err == nil {
+			logged = logged.RawJSON("result", encoded)
+		}
+	}
+	logged.Msg("job finished")
+}
+
+var (
+	scheduleFilePath string
+	scheduleCmd      = &cobra.Command{
+		Use:   "schedule",
+		Short: "Run Lua scripts periodically",
+		Long:  "Run Lua scripts periodically according to cron expressions in a schedule file",
+		RunE: func(cmd *cobra.Command, args []string) error {
+			jobs, err := loadScheduleFile(scheduleFilePath)
+			if err != nil {
+				return err
+			}
+			if len(jobs) == 0 {
+				return errors.New("no job is defined")
+			}
+			parsedSweepInterval, err := time.ParseDuration(sweepInterval)
+			if err != nil {
+				return err
+			}
+
+			store, err := openStore()
+			if err != nil {
+				return err
+			}
+			defer store.Close()
+			e, err := newEvalContext(store)
+			if err != nil {
+				return err
+			}
+			defer e.Close()
+
+			for _, j := range jobs {
+				if err := j.compile(e); err != nil {
+					return err
+				}
+			}
+
+			ctx, stop := signal.NotifyContext(context.Background(), os.Interrupt, syscall.SIGTERM)
+			defer stop()
+
+			var background, runs sync.WaitGroup
+			if parsedSweepInterval > 0 {
+				background.Add(1)
+				go func() {
+					defer background.Done()
+					sweepExpired(ctx, store, parsedSweepInterval)
+				}()
+			}
+			for _, j := range jobs {
+				background.Add(1)
+				go func() {
+					defer background.Done()
+					j.loop(ctx, e, &runs)
+				}()
+				log.Info().Str("job", j.name).Str("file_path", j.scriptPath).Msg("job registered")
+			}
+
+			<-ctx.Done()
+			// a second signal terminates the process immediately
+			stop()
+			log.Info().Msg("waiting for running jobs")
+			background.Wait()
+			runs.Wait()
+			log.Info().Msg("shut down")
+			return nil
+		},
+	}
+)
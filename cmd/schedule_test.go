@@ -0,0 +1,164 @@
+package cmd
+
+import (
+	"context"
+	"net/http"
+	"os"
+	"path/filepath"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/henry40408/lmb/internal/cron"
+	"github.com/henry40408/lmb/internal/eval_context"
+	"github.com/stretchr/testify/assert"
+)
+
+func TestLoadScheduleFile(t *testing.T) {
+	testCases := []struct {
+		name     string
+		content  string
+		jobs     []string
+		timeouts []string
+		err      string
+	}{
+		{
+			"jobs",
+			"jobs:\n  - name: a\n    schedule: '*/5 * * * *'\n    file: a.lua\n    timeout: 1m\n  - name: b\n    schedule: '@daily'\n    file: /b.lua\n",
+			[]string{"a", "b"},
+			[]string{"1m", "30s"},
+			"",
+		},
+		{"empty", "", []string{}, []string{}, ""},
+		{"invalid YAML", "jobs: [", nil, nil, "schedule.yaml"},
+		{"missing name", "jobs:\n  - schedule: '@daily'\n    file: a.lua\n", nil, nil, "name of job is required"},
+		{"duplicate name", "jobs:\n  - name: a\n    schedule: '@daily'\n    file: a.lua\n  - name: a\n    schedule: '@hourly'\n    file: b.lua\n", nil, nil, `job "a" is defined more than once`},
+		{"missing script", "jobs:\n  - name: a\n    schedule: '@daily'\n", nil, nil, `script of job "a" is required`},
+		{"invalid cron", "jobs:\n  - name: a\n    schedule: '* * *'\n    file: a.lua\n", nil, nil, `job "a"`},
+		{"invalid timeout", "jobs:\n  - name: a\n    schedule: '@daily'\n    file: a.lua\n    timeout: soon\n", nil, nil, `job "a": invalid timeout`},
+	}
+	for _, tc := range testCases {
+		t.Run(tc.name, func(t *testing.T) {
+			dir := t.TempDir()
+			path := filepath.Join(dir, "schedule.yaml")
+			assert.NoError(t, os.WriteFile(path, []byte(tc.content), 0o644))
+
+			jobs, err := loadScheduleFile(path)
+			if tc.err != "" {
+				assert.ErrorContains(t, err, tc.err)
+				return
+			}
+			assert.NoError(t, err)
+			names, timeouts := []string{}, []string{}
+			for _, j := range jobs {
+				names = append(names, j.name)
+				timeouts = append(timeouts, j.timeout)
+			}
+			assert.Equal(t, tc.jobs, names)
+			assert.Equal(t, tc.timeouts, timeouts)
+			if len(jobs) == 2 {
+				// relative scripts are resolved against the directory of the file
+				assert.Equal(t, filepath.Join(dir, "a.lua"), jobs[0].scriptPath)
+				assert.Equal(t, "/b.lua", jobs[1].scriptPath)
+			}
+		})
+	}
+}
+
+// newTestJob returns a job running script, which is compiled by e.
+func newTestJob(t *testing.T, e *eval_context.EvalContext, expr, script string) *job {
+	schedule, err := cron.Parse(expr)
+	assert.NoError(t, err)
+	scriptPath := filepath.Join(t.TempDir(), "job.lua")
+	assert.NoError(t, os.WriteFile(scriptPath, []byte(script), 0o644))
+	j := &job{name: "job", schedule: schedule, scriptPath: scriptPath, timeout: "5s"}
+	assert.NoError(t, j.compile(e))
+	return j
+}
+
+func TestJobRun(t *testing.T) {
+	e, s := eval_context.NewTestEvalContext(http.DefaultClient)
+	defer s.Close()
+	defer e.Close()
+
+	j := newTestJob(t, e, "@daily", `
+  local m = require('@lmb')
+  m.store.seen = m.state.schedule.name .. ' ' .. m.state.schedule.scheduled_at
+  `)
+	scheduledAt := time.Date(2026, 1, 2, 3, 4, 0, 0, time.UTC)
+	j.run(e, scheduledAt)
+
+	seen, err := s.Get("seen")
+	assert.NoError(t, err)
+	assert.Equal(t, "job 2026-01-02T03:04:00Z", seen)
+}
+
+func TestJobStart(t *testing.T) {
+	e, s := eval_context.NewTestEvalContext(http.DefaultClient)
+	defer s.Close()
+	defer e.Close()
+
+	j := newTestJob(t, e, "@daily", `
+  local m = require('@lmb')
+  local w = m.store:watcher('release')
+  m.store:incr('runs')
+  w:wait(5)
+  `)
+	// release waits until the nth run is waiting, and lets it finish
+	var runs sync.WaitGroup
+	release := func(n int64) {
+		assert.Eventually(t, func() bool {
+			count, _ := s.Get("runs")
+			return count == n
+		}, time.Second, 10*time.Millisecond)
+		assert.NoError(t, s.Put("release", n))
+		runs.Wait()
+	}
+
+	start := time.Now()
+	assert.True(t, j.start(e, time.Now(), &runs))
+	// the tick is skipped while the previous run is still running
+	assert.False(t, j.start(e, time.Now(), &runs))
+	release(1)
+	assert.True(t, j.start(e, time.Now(), &runs))
+	release(2)
+	assert.Less(t, time.Since(start), 5*time.Second)
+}
+
+func TestJobLoop(t *testing.T) {
+	e, s := eval_context.NewTestEvalContext(http.DefaultClient)
+	defer s.Close()
+	defer e.Close()
+
+	testCases := []struct {
+		name   string
+		expr   string
+		cancel bool
+	}{
+		{"cancelled", "@daily", true},
+		// February 30th never comes
+		{"never", "0 0 30 2 *", false},
+	}
+	for _, tc := range testCases {
+		t.Run(tc.name, func(t *testing.T) {
+			j := newTestJob(t, e, tc.expr, "return 1")
+			ctx, cancel := context.WithCancel(context.Background())
+			defer cancel()
+			if tc.cancel {
+				time.AfterFunc(50*time.Millisecond, cancel)
+			}
+
+			var runs sync.WaitGroup
+			done := make(chan struct{})
+			go func() {
+				defer close(done)
+				j.loop(ctx, e, &runs)
+			}()
+			select {
+			case <-done:
+			case <-time.After(time.Second):
+				t.Fatal("loop did not return")
+			}
+		})
+	}
+}
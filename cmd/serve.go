@@ -2,13 +2,19 @@ package cmd
 
 import (
 	"bytes"
-	"fmt"
+	"context"
+	"encoding/json"
+	"errors"
 	"io"
+	"net"
 	"net/http"
 	"os"
+	"os/signal"
+	"runtime"
 	"strconv"
 	"strings"
 	"sync"
+	"syscall"
 	"time"
 	"unicode"
 
@@ -36,25 +42,173 @@ func (r *responseRecorder) WriteHeader(statusCode int) {
 	r.ResponseWriter.WriteHeader(statusCode)
 }
 
+func (r *responseRecorder) Unwrap() http.ResponseWriter {
+	return r.ResponseWriter
+}
+
 func init() {
 	serveCmd.Flags().StringVar(&bind, "bind", "127.0.0.1:3000", "Bind")
-	serveCmd.Flags().StringVar(&scriptPath, "file", "", "Script path (use '-' for stdin)")
+	serveCmd.Flags().StringVar(&scriptPath, "file", "", "Script path (use '-' for stdin) handling requests not matched by other routes")
+	serveCmd.Flags().IntVar(&poolSize, "pool-size", runtime.GOMAXPROCS(0), "Number of idle Lua states kept for reuse (0 to disable)")
+	serveCmd.Flags().StringArrayVar(&routeSpecs, "route", nil, "Route in the form of [METHOD:]PATH=SCRIPT e.g. GET:/hooks/{name}=hook.lua, can be repeated")
+	serveCmd.Flags().StringVar(&routesFilePath, "routes-file", "", "Path to YAML file of routes")
+	serveCmd.Flags().StringVar(&shutdownTimeout, "shutdown-timeout", "10s", "Time to wait for running requests on shutdown in human-readable format e.g. 30s, 1m30s")
+	serveCmd.Flags().BoolVar(&stream, "stream", false, "Send what scripts write to clients immediately instead of buffering the response")
+	serveCmd.Flags().BoolVar(&watch, "watch", false, "Reload scripts when they change")
+	serveCmd.Flags().StringVar(&watchInterval, "watch-interval", "1s", "Interval to check scripts for changes in human-readable format e.g. 500ms, 1s")
+	serveCmd.Flags().StringVar(&sweepInterval, "store-sweep-interval", "1m", "Interval to delete expired values from store in human-readable format e.g. 30s, 1m30s (0 to disable)")
 	rootCmd.AddCommand(serveCmd)
 }
 
-func setHeadersFromState(w http.ResponseWriter, state *sync.Map) {
-	rawHeaders, ok := state.Load("headers")
-	if !ok {
-		return
+func newRouteHandler(e *eval_context.EvalContext, rt *route) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		var state sync.Map
+
+		requestState := make(map[string]interface{})
+		requestHeaders := make(map[string]interface{})
+		for key, values := range r.Header {
+			requestHeaders[strings.Map(unicode.ToLower, key)] = values
+		}
+		requestQuery := make(map[string]interface{})
+		for key, values := range r.URL.Query() {
+			requestQuery[key] = values
+		}
+		requestState["headers"] = requestHeaders
+		requestState["path"] = r.URL.Path
+		requestState["method"] = r.Method
+		requestState["query"] = requestQuery
+		requestState["raw_query"] = r.URL.RawQuery
+		requestState["params"] = rt.pathParams(r)
+		state.Store("request", requestState)
+
+		// the context of the request is cancelled when the client disconnects, or
+		// when running evaluations are cancelled during shutdown
+		ctx, cancel, err := setupTimeoutContext(r.Context(), timeout)
+		if err != nil {
+			log.Error().Err(err).Msg("failed to set timeout")
+			http.Error(w, "", http.StatusInternalServerError)
+			return
+		}
+		defer cancel()
+
+		var buf bytes.Buffer
+		var output io.Writer = &buf
+		var sw *streamWriter
+		if stream {
+			sw = &streamWriter{w: w, state: &state}
+			output = sw
+		}
+		res, err := e.Eval(ctx, rt.compiled.Load(), &state, r.Body, output)
+		if err != nil {
+			log.Error().Err(err).Str("file_path", rt.scriptPath).Msg("request errored")
+			// the status code cannot be changed once the response is committed
+			if sw == nil || !sw.committed {
+				writeEvalError(w, err)
+			}
+			return
+		}
+		if sw != nil && sw.committed {
+			if res != nil {
+				log.Warn().Msg("result will be ignored because response is streamed")
+			}
+			return
+		}
+
+		if buf.Len() > 0 {
+			if res != nil {
+				log.Warn().Msg("result will be ignored because buffer is not empty")
+			}
+			setHeadersFromState(w, &state)
+			setStatusCode(w, &state)
+			_, err := io.Copy(w, &buf)
+			if err != nil {
+				log.Error().Err(err).Msg("request errored")
+			}
+			return
+		}
+
+		body, contentType, err := encodeResult(res)
+		if err != nil {
+			log.Error().Err(err).Str("file_path", rt.scriptPath).Msg("failed to encode result")
+			http.Error(w, "", http.StatusInternalServerError)
+			return
+		}
+		if contentType != "" {
+			w.Header().Set("Content-Type", contentType)
+		}
+		setHeadersFromState(w, &state)
+		setStatusCode(w, &state)
+		w.Write(body)
 	}
+}
 
-	headers, ok := rawHeaders.(map[string]interface{})
-	if !ok {
+// encodeResult renders the value returned by a script. Strings are sent as
+// plain text, nil as an empty body, and other values as JSON like lmb eval.
+func encodeResult(res interface{}) ([]byte, string, error) {
+	switch v := res.(type) {
+	case nil:
+		return nil, "", nil
+	case string:
+		return []byte(v), "text/plain; charset=utf-8", nil
+	default:
+		encoded, err := json.Marshal(v)
+		if err != nil {
+			return nil, "", err
+		}
+		return encoded, "application/json", nil
+	}
+}
+
+// writeEvalError answers with a blank 500, or with the error as JSON in debug
+// mode.
+func writeEvalError(w http.ResponseWriter, err error) {
+	if !debug {
+		http.Error(w, "", http.StatusInternalServerError)
 		return
 	}
+	var body bytes.Buffer
+	if !encodeEvalError(&body, err) {
+		http.Error(w, "", http.StatusInternalServerError)
+		return
+	}
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(http.StatusInternalServerError)
+	io.Copy(w, &body)
+}
 
-	for name, rawValue := range headers {
-		setHeader(w, name, rawValue)
+func sweepExpired(ctx context.Context, store store.Store, interval time.Duration) {
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-ctx.Done():
+			return
+		case <-ticker.C:
+		}
+		n, err := store.DeleteExpired()
+		if err != nil {
+			log.Error().Err(err).Msg("failed to delete expired values")
+			continue
+		}
+		log.Debug().Int64("count", n).Msg("expired values deleted")
+	}
+}
+
+// setHeadersFromState sets the headers in the state, and then the content type
+// in the state, which takes precedence over the headers.
+func setHeadersFromState(w http.ResponseWriter, state *sync.Map) {
+	if rawHeaders, ok := state.Load("headers"); ok {
+		if headers, ok := rawHeaders.(map[string]interface{}); ok {
+			for name, rawValue := range headers {
+				setHeader(w, name, rawValue)
+			}
+		}
+	}
+
+	if rawContentType, ok := state.Load("content_type"); ok {
+		if contentType, ok := rawContentType.(string); ok && contentType != "" {
+			w.Header().Set("Content-Type", contentType)
+		}
 	}
 }
 
@@ -62,6 +216,8 @@ func setHeader(w http.ResponseWriter, name string, value interface{}) {
 	switch v := value.(type) {
 	case string:
 		w.Header().Set(name, v)
+	case int64:
+		w.Header().Set(name, strconv.FormatInt(v, 10))
 	case float64:
 		w.Header().Set(name, strconv.FormatFloat(v, 'f', -1, 64))
 	case []interface{}:
@@ -69,6 +225,8 @@ func setHeader(w http.ResponseWriter, name string, value interface{}) {
 			switch typedItem := item.(type) {
 			case string:
 				w.Header().Add(name, typedItem)
+			case int64:
+				w.Header().Add(name, strconv.FormatInt(typedItem, 10))
 			case float64:
 				w.Header().Add(name, strconv.FormatFloat(typedItem, 'f', -1, 64))
 			}
@@ -89,6 +247,8 @@ func setStatusCode(w http.ResponseWriter, state *sync.Map) {
 	switch code := rawStatusCode.(type) {
 	case int:
 		statusCode = code
+	case int64:
+		statusCode = int(code)
 	case float64:
 		statusCode = int(code)
 	case string:
@@ -105,96 +265,110 @@ func setStatusCode(w http.ResponseWriter, state *sync.Map) {
 }
 
 var (
-	bind     string
-	serveCmd = &cobra.Command{
+	bind            string
+	poolSize        int
+	routeSpecs      []string
+	routesFilePath  string
+	stream          bool
+	sweepInterval   string
+	watch           bool
+	watchInterval   string
+	shutdownTimeout string
+	serveCmd        = &cobra.Command{
 		Use:   "serve",
 		Short: "Process HTTP requests with Lua script",
 		Long:  "Process HTTP requests with Lua script",
 		RunE: func(cmd *cobra.Command, args []string) error {
-			store, err := store.NewStore(storePath)
+			store, err := openStore()
 			if err != nil {
 				return err
 			}
-			parsedHttpTimeout, err := time.ParseDuration(httpTimeout)
+			parsedSweepInterval, err := time.ParseDuration(sweepInterval)
 			if err != nil {
 				return err
 			}
-			httpClient := http.Client{Timeout: parsedHttpTimeout}
-			e := eval_context.NewEvalContext(store, os.Stdin, &httpClient)
-
-			var reader io.Reader
-			if scriptPath == "-" {
-				reader = os.Stdin
-			} else {
-				file, err := os.Open(scriptPath)
-				if err != nil {
-					return err
-				}
-				defer file.Close()
-				reader = file
+			if poolSize < 0 {
+				return errors.New("pool size must not be negative")
 			}
-
-			compiled, err := e.Compile(reader, scriptPath)
+			// watchCtx is cancelled when shutdown begins, so that long polls waiting
+			// in m.store:watch are answered instead of holding the shutdown
+			watchCtx, stopWatches := context.WithCancel(context.Background())
+			defer stopWatches()
+			e, err := newEvalContext(store, eval_context.WithPoolSize(poolSize), eval_context.WithStoreWatchContext(watchCtx))
 			if err != nil {
 				return err
 			}
 
-			handler := func(w http.ResponseWriter, r *http.Request) {
-				var state sync.Map
+			routes, err := loadRoutes(routesFilePath, routeSpecs, scriptPath)
+			if err != nil {
+				return err
+			}
 
-				requestState := make(map[string]interface{})
-				requestHeaders := make(map[string]interface{})
-				for key, values := range r.Header {
-					requestHeaders[strings.Map(unicode.ToLower, key)] = values
+			mux := http.NewServeMux()
+			for _, route := range routes {
+				if err := route.compile(e); err != nil {
+					return err
 				}
-				requestState["headers"] = requestHeaders
-				requestState["path"] = r.URL.Path
-				requestState["method"] = r.Method
-				state.Store("request", requestState)
-
-				ctx, cancel, err := setupTimeoutContext(timeout)
-				if err != nil {
-					log.Error().Err(err).Msg("failed to set timeout")
-					http.Error(w, "", http.StatusInternalServerError)
-					return
+				if err := route.handle(mux, newRouteHandler(e, route)); err != nil {
+					return err
 				}
-				defer cancel()
+				log.Debug().Str("pattern", route.pattern).Str("file_path", route.scriptPath).Msg("route registered")
+			}
 
-				var buf bytes.Buffer
-				res, err := e.Eval(ctx, compiled, &state, &buf)
+			parsedShutdownTimeout, err := time.ParseDuration(shutdownTimeout)
+			if err != nil {
+				return err
+			}
+			var parsedWatchInterval time.Duration
+			if watch {
+				parsedWatchInterval, err = time.ParseDuration(watchInterval)
 				if err != nil {
-					log.Error().Err(err).Msg("request errored")
-					http.Error(w, "", http.StatusInternalServerError)
-					return
+					return err
 				}
-
-				setHeadersFromState(w, &state)
-				setStatusCode(w, &state)
-				if buf.Len() > 0 {
-					if res != nil {
-						log.Warn().Msg("result will be ignored because buffer is not empty")
-					}
-					_, err := io.Copy(w, &buf)
-					if err != nil {
-						log.Error().Err(err).Msg("request errored")
-						http.Error(w, "", http.StatusInternalServerError)
-						return
-					}
-				} else {
-					fmt.Fprintf(w, "%v", res)
+				if parsedWatchInterval <= 0 {
+					return errors.New("watch interval must be positive")
 				}
 			}
 
+			ctx, stop := signal.NotifyContext(context.Background(), os.Interrupt, syscall.SIGTERM)
+			defer stop()
+
+			var background sync.WaitGroup
+			if parsedSweepInterval > 0 {
+				background.Add(1)
+				go func() {
+					defer background.Done()
+					sweepExpired(ctx, store, parsedSweepInterval)
+				}()
+			}
+			if watch {
+				background.Add(1)
+				go func() {
+					defer background.Done()
+					watchRoutes(ctx, e, routes, parsedWatchInterval)
+				}()
+			}
+
+			// evalCtx is the parent of every request context. It is only cancelled
+			// when running evaluations do not finish in time during shutdown.
+			evalCtx, cancelEvals := context.WithCancel(context.Background())
+			defer cancelEvals()
+			var inFlight sync.WaitGroup
+
 			server := &http.Server{
-				Addr: bind,
+				Addr:        bind,
+				BaseContext: func(net.Listener) context.Context { return evalCtx },
 				Handler: http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
 					recorder := &responseRecorder{
 						ResponseWriter: w,
 						StatusCode:     http.StatusOK,
 					}
 
+					inFlight.Add(1)
+					defer inFlight.Done()
+
 					begin := time.Now()
-					handler(recorder, r)
+					mux.ServeHTTP(recorder, r)
 					duration := time.Since(begin)
 
 					if e := log.Debug(); e.Enabled() {
@@ -213,13 +387,38 @@ var (
 					}
 				}),
 			}
-			if err := server.ListenAndServe(); err != nil && err != http.ErrServerClosed {
+
+			serveErr := make(chan error, 1)
+			go func() {
+				serveErr <- server.ListenAndServe()
+			}()
+			select {
+			case err := <-serveErr:
+				stop()
+				background.Wait()
+				store.Close()
+				return err
+			case <-ctx.Done():
+			}
+			// a second signal terminates the process immediately
+			stop()
+
+			log.Info().Str("timeout", parsedShutdownTimeout.String()).Msg("shutting down")
+			stopWatches()
+			shutdownCtx, cancel := context.WithTimeout(context.Background(), parsedShutdownTimeout)
+			defer cancel()
+			if err := server.Shutdown(shutdownCtx); err != nil {
+				log.Warn().Err(err).Msg("cancel running evaluations")
+				cancelEvals()
+			}
+			inFlight.Wait()
+			background.Wait()
+			e.Close()
+
+			if err := store.Close(); err != nil {
 				return err
 			}
+			log.Info().Msg("shut down")
 			return nil
 		}}
 )
-
-func init() {
-	serveCmd.MarkFlagRequired("file")
-}
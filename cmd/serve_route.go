@@ -0,0 +1,224 @@
+package cmd
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"io"
+	"net/http"
+	"os"
+	"path/filepath"
+	"regexp"
+	"strings"
+	"sync/atomic"
+	"time"
+
+	"github.com/henry40408/lmb/internal/eval_context"
+	"github.com/rs/zerolog/log"
+	lua "github.com/yuin/gopher-lua"
+	"gopkg.in/yaml.v3"
+)
+
+// wildcardPattern matches wildcards of http.ServeMux patterns, e.g. {id} and
+// {path...}, but not {$}.
+var wildcardPattern = regexp.MustCompile(`\{([A-Za-z_][A-Za-z0-9_]*)(?:\.\.\.)?\}`)
+
+// route binds a script to a pattern of http.ServeMux, e.g. "GET /hooks/{id}".
+type route struct {
+	pattern    string
+	params     []string
+	scriptPath string
+	// compiled is swapped when the script is reloaded while requests are served.
+	compiled atomic.Pointer[lua.FunctionProto]
+	// modTime and size identify the compiled version of the script. They are
+	// only accessed by the goroutine compiling the script.
+	modTime time.Time
+	size    int64
+}
+
+func newRoute(method, path, scriptPath string) (*route, error) {
+	if !strings.HasPrefix(path, "/") {
+		return nil, fmt.Errorf("path %q must start with /", path)
+	}
+	if scriptPath == "" {
+		return nil, fmt.Errorf("script of %q is required", path)
+	}
+	pattern := path
+	if method != "" {
+		pattern = fmt.Sprintf("%s %s", strings.ToUpper(method), path)
+	}
+	var params []string
+	for _, match := range wildcardPattern.FindAllStringSubmatch(path, -1) {
+		params = append(params, match[1])
+	}
+	return &route{pattern: pattern, params: params, scriptPath: scriptPath}, nil
+}
+
+// parseRoute parses a route in the form of [METHOD:]PATH=SCRIPT, e.g.
+// GET:/hooks/{name}=hook.lua
+func parseRoute(spec string) (*route, error) {
+	target, scriptPath, ok := strings.Cut(spec, "=")
+	if !ok {
+		return nil, fmt.Errorf("invalid route %q, expect [METHOD:]PATH=SCRIPT", spec)
+	}
+	method, path := "", target
+	if !strings.HasPrefix(target, "/") {
+		method, path, ok = strings.Cut(target, ":")
+		if !ok {
+			return nil, fmt.Errorf("invalid route %q, expect [METHOD:]PATH=SCRIPT", spec)
+		}
+	}
+	return newRoute(method, path, scriptPath)
+}
+
+// loadRoutesFile loads routes from a YAML file. Script paths are relative to
+// the directory of the file.
+//
+//	routes:
+//	  - method: GET
+//	    path: /hooks/{name}
+//	    file: hook.lua
+func loadRoutesFile(path string) ([]*route, error) {
+	content, err := os.ReadFile(path)
+	if err != nil {
+		return nil, err
+	}
+	var config struct {
+		Routes []struct {
+			Method string `yaml:"method"`
+			Path   string `yaml:"path"`
+			File   string `yaml:"file"`
+		} `yaml:"routes"`
+	}
+	if err := yaml.Unmarshal(content, &config); err != nil {
+		return nil, fmt.Errorf("%s: %w", path, err)
+	}
+	routes := make([]*route, 0, len(config.Routes))
+	for _, r := range config.Routes {
+		scriptPath := r.File
+		if scriptPath != "" && scriptPath != "-" && !filepath.IsAbs(scriptPath) {
+			scriptPath = filepath.Join(filepath.Dir(path), scriptPath)
+		}
+		route, err := newRoute(r.Method, r.Path, scriptPath)
+		if err != nil {
+			return nil, fmt.Errorf("%s: %w", path, err)
+		}
+		routes = append(routes, route)
+	}
+	return routes, nil
+}
+
+// loadRoutes collects routes from the routes file, the route specs and the
+// script handling requests not matched by other routes, in this order.
+func loadRoutes(routesFilePath string, specs []string, scriptPath string) ([]*route, error) {
+	var routes []*route
+	if routesFilePath != "" {
+		loaded, err := loadRoutesFile(routesFilePath)
+		if err != nil {
+			return nil, err
+		}
+		routes = append(routes, loaded...)
+	}
+	for _, spec := range specs {
+		route, err := parseRoute(spec)
+		if err != nil {
+			return nil, err
+		}
+		routes = append(routes, route)
+	}
+	if scriptPath != "" {
+		route, _ := newRoute("", "/", scriptPath)
+		routes = append(routes, route)
+	}
+	if len(routes) == 0 {
+		return nil, errors.New("either --file, --route or --routes-file is required")
+	}
+	return routes, nil
+}
+
+// compile compiles the script of the route once, so requests only evaluate it.
+func (rt *route) compile(e *eval_context.EvalContext) error {
+	var reader io.Reader
+	if rt.scriptPath == "-" {
+		reader = os.Stdin
+	} else {
+		file, err := os.Open(rt.scriptPath)
+		if err != nil {
+			return err
+		}
+		defer file.Close()
+		info, err := file.Stat()
+		if err != nil {
+			return err
+		}
+		rt.modTime, rt.size = info.ModTime(), info.Size()
+		reader = file
+	}
+	compiled, err := e.Compile(reader, rt.scriptPath)
+	if err != nil {
+		return err
+	}
+	rt.compiled.Store(compiled)
+	return nil
+}
+
+// reload recompiles the script when it has changed since it was compiled. When
+// the new version fails to compile, the previous one keeps serving requests.
+func (rt *route) reload(e *eval_context.EvalContext) {
+	if rt.scriptPath == "-" {
+		return
+	}
+	info, err := os.Stat(rt.scriptPath)
+	if err != nil {
+		if !rt.modTime.IsZero() {
+			log.Error().Err(err).Str("file_path", rt.scriptPath).Msg("failed to reload script")
+			rt.modTime, rt.size = time.Time{}, 0
+		}
+		return
+	}
+	if info.ModTime().Equal(rt.modTime) && info.Size() == rt.size {
+		return
+	}
+	if err := rt.compile(e); err != nil {
+		log.Error().Err(err).Str("file_path", rt.scriptPath).Msg("failed to reload script, previous version is kept")
+		return
+	}
+	log.Info().Str("file_path", rt.scriptPath).Str("pattern", rt.pattern).Msg("script reloaded")
+}
+
+// watchRoutes polls the scripts of routes and reloads them when they change.
+func watchRoutes(ctx context.Context, e *eval_context.EvalContext, routes []*route, interval time.Duration) {
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-ctx.Done():
+			return
+		case <-ticker.C:
+		}
+		for _, rt := range routes {
+			rt.reload(e)
+		}
+	}
+}
+
+// pathParams returns the values of the wildcards matched by the request.
+func (rt *route) pathParams(r *http.Request) map[string]interface{} {
+	params := make(map[string]interface{}, len(rt.params))
+	for _, name := range rt.params {
+		params[name] = r.PathValue(name)
+	}
+	return params
+}
+
+// handle registers the route on mux. http.ServeMux panics on invalid or
+// conflicting patterns, so the panic is turned into an error.
+func (rt *route) handle(mux *http.ServeMux, handler http.Handler) (err error) {
+	defer func() {
+		if rcv := recover(); rcv != nil {
+			err = fmt.Errorf("invalid route %q: %v", rt.pattern, rcv)
+		}
+	}()
+	mux.Handle(rt.pattern, handler)
+	return nil
+}
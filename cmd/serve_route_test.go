@@ -0,0 +1,213 @@
+package cmd
+
+import (
+	"bytes"
+	"context"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/henry40408/lmb/internal/eval_context"
+	"github.com/stretchr/testify/assert"
+)
+
+func TestParseRoute(t *testing.T) {
+	testCases := []struct {
+		spec       string
+		pattern    string
+		params     []string
+		scriptPath string
+		err        string
+	}{
+		{"/hooks=hook.lua", "/hooks", nil, "hook.lua", ""},
+		{"GET:/hooks/{name}=hook.lua", "GET /hooks/{name}", []string{"name"}, "hook.lua", ""},
+		{"post:/files/{dir}/{path...}=file.lua", "POST /files/{dir}/{path...}", []string{"dir", "path"}, "file.lua", ""},
+		{"GET:/{$}=index.lua", "GET /{$}", nil, "index.lua", ""},
+		{"/hooks", "", nil, "", "expect [METHOD:]PATH=SCRIPT"},
+		{"GET/hooks=hook.lua", "", nil, "", "expect [METHOD:]PATH=SCRIPT"},
+		{"GET:hooks=hook.lua", "", nil, "", `path "hooks" must start with /`},
+		{"/hooks=", "", nil, "", `script of "/hooks" is required`},
+	}
+	for _, tc := range testCases {
+		t.Run(tc.spec, func(t *testing.T) {
+			rt, err := parseRoute(tc.spec)
+			if tc.err != "" {
+				assert.ErrorContains(t, err, tc.err)
+				return
+			}
+			assert.NoError(t, err)
+			assert.Equal(t, tc.pattern, rt.pattern)
+			assert.Equal(t, tc.params, rt.params)
+			assert.Equal(t, tc.scriptPath, rt.scriptPath)
+		})
+	}
+}
+
+func TestLoadRoutesFile(t *testing.T) {
+	testCases := []struct {
+		name     string
+		content  string
+		patterns []string
+		scripts  []string
+		err      string
+	}{
+		{
+			"routes",
+			"routes:\n  - method: GET\n    path: /hooks/{name}\n    file: hook.lua\n  - path: /abs\n    file: /abs.lua\n  - path: /stdin\n    file: '-'\n",
+			[]string{"GET /hooks/{name}", "/abs", "/stdin"},
+			[]string{"hook.lua", "/abs.lua", "-"},
+			"",
+		},
+		{"empty", "", []string{}, []string{}, ""},
+		{"invalid YAML", "routes: [", nil, nil, "routes.yaml"},
+		{"missing path", "routes:\n  - file: hook.lua\n", nil, nil, `path "" must start with /`},
+		{"missing file", "routes:\n  - path: /hooks\n", nil, nil, `script of "/hooks" is required`},
+	}
+	for _, tc := range testCases {
+		t.Run(tc.name, func(t *testing.T) {
+			dir := t.TempDir()
+			path := filepath.Join(dir, "routes.yaml")
+			assert.NoError(t, os.WriteFile(path, []byte(tc.content), 0o644))
+
+			routes, err := loadRoutesFile(path)
+			if tc.err != "" {
+				assert.ErrorContains(t, err, tc.err)
+				return
+			}
+			assert.NoError(t, err)
+			patterns, scripts := []string{}, []string{}
+			for _, rt := range routes {
+				patterns = append(patterns, rt.pattern)
+				scripts = append(scripts, rt.scriptPath)
+			}
+			assert.Equal(t, tc.patterns, patterns)
+			for i, script := range tc.scripts {
+				// relative scripts are resolved against the directory of the file
+				if script != "-" && !filepath.IsAbs(script) {
+					tc.scripts[i] = filepath.Join(dir, script)
+				}
+			}
+			assert.Equal(t, tc.scripts, scripts)
+		})
+	}
+
+	_, err := loadRoutesFile(filepath.Join(t.TempDir(), "missing.yaml"))
+	assert.ErrorIs(t, err, os.ErrNotExist)
+}
+
+func TestLoadRoutes(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "routes.yaml")
+	assert.NoError(t, os.WriteFile(path, []byte("routes:\n  - path: /a\n    file: a.lua\n"), 0o644))
+
+	routes, err := loadRoutes(path, []string{"GET:/b=b.lua"}, "c.lua")
+	assert.NoError(t, err)
+	var patterns []string
+	for _, rt := range routes {
+		patterns = append(patterns, rt.pattern)
+	}
+	assert.Equal(t, []string{"/a", "GET /b", "/"}, patterns)
+
+	_, err = loadRoutes("", nil, "")
+	assert.ErrorContains(t, err, "either --file, --route or --routes-file is required")
+	_, err = loadRoutes("", []string{"/b"}, "c.lua")
+	assert.ErrorContains(t, err, "expect [METHOD:]PATH=SCRIPT")
+}
+
+func TestRouteHandle(t *testing.T) {
+	testCases := []struct {
+		spec   string
+		method string
+		target string
+		status int
+		params map[string]interface{}
+	}{
+		{"GET:/hooks/{name}=hook.lua", http.MethodGet, "/hooks/a", http.StatusOK, map[string]interface{}{"name": "a"}},
+		// GET patterns match HEAD requests as well
+		{"GET:/hooks/{name}=hook.lua", http.MethodHead, "/hooks/a", http.StatusOK, map[string]interface{}{"name": "a"}},
+		{"GET:/hooks/{name}=hook.lua", http.MethodPost, "/hooks/a", http.StatusMethodNotAllowed, nil},
+		{"GET:/hooks/{name}=hook.lua", http.MethodGet, "/hooks", http.StatusNotFound, nil},
+		{"/files/{path...}=file.lua", http.MethodPut, "/files/a/b", http.StatusOK, map[string]interface{}{"path": "a/b"}},
+		{"/=index.lua", http.MethodGet, "/a", http.StatusOK, map[string]interface{}{}},
+	}
+	for _, tc := range testCases {
+		t.Run(tc.method+" "+tc.target, func(t *testing.T) {
+			rt, err := parseRoute(tc.spec)
+			assert.NoError(t, err)
+			var params map[string]interface{}
+			mux := http.NewServeMux()
+			assert.NoError(t, rt.handle(mux, http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+				params = rt.pathParams(r)
+			})))
+
+			w := httptest.NewRecorder()
+			mux.ServeHTTP(w, httptest.NewRequest(tc.method, tc.target, nil))
+			assert.Equal(t, tc.status, w.Code)
+			assert.Equal(t, tc.params, params)
+		})
+	}
+}
+
+func TestRouteHandleInvalid(t *testing.T) {
+	mux := http.NewServeMux()
+	rt, err := parseRoute("GET:/a/{id}=a.lua")
+	assert.NoError(t, err)
+	assert.NoError(t, rt.handle(mux, http.NotFoundHandler()))
+
+	// conflicting and malformed patterns are errors instead of panics
+	for _, spec := range []string{"GET:/a/{name}=b.lua", "GET:/b/{id=c.lua"} {
+		rt, err := parseRoute(spec)
+		assert.NoError(t, err)
+		assert.ErrorContains(t, rt.handle(mux, http.NotFoundHandler()), "invalid route", spec)
+	}
+}
+
+func TestRouteReload(t *testing.T) {
+	e, s := eval_context.NewTestEvalContext(http.DefaultClient)
+	defer s.Close()
+	defer e.Close()
+
+	scriptPath := filepath.Join(t.TempDir(), "script.lua")
+	// write changes the script and its modification time, which may not change
+	// between quick writes
+	modTime := time.Now()
+	write := func(script string) {
+		assert.NoError(t, os.WriteFile(scriptPath, []byte(script), 0o644))
+		modTime = modTime.Add(time.Second)
+		assert.NoError(t, os.Chtimes(scriptPath, modTime, modTime))
+	}
+	eval := func(rt *route) interface{} {
+		var state sync.Map
+		var buf bytes.Buffer
+		res, err := e.Eval(context.Background(), rt.compiled.Load(), &state, nil, &buf)
+		assert.NoError(t, err)
+		return res
+	}
+
+	write("return 1")
+	rt, err := newRoute("", "/", scriptPath)
+	assert.NoError(t, err)
+	assert.NoError(t, rt.compile(e))
+	assert.Equal(t, int64(1), eval(rt))
+
+	write("return 2")
+	rt.reload(e)
+	assert.Equal(t, int64(2), eval(rt))
+
+	// the previous version keeps serving when the new one fails to compile
+	write("return return")
+	rt.reload(e)
+	assert.Equal(t, int64(2), eval(rt))
+
+	// and when the script is removed
+	assert.NoError(t, os.Remove(scriptPath))
+	rt.reload(e)
+	assert.Equal(t, int64(2), eval(rt))
+
+	write("return 3")
+	rt.reload(e)
+	assert.Equal(t, int64(3), eval(rt))
+}
@@ -0,0 +1,43 @@
+package cmd
+
+import (
+	"errors"
+	"net/http"
+	"sync"
+)
+
+// streamWriter sends what a script writes straight to the client. The status
+// code and headers are taken from the state and committed on the first write or
+// flush, so they must be set before.
+type streamWriter struct {
+	w         http.ResponseWriter
+	state     *sync.Map
+	committed bool
+}
+
+func (s *streamWriter) commit() {
+	if s.committed {
+		return
+	}
+	s.committed = true
+	setHeadersFromState(s.w, s.state)
+	setStatusCode(s.w, s.state)
+}
+
+func (s *streamWriter) Write(b []byte) (int, error) {
+	s.commit()
+	n, err := s.w.Write(b)
+	if err != nil {
+		return n, err
+	}
+	return n, s.Flush()
+}
+
+func (s *streamWriter) Flush() error {
+	s.commit()
+	err := http.NewResponseController(s.w).Flush()
+	if errors.Is(err, http.ErrNotSupported) {
+		return nil
+	}
+	return err
+}
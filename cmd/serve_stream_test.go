@@ -0,0 +1,99 @@
+package cmd
+
+import (
+	"bufio"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"sync"
+	"testing"
+
+	"github.com/henry40408/lmb/internal/eval_context"
+	"github.com/stretchr/testify/assert"
+)
+
+func TestStreamWriter(t *testing.T) {
+	testCases := []struct {
+		name   string
+		commit func(sw *streamWriter) error
+	}{
+		{"write", func(sw *streamWriter) error {
+			_, err := sw.Write([]byte("a"))
+			return err
+		}},
+		{"flush", func(sw *streamWriter) error { return sw.Flush() }},
+	}
+	for _, tc := range testCases {
+		t.Run(tc.name, func(t *testing.T) {
+			var state sync.Map
+			state.Store("status_code", int64(http.StatusCreated))
+			state.Store("headers", map[string]interface{}{"x-a": "1"})
+			w := httptest.NewRecorder()
+			sw := &streamWriter{w: w, state: &state}
+
+			assert.NoError(t, tc.commit(sw))
+			assert.True(t, sw.committed)
+			assert.True(t, w.Flushed)
+			assert.Equal(t, http.StatusCreated, w.Code)
+			assert.Equal(t, "1", w.Header().Get("X-A"))
+
+			// later changes of the state are ignored
+			state.Store("status_code", int64(http.StatusAccepted))
+			state.Store("headers", map[string]interface{}{"x-a": "2", "x-b": "3"})
+			_, err := sw.Write([]byte("b"))
+			assert.NoError(t, err)
+			assert.Equal(t, http.StatusCreated, w.Result().StatusCode)
+			assert.Equal(t, "1", w.Result().Header.Get("X-A"))
+			assert.Empty(t, w.Result().Header.Get("X-B"))
+		})
+	}
+}
+
+func TestServeStream(t *testing.T) {
+	stream = true
+	defer func() { stream = false }()
+
+	scriptPath := filepath.Join(t.TempDir(), "sse.lua")
+	assert.NoError(t, os.WriteFile(scriptPath, []byte(`
+  local io = require('io')
+  local m = require('@lmb')
+  local w = m.store:watcher('received')
+  m.state.status_code = 201
+  m.state.headers = { ['content-type'] = 'text/event-stream' }
+  io.write('data: 1\n\n')
+  m.response:flush()
+  -- the client receives the first event before the script returns
+  local received = w:wait(5)
+  m.state.headers = { ['x-late'] = 'ignored' }
+  io.write('data: ' .. tostring(received) .. '\n\n')
+  m.response:flush()
+  `), 0o644))
+	e, s := eval_context.NewTestEvalContext(http.DefaultClient)
+	defer s.Close()
+	defer e.Close()
+	rt, err := newRoute("", "/", scriptPath)
+	assert.NoError(t, err)
+	assert.NoError(t, rt.compile(e))
+	server := httptest.NewServer(newRouteHandler(e, rt))
+	defer server.Close()
+
+	res, err := http.Get(server.URL)
+	assert.NoError(t, err)
+	defer res.Body.Close()
+	assert.Equal(t, http.StatusCreated, res.StatusCode)
+	assert.Equal(t, "text/event-stream", res.Header.Get("Content-Type"))
+	assert.Empty(t, res.Header.Get("X-Late"))
+
+	reader := bufio.NewReader(res.Body)
+	line, err := reader.ReadString('\n')
+	assert.NoError(t, err)
+	assert.Equal(t, "data: 1\n", line)
+	assert.NoError(t, s.Put("received", "first"))
+
+	_, err = reader.ReadString('\n')
+	assert.NoError(t, err)
+	line, err = reader.ReadString('\n')
+	assert.NoError(t, err)
+	assert.Equal(t, "data: received\n", line)
+}
@@ -0,0 +1,132 @@
+package cmd
+
+import (
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+
+	"github.com/henry40408/lmb/internal/eval_context"
+	"github.com/stretchr/testify/assert"
+)
+
+func TestEncodeResult(t *testing.T) {
+	testCases := []struct {
+		name        string
+		res         interface{}
+		body        string
+		contentType string
+		err         bool
+	}{
+		{"nil", nil, "", "", false},
+		{"string", "hello", "hello", "text/plain; charset=utf-8", false},
+		{"empty string", "", "", "text/plain; charset=utf-8", false},
+		{"integer", int64(1), "1", "application/json", false},
+		{"boolean", true, "true", "application/json", false},
+		{"array", []interface{}{int64(1), "a"}, `[1,"a"]`, "application/json", false},
+		{"table", map[string]interface{}{"a": int64(1)}, `{"a":1}`, "application/json", false},
+		{"unencodable", map[string]interface{}{"a": func() {}}, "", "", true},
+	}
+	for _, tc := range testCases {
+		t.Run(tc.name, func(t *testing.T) {
+			body, contentType, err := encodeResult(tc.res)
+			if tc.err {
+				assert.Error(t, err)
+				return
+			}
+			assert.NoError(t, err)
+			assert.Equal(t, tc.body, string(body))
+			assert.Equal(t, tc.contentType, contentType)
+		})
+	}
+}
+
+func TestRouteHandlerContentType(t *testing.T) {
+	testCases := []struct {
+		name        string
+		script      string
+		body        string
+		contentType string
+	}{
+		{"string", "return 'hello'", "hello", "text/plain; charset=utf-8"},
+		{"table", "return { a = 1 }", `{"a":1}`, "application/json"},
+		{"nil", "return nil", "", ""},
+		{"content_type", "local m = require('@lmb'); m.state.content_type = 'text/html'; return '<p>hello</p>'", "<p>hello</p>", "text/html"},
+		{"content_type of table", "local m = require('@lmb'); m.state.content_type = 'application/vnd.api+json'; return { a = 1 }", `{"a":1}`, "application/vnd.api+json"},
+		{"header", "local m = require('@lmb'); m.state.headers = { ['content-type'] = 'text/csv' }; return 'a,b'", "a,b", "text/csv"},
+	}
+	for _, tc := range testCases {
+		t.Run(tc.name, func(t *testing.T) {
+			scriptPath := filepath.Join(t.TempDir(), "script.lua")
+			assert.NoError(t, os.WriteFile(scriptPath, []byte(tc.script), 0o644))
+			e, s := eval_context.NewTestEvalContext(http.DefaultClient)
+			defer s.Close()
+			defer e.Close()
+			rt, err := newRoute("", "/", scriptPath)
+			assert.NoError(t, err)
+			assert.NoError(t, rt.compile(e))
+
+			w := httptest.NewRecorder()
+			newRouteHandler(e, rt)(w, httptest.NewRequest(http.MethodGet, "/", nil))
+			assert.Equal(t, http.StatusOK, w.Code)
+			assert.Equal(t, tc.body, w.Body.String())
+			assert.Equal(t, tc.contentType, w.Header().Get("Content-Type"))
+		})
+	}
+}
+
+func TestWriteEvalErrorDebug(t *testing.T) {
+	e, s := eval_context.NewTestEvalContext(http.DefaultClient)
+	defer s.Close()
+	defer e.Close()
+
+	scriptPath := filepath.Join(t.TempDir(), "script.lua")
+	assert.NoError(t, os.WriteFile(scriptPath, []byte("local a = 1\nerror('boom')"), 0o644))
+	rt, err := newRoute("", "/", scriptPath)
+	assert.NoError(t, err)
+	assert.NoError(t, rt.compile(e))
+	_, syntaxErr := e.Compile(strings.NewReader("return return"), "syntax.lua")
+	assert.Error(t, syntaxErr)
+
+	testCases := []struct {
+		name      string
+		serve     func(w http.ResponseWriter)
+		kind      string
+		line      int
+		traceback bool
+	}{
+		{"syntax", func(w http.ResponseWriter) { writeEvalError(w, syntaxErr) }, "syntax", 1, false},
+		{"runtime", func(w http.ResponseWriter) {
+			newRouteHandler(e, rt)(w, httptest.NewRequest(http.MethodGet, "/", nil))
+		}, "runtime", 2, true},
+	}
+	for _, tc := range testCases {
+		t.Run(tc.name, func(t *testing.T) {
+			// errors are not revealed without --debug
+			w := httptest.NewRecorder()
+			tc.serve(w)
+			assert.Equal(t, http.StatusInternalServerError, w.Code)
+			assert.Equal(t, "\n", w.Body.String())
+
+			debug = true
+			defer func() { debug = false }()
+			w = httptest.NewRecorder()
+			tc.serve(w)
+			assert.Equal(t, http.StatusInternalServerError, w.Code)
+			assert.Equal(t, "application/json", w.Header().Get("Content-Type"))
+			var evalErr map[string]interface{}
+			assert.NoError(t, json.Unmarshal(w.Body.Bytes(), &evalErr), w.Body.String())
+			assert.Equal(t, tc.kind, evalErr["kind"])
+			assert.Equal(t, float64(tc.line), evalErr["line"])
+			assert.NotEmpty(t, evalErr["message"])
+			if tc.traceback {
+				assert.Contains(t, evalErr["traceback"], "stack traceback")
+			} else {
+				assert.NotContains(t, evalErr, "traceback")
+			}
+		})
+	}
+}
@@ -0,0 +1,400 @@
+package cmd
+
+import (
+	"bufio"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"os"
+	"strings"
+	"time"
+
+	"github.com/henry40408/lmb/internal/store"
+	"github.com/spf13/cobra"
+)
+
+// storeRecord is a line of the JSONL format used by export and import.
+// Namespace is only written when every namespace is exported.
+type storeRecord struct {
+	Namespace string      `json:"namespace,omitempty"`
+	Name      string      `json:"name"`
+	Value     interface{} `json:"value"`
+	ExpiresAt *time.Time  `json:"expires_at,omitempty"`
+}
+
+const exportPageSize = 100
+
+// historyRecord is a line printed by history.
+type historyRecord struct {
+	Value     interface{} `json:"value"`
+	Previous  interface{} `json:"previous"`
+	Script    string      `json:"script"`
+	ChangedAt time.Time   `json:"changed_at"`
+}
+
+var (
+	storeAllNamespaces bool
+	storeAt            string
+	storeFilePath      string
+	storeHistoryLimit  int
+	storePrefix        string
+	storeScriptPath    string
+	storeTTL           string
+)
+
+func init() {
+	storeCmd.PersistentFlags().StringVar(&storeScriptPath, "script", "", "Use the namespace of the script at path unless --store-namespace is set")
+	storeGetCmd.Flags().StringVar(&storeAt, "at", "", "Print the value as it was at the time in RFC3339 according to --store-history")
+	storeListCmd.Flags().StringVar(&storePrefix, "prefix", "", "Only list names with prefix")
+	storePutCmd.Flags().StringVar(&storeTTL, "ttl", "", "Expire value after duration in human-readable format e.g. 30s, 1m30s")
+	storeHistoryCmd.Flags().IntVar(&storeHistoryLimit, "limit", 10, "Maximum number of changes to print")
+	storeExportCmd.Flags().StringVar(&storeFilePath, "file", "-", "Path to write JSONL to (use '-' for stdout)")
+	storeExportCmd.Flags().BoolVar(&storeAllNamespaces, "all-namespaces", false, "Export values of every namespace with their namespaces")
+	storeImportCmd.Flags().StringVar(&storeFilePath, "file", "-", "Path to read JSONL from (use '-' for stdin)")
+
+	storeCmd.AddCommand(storeNamespacesCmd, storeListCmd, storeGetCmd, storePutCmd, storeDeleteCmd, storeHistoryCmd, storeExportCmd, storeImportCmd)
+	rootCmd.AddCommand(storeCmd)
+}
+
+// openNamespacedStore opens the store in the namespace selected by
+// --store-namespace or --script, or in the default namespace.
+func openNamespacedStore() (store.Store, error) {
+	s, err := openStore()
+	if err != nil {
+		return nil, err
+	}
+	if storeNamespace == "" && storeScriptPath == "" {
+		return s, nil
+	}
+	return s.Namespace(scriptNamespace(s, storeScriptPath)), nil
+}
+
+// exportNamespace writes the values of a namespace page by page. namespace is
+// written to records unless it is empty.
+func exportNamespace(encoder *json.Encoder, s store.Store, namespace string) error {
+	after := ""
+	for {
+		entries, err := s.Scan("", after, exportPageSize)
+		if err != nil {
+			return err
+		}
+		for _, entry := range entries {
+			record := storeRecord{Namespace: namespace, Name: entry.Name, Value: entry.Value}
+			if !entry.ExpiresAt.IsZero() {
+				record.ExpiresAt = &entry.ExpiresAt
+			}
+			if err := encoder.Encode(&record); err != nil {
+				return err
+			}
+			after = entry.Name
+		}
+		if len(entries) < exportPageSize {
+			return nil
+		}
+	}
+}
+
+func printJSON(value interface{}) error {
+	encoded, err := json.Marshal(value)
+	if err != nil {
+		return err
+	}
+	fmt.Printf("%s\n", string(encoded))
+	return nil
+}
+
+var (
+	storeCmd = &cobra.Command{
+		Use:   "store",
+		Short: "Inspect and edit the store",
+		Long:  "Inspect and edit the store. Values are displayed and accepted as JSON. Commands use the default namespace unless --store-namespace or --script is set.",
+	}
+	storeNamespacesCmd = &cobra.Command{
+		Use:   "namespaces",
+		Short: "List namespaces in the store",
+		Long:  "List namespaces holding values in the store",
+		Args:  cobra.NoArgs,
+		RunE: func(cmd *cobra.Command, args []string) error {
+			store, err := openStore()
+			if err != nil {
+				return err
+			}
+			defer store.Close()
+
+			namespaces, err := store.Namespaces()
+			if err != nil {
+				return err
+			}
+			for _, namespace := range namespaces {
+				fmt.Println(namespace)
+			}
+			return nil
+		},
+	}
+	storeListCmd = &cobra.Command{
+		Use:   "list",
+		Short: "List names in the store",
+		Long:  "List names in the store",
+		Args:  cobra.NoArgs,
+		RunE: func(cmd *cobra.Command, args []string) error {
+			store, err := openNamespacedStore()
+			if err != nil {
+				return err
+			}
+			defer store.Close()
+
+			names, err := store.Keys(storePrefix)
+			if err != nil {
+				return err
+			}
+			for _, name := range names {
+				fmt.Println(name)
+			}
+			return nil
+		},
+	}
+	storeGetCmd = &cobra.Command{
+		Use:   "get <name>",
+		Short: "Print a value as JSON",
+		Long:  "Print a value as JSON. With --at, print the value as it was at the time according to the history, or null when it was missing.",
+		Args:  cobra.ExactArgs(1),
+		RunE: func(cmd *cobra.Command, args []string) error {
+			store, err := openNamespacedStore()
+			if err != nil {
+				return err
+			}
+			defer store.Close()
+
+			if storeAt != "" {
+				at, err := time.Parse(time.RFC3339, storeAt)
+				if err != nil {
+					return fmt.Errorf("invalid time: %w", err)
+				}
+				value, err := store.GetAt(args[0], at)
+				if err != nil {
+					return err
+				}
+				return printJSON(value)
+			}
+			found, err := store.Has(args[0])
+			if err != nil {
+				return err
+			}
+			if !found {
+				return fmt.Errorf("%s not found", args[0])
+			}
+			value, err := store.Get(args[0])
+			if err != nil {
+				return err
+			}
+			return printJSON(value)
+		},
+	}
+	storePutCmd = &cobra.Command{
+		Use:   "put <name> <json>",
+		Short: "Put a JSON value",
+		Long:  "Put a JSON value (use '-' to read the value from stdin)",
+		Args:  cobra.ExactArgs(2),
+		RunE: func(cmd *cobra.Command, args []string) error {
+			var data []byte
+			if args[1] == "-" {
+				read, err := io.ReadAll(os.Stdin)
+				if err != nil {
+					return err
+				}
+				data = read
+			} else {
+				data = []byte(args[1])
+			}
+			value, err := store.DecodeJSON(data)
+			if err != nil {
+				return fmt.Errorf("invalid JSON value: %w", err)
+			}
+			if value == nil {
+				return errors.New("null cannot be stored, use delete instead")
+			}
+
+			store, err := openNamespacedStore()
+			if err != nil {
+				return err
+			}
+			defer store.Close()
+
+			if storeTTL == "" {
+				return store.Put(args[0], value)
+			}
+			ttl, err := time.ParseDuration(storeTTL)
+			if err != nil {
+				return err
+			}
+			return store.PutWithTTL(args[0], value, ttl)
+		},
+	}
+	storeDeleteCmd = &cobra.Command{
+		Use:   "delete <name>",
+		Short: "Delete a value",
+		Long:  "Delete a value",
+		Args:  cobra.ExactArgs(1),
+		RunE: func(cmd *cobra.Command, args []string) error {
+			store, err := openNamespacedStore()
+			if err != nil {
+				return err
+			}
+			defer store.Close()
+
+			return store.Delete(args[0])
+		},
+	}
+	storeHistoryCmd = &cobra.Command{
+		Use:   "history <name>",
+		Short: "Print changes of a value as JSONL",
+		Long:  "Print changes of a value recorded with --store-history as JSONL, from the newest to the oldest. Deleted and missing values are null.",
+		Args:  cobra.ExactArgs(1),
+		RunE: func(cmd *cobra.Command, args []string) error {
+			if storeHistoryLimit <= 0 {
+				return errors.New("limit must be positive")
+			}
+			store, err := openNamespacedStore()
+			if err != nil {
+				return err
+			}
+			defer store.Close()
+
+			changes, err := store.History(args[0], storeHistoryLimit)
+			if err != nil {
+				return err
+			}
+			for _, change := range changes {
+				record := historyRecord{Value: change.Value, Previous: change.Previous, Script: change.Script, ChangedAt: change.ChangedAt}
+				if err := printJSON(&record); err != nil {
+					return err
+				}
+			}
+			return nil
+		},
+	}
+	storeExportCmd = &cobra.Command{
+		Use:   "export",
+		Short: "Export the store as JSONL",
+		Long:  "Export the store as JSONL, one value per line",
+		Args:  cobra.NoArgs,
+		RunE: func(cmd *cobra.Command, args []string) error {
+			store, err := openNamespacedStore()
+			if err != nil {
+				return err
+			}
+			defer store.Close()
+
+			var writer io.Writer
+			if storeFilePath == "-" {
+				writer = os.Stdout
+			} else {
+				file, err := os.Create(storeFilePath)
+				if err != nil {
+					return err
+				}
+				defer file.Close()
+				writer = file
+			}
+
+			bw := bufio.NewWriter(writer)
+			encoder := json.NewEncoder(bw)
+			if !storeAllNamespaces {
+				if err := exportNamespace(encoder, store, ""); err != nil {
+					return err
+				}
+				return bw.Flush()
+			}
+			namespaces, err := store.Namespaces()
+			if err != nil {
+				return err
+			}
+			for _, namespace := range namespaces {
+				if err := exportNamespace(encoder, store.Namespace(namespace), namespace); err != nil {
+					return err
+				}
+			}
+			return bw.Flush()
+		},
+	}
+	storeImportCmd = &cobra.Command{
+		Use:   "import",
+		Short: "Import JSONL into the store",
+		Long:  "Import JSONL produced by export. Existing values with the same names are replaced. Values with namespaces are imported into their namespaces.",
+		Args:  cobra.NoArgs,
+		RunE: func(cmd *cobra.Command, args []string) error {
+			var reader io.Reader
+			if storeFilePath == "-" {
+				reader = os.Stdin
+			} else {
+				file, err := os.Open(storeFilePath)
+				if err != nil {
+					return err
+				}
+				defer file.Close()
+				reader = file
+			}
+
+			s, err := openNamespacedStore()
+			if err != nil {
+				return err
+			}
+			defer s.Close()
+
+			tx, err := s.Begin()
+			if err != nil {
+				return err
+			}
+			defer tx.Rollback()
+
+			scanner := bufio.NewScanner(reader)
+			scanner.Buffer(make([]byte, 0, 64*1024), 64*1024*1024)
+			line := 0
+			for scanner.Scan() {
+				line++
+				if strings.TrimSpace(scanner.Text()) == "" {
+					continue
+				}
+
+				var record struct {
+					Namespace string          `json:"namespace"`
+					Name      string          `json:"name"`
+					Value     json.RawMessage `json:"value"`
+					ExpiresAt *time.Time      `json:"expires_at"`
+				}
+				if err := json.Unmarshal(scanner.Bytes(), &record); err != nil {
+					return fmt.Errorf("line %d: %w", line, err)
+				}
+				var value interface{}
+				if len(record.Value) > 0 {
+					if value, err = store.DecodeJSON(record.Value); err != nil {
+						return fmt.Errorf("line %d: %w", line, err)
+					}
+				}
+				if record.Name == "" || value == nil {
+					return fmt.Errorf("line %d: name and value are required", line)
+				}
+
+				var accessor store.Accessor = tx
+				if record.Namespace != "" {
+					accessor = tx.Namespace(record.Namespace)
+				}
+				if record.ExpiresAt == nil {
+					err = accessor.Put(record.Name, value)
+				} else if ttl := time.Until(*record.ExpiresAt); ttl > 0 {
+					err = accessor.PutWithTTL(record.Name, value, ttl)
+				} else {
+					continue // already expired
+				}
+				if err != nil {
+					return fmt.Errorf("line %d: %w", line, err)
+				}
+			}
+			if err := scanner.Err(); err != nil {
+				return err
+			}
+			return tx.Commit()
+		},
+	}
+)
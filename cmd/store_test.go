@@ -0,0 +1,234 @@
+package cmd
+
+import (
+	"bytes"
+	"io"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/henry40408/lmb/internal/store"
+	"github.com/spf13/cobra"
+	"github.com/spf13/pflag"
+	"github.com/stretchr/testify/assert"
+)
+
+// execute runs the command with args and stdin, and returns what it printed to
+// stdout. Flags are reset afterwards, since they are kept across executions.
+func execute(t *testing.T, stdin string, args ...string) (string, error) {
+	t.Helper()
+	defer resetFlags(rootCmd)
+
+	input, err := os.CreateTemp(t.TempDir(), "stdin")
+	assert.NoError(t, err)
+	_, err = input.WriteString(stdin)
+	assert.NoError(t, err)
+	_, err = input.Seek(0, io.SeekStart)
+	assert.NoError(t, err)
+	defer input.Close()
+
+	r, w, err := os.Pipe()
+	assert.NoError(t, err)
+	output := make(chan string)
+	go func() {
+		var buf bytes.Buffer
+		io.Copy(&buf, r)
+		output <- buf.String()
+	}()
+
+	stdinBackup, stdoutBackup := os.Stdin, os.Stdout
+	os.Stdin, os.Stdout = input, w
+	rootCmd.SetArgs(args)
+	rootCmd.SetOut(io.Discard)
+	rootCmd.SetErr(io.Discard)
+	err = rootCmd.Execute()
+	os.Stdin, os.Stdout = stdinBackup, stdoutBackup
+	w.Close()
+	return <-output, err
+}
+
+func resetFlags(cmd *cobra.Command) {
+	reset := func(f *pflag.Flag) {
+		if slice, ok := f.Value.(pflag.SliceValue); ok {
+			slice.Replace(nil)
+		} else {
+			f.Value.Set(f.DefValue)
+		}
+		f.Changed = false
+	}
+	cmd.PersistentFlags().VisitAll(reset)
+	cmd.Flags().VisitAll(reset)
+	for _, sub := range cmd.Commands() {
+		resetFlags(sub)
+	}
+}
+
+func TestStoreCommands(t *testing.T) {
+	dbPath := filepath.Join(t.TempDir(), "db.sqlite3")
+
+	_, err := execute(t, "", "store", "put", "--db-path", dbPath, "a", `{"b":[1,"c"]}`)
+	assert.NoError(t, err)
+	_, err = execute(t, `"from stdin"`, "store", "put", "--db-path", dbPath, "b", "-")
+	assert.NoError(t, err)
+	_, err = execute(t, "", "store", "put", "--db-path", dbPath, "--store-namespace", "other", "a", "1")
+	assert.NoError(t, err)
+
+	output, err := execute(t, "", "store", "get", "--db-path", dbPath, "a")
+	assert.NoError(t, err)
+	assert.Equal(t, "{\"b\":[1,\"c\"]}\n", output)
+	output, err = execute(t, "", "store", "list", "--db-path", dbPath)
+	assert.NoError(t, err)
+	assert.Equal(t, "a\nb\n", output)
+	output, err = execute(t, "", "store", "list", "--db-path", dbPath, "--prefix", "b")
+	assert.NoError(t, err)
+	assert.Equal(t, "b\n", output)
+	output, err = execute(t, "", "store", "namespaces", "--db-path", dbPath)
+	assert.NoError(t, err)
+	assert.Equal(t, "default\nother\n", output)
+
+	_, err = execute(t, "", "store", "delete", "--db-path", dbPath, "b")
+	assert.NoError(t, err)
+	_, err = execute(t, "", "store", "get", "--db-path", dbPath, "b")
+	assert.ErrorContains(t, err, "b not found")
+}
+
+func TestStorePutInvalid(t *testing.T) {
+	dbPath := filepath.Join(t.TempDir(), "db.sqlite3")
+	testCases := []struct {
+		name string
+		args []string
+		err  string
+	}{
+		{"invalid JSON", []string{"a", "{"}, "invalid JSON value"},
+		{"null", []string{"a", "null"}, "null cannot be stored"},
+		{"invalid TTL", []string{"--ttl", "soon", "a", "1"}, "invalid duration"},
+	}
+	for _, tc := range testCases {
+		t.Run(tc.name, func(t *testing.T) {
+			args := append([]string{"store", "put", "--db-path", dbPath}, tc.args...)
+			_, err := execute(t, "", args...)
+			assert.ErrorContains(t, err, tc.err)
+		})
+	}
+}
+
+func TestStoreExportImport(t *testing.T) {
+	dir := t.TempDir()
+	source, target := filepath.Join(dir, "source.sqlite3"), filepath.Join(dir, "target.sqlite3")
+	s, err := store.NewStore(source)
+	assert.NoError(t, err)
+	assert.NoError(t, s.Put("a", map[string]interface{}{"b": int64(1)}))
+	assert.NoError(t, s.PutWithTTL("ttl", "c", time.Hour))
+	assert.NoError(t, s.Namespace("other").Put("a", "d"))
+	assert.NoError(t, s.Close())
+
+	output, err := execute(t, "", "store", "export", "--db-path", source)
+	assert.NoError(t, err)
+	lines := strings.Split(strings.TrimSpace(output), "\n")
+	assert.Len(t, lines, 2)
+	assert.Equal(t, `{"name":"a","value":{"b":1}}`, lines[0])
+	assert.Contains(t, lines[1], `"name":"ttl","value":"c","expires_at":`)
+
+	exported := filepath.Join(dir, "export.jsonl")
+	_, err = execute(t, "", "store", "export", "--db-path", source, "--all-namespaces", "--file", exported)
+	assert.NoError(t, err)
+	_, err = execute(t, "", "store", "import", "--db-path", target, "--file", exported)
+	assert.NoError(t, err)
+
+	s, err = store.NewStore(target)
+	assert.NoError(t, err)
+	defer s.Close()
+	value, err := s.Get("a")
+	assert.NoError(t, err)
+	assert.Equal(t, map[string]interface{}{"b": int64(1)}, value)
+	value, err = s.Namespace("other").Get("a")
+	assert.NoError(t, err)
+	assert.Equal(t, "d", value)
+	// TTLs are kept
+	entries, err := s.Scan("ttl", "", 10)
+	assert.NoError(t, err)
+	assert.Len(t, entries, 1)
+	assert.WithinDuration(t, time.Now().Add(time.Hour), entries[0].ExpiresAt, time.Minute)
+}
+
+func TestStoreImport(t *testing.T) {
+	testCases := []struct {
+		name   string
+		input  string
+		values map[string]interface{}
+		err    string
+	}{
+		{
+			"values",
+			"{\"name\":\"a\",\"value\":1}\n\n{\"namespace\":\"default\",\"name\":\"b\",\"value\":[true]}\n",
+			map[string]interface{}{"a": int64(1), "b": []interface{}{true}},
+			"",
+		},
+		{
+			"expired",
+			"{\"name\":\"a\",\"value\":1,\"expires_at\":\"2000-01-01T00:00:00Z\"}\n{\"name\":\"b\",\"value\":2}\n",
+			map[string]interface{}{"b": int64(2)},
+			"",
+		},
+		{"invalid JSON", "{\"name\":\"a\",\"value\":1}\n{\n", nil, "line 2"},
+		{"missing name", "{\"value\":1}\n", nil, "line 1: name and value are required"},
+		{"missing value", "{\"name\":\"a\"}\n", nil, "line 1: name and value are required"},
+	}
+	for _, tc := range testCases {
+		t.Run(tc.name, func(t *testing.T) {
+			dbPath := filepath.Join(t.TempDir(), "db.sqlite3")
+			_, err := execute(t, tc.input, "store", "import", "--db-path", dbPath)
+
+			s, openErr := store.NewStore(dbPath)
+			assert.NoError(t, openErr)
+			defer s.Close()
+			names, keysErr := s.Keys("")
+			assert.NoError(t, keysErr)
+			if tc.err != "" {
+				assert.ErrorContains(t, err, tc.err)
+				// nothing is imported when a line fails
+				assert.Empty(t, names)
+				return
+			}
+			assert.NoError(t, err)
+			assert.Len(t, names, len(tc.values))
+			for name, expected := range tc.values {
+				value, err := s.Get(name)
+				assert.NoError(t, err)
+				assert.Equal(t, expected, value)
+			}
+		})
+	}
+}
+
+func TestStoreHistory(t *testing.T) {
+	dbPath := filepath.Join(t.TempDir(), "db.sqlite3")
+	_, err := execute(t, "", "store", "put", "--db-path", dbPath, "--store-history", "a", "1")
+	assert.NoError(t, err)
+	at := time.Now().UTC().Add(time.Second).Format(time.RFC3339)
+	time.Sleep(time.Second + 100*time.Millisecond)
+	_, err = execute(t, "", "store", "put", "--db-path", dbPath, "--store-history", "a", "2")
+	assert.NoError(t, err)
+
+	output, err := execute(t, "", "store", "history", "--db-path", dbPath, "--store-history", "a")
+	assert.NoError(t, err)
+	lines := strings.Split(strings.TrimSpace(output), "\n")
+	assert.Len(t, lines, 2)
+	assert.Contains(t, lines[0], `"value":2,"previous":1`)
+	assert.Contains(t, lines[1], `"value":1,"previous":null`)
+	output, err = execute(t, "", "store", "history", "--db-path", dbPath, "--store-history", "--limit", "1", "a")
+	assert.NoError(t, err)
+	assert.Equal(t, 1, strings.Count(output, "\n"))
+	_, err = execute(t, "", "store", "history", "--db-path", dbPath, "--limit", "0", "a")
+	assert.ErrorContains(t, err, "limit must be positive")
+
+	output, err = execute(t, "", "store", "get", "--db-path", dbPath, "--store-history", "--at", at, "a")
+	assert.NoError(t, err)
+	assert.Equal(t, "1\n", output)
+	_, err = execute(t, "", "store", "get", "--db-path", dbPath, "--at", at, "a")
+	assert.ErrorIs(t, err, store.ErrNoHistory)
+	_, err = execute(t, "", "store", "get", "--db-path", dbPath, "--at", "yesterday", "a")
+	assert.ErrorContains(t, err, "invalid time")
+}
@@ -2,16 +2,133 @@ package cmd
 
 import (
 	"context"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
 	"fmt"
+	"io"
+	"net/http"
+	"path/filepath"
+	"sync"
 	"time"
+
+	"github.com/henry40408/lmb/internal/eval_context"
+	"github.com/henry40408/lmb/internal/http_policy"
+	"github.com/henry40408/lmb/internal/store"
+	"github.com/rs/zerolog/log"
 )
 
-func setupTimeoutContext(timeout string) (context.Context, context.CancelFunc, error) {
+func newEvalContext(store store.Store, options ...eval_context.Option) (*eval_context.EvalContext, error) {
+	parsedHttpTimeout, err := time.ParseDuration(httpTimeout)
+	if err != nil {
+		return nil, err
+	}
+	policy, err := http_policy.NewPolicy(httpAllow, httpDeny)
+	if err != nil {
+		return nil, err
+	}
+	httpClient := http.Client{Timeout: parsedHttpTimeout}
+	options = append(
+		options,
+		eval_context.WithHttpPolicy(policy),
+		eval_context.WithMaxInstructions(maxInstructions),
+		eval_context.WithMaxMemory(maxMemory),
+		eval_context.WithMaxStackSize(maxStackSize),
+		eval_context.WithStoreNamespaceFunc(namespaceFunc(store)),
+		eval_context.WithStoreNamespaces(storeNamespaces...),
+	)
+	return eval_context.NewEvalContext(store, &httpClient, options...), nil
+}
+
+// encodeEvalError writes the error as JSON if it is an evaluation error.
+func encodeEvalError(w io.Writer, err error) bool {
+	var evalErr *eval_context.EvalError
+	if !errors.As(err, &evalErr) {
+		return false
+	}
+	return json.NewEncoder(w).Encode(evalErr) == nil
+}
+
+// openStore opens the store at --store-url, or the SQLite database at --db-path
+// without it.
+func openStore() (store.Store, error) {
+	options := []store.Option{
+		store.WithMaxValueSize(storeMaxValueSize),
+		store.WithMaxTotalSize(storeMaxTotalSize),
+	}
+	if storeHistory {
+		retention, err := time.ParseDuration(storeHistoryRetention)
+		if err != nil {
+			return nil, fmt.Errorf("invalid history retention: %w", err)
+		}
+		options = append(options, store.WithHistory(retention))
+	}
+	if storeURL != "" {
+		return store.Open(storeURL, options...)
+	}
+	return store.NewStore(storePath, options...)
+}
+
+// scriptNamespace returns --store-namespace, or a hash of the absolute path of
+// the script so that unrelated scripts do not share values by accident. Scripts
+// read from stdin use the default namespace, and so do scripts of databases
+// holding values before namespaces existed.
+func scriptNamespace(s store.Store, path string) string {
+	if storeNamespace != "" {
+		return storeNamespace
+	}
+	if path == "" || path == "-" {
+		return store.DefaultNamespace
+	}
+	if shared := s.SharedNamespace(); shared != "" {
+		return shared
+	}
+	if abs, err := filepath.Abs(path); err == nil {
+		path = abs
+	}
+	sum := sha256.Sum256([]byte(path))
+	return hex.EncodeToString(sum[:8])
+}
+
+// namespaceFunc returns the namespace of each script of s, and warns once per
+// namespace when it is empty while the default namespace holds values, which
+// usually means the values were written before scripts had namespaces.
+func namespaceFunc(s store.Store) func(path string) string {
+	var checked sync.Map
+	return func(path string) string {
+		namespace := scriptNamespace(s, path)
+		if _, loaded := checked.LoadOrStore(namespace, true); !loaded {
+			warnEmptyNamespace(s, namespace, path)
+		}
+		return namespace
+	}
+}
+
+func warnEmptyNamespace(s store.Store, namespace, path string) {
+	if namespace == store.DefaultNamespace {
+		return
+	}
+	entries, err := s.Namespace(namespace).Scan("", "", 1)
+	if err != nil || len(entries) > 0 {
+		return
+	}
+	entries, err = s.Namespace(store.DefaultNamespace).Scan("", "", 1)
+	if err != nil || len(entries) == 0 {
+		return
+	}
+	log.Warn().
+		Str("file_path", path).
+		Str("namespace", namespace).
+		Msg("namespace of script is empty while the default namespace holds values, use --store-namespace default to read them")
+}
+
+func setupTimeoutContext(parent context.Context, timeout string) (context.Context, context.CancelFunc, error) {
 	parsedTimeout, err := time.ParseDuration(timeout)
 	if err != nil {
 		return nil, nil, fmt.Errorf("invalid timeout format: %w", err)
 	}
 
-	ctx, cancel := context.WithTimeout(context.Background(), parsedTimeout)
+	ctx, cancel := context.WithTimeout(parent, parsedTimeout)
 	return ctx, cancel, nil
 }
@@ -0,0 +1,81 @@
+package cmd
+
+import (
+	"bytes"
+	"database/sql"
+	"path/filepath"
+	"testing"
+
+	"github.com/henry40408/lmb/internal/store"
+	"github.com/rs/zerolog"
+	"github.com/rs/zerolog/log"
+	"github.com/stretchr/testify/assert"
+)
+
+func TestScriptNamespace(t *testing.T) {
+	s := store.NewMemoryStore()
+	defer s.Close()
+
+	hashed := scriptNamespace(s, "a.lua")
+	assert.Len(t, hashed, 16)
+	abs, err := filepath.Abs("a.lua")
+	assert.NoError(t, err)
+	assert.Equal(t, hashed, scriptNamespace(s, abs))
+	assert.NotEqual(t, hashed, scriptNamespace(s, "b.lua"))
+	assert.Equal(t, store.DefaultNamespace, scriptNamespace(s, "-"))
+	assert.Equal(t, store.DefaultNamespace, scriptNamespace(s, ""))
+
+	storeNamespace = "other"
+	defer func() { storeNamespace = "" }()
+	assert.Equal(t, "other", scriptNamespace(s, "a.lua"))
+}
+
+func TestScriptNamespaceShared(t *testing.T) {
+	dsn := filepath.Join(t.TempDir(), "db.sqlite3")
+	s, err := store.NewStore(dsn)
+	assert.NoError(t, err)
+	assert.NoError(t, s.Close())
+	// as recorded by the migration adding namespaces
+	db, err := sql.Open("sqlite3", dsn)
+	assert.NoError(t, err)
+	_, err = db.Exec(`INSERT INTO store_settings (name, value) VALUES ('shared_namespace', 'default')`)
+	assert.NoError(t, err)
+	assert.NoError(t, db.Close())
+
+	// scripts of databases holding values before namespaces existed keep
+	// reading them
+	s, err = store.NewStore(dsn)
+	assert.NoError(t, err)
+	defer s.Close()
+	assert.Equal(t, store.DefaultNamespace, scriptNamespace(s, "a.lua"))
+}
+
+func TestNamespaceFuncWarnsEmptyNamespace(t *testing.T) {
+	var buf bytes.Buffer
+	logger := log.Logger
+	log.Logger = zerolog.New(&buf)
+	defer func() { log.Logger = logger }()
+
+	s := store.NewMemoryStore()
+	defer s.Close()
+	namespace := namespaceFunc(s)
+
+	// nothing to warn about while the default namespace is empty
+	namespace("a.lua")
+	assert.Empty(t, buf.String())
+
+	assert.NoError(t, s.Put("a", int64(1)))
+	namespace("b.lua")
+	assert.Contains(t, buf.String(), `"namespace":"`+scriptNamespace(s, "b.lua")+`"`)
+	assert.Contains(t, buf.String(), "default namespace holds values")
+
+	// once per namespace
+	buf.Reset()
+	namespace("b.lua")
+	assert.Empty(t, buf.String())
+
+	// nor when the namespace of the script holds values
+	assert.NoError(t, s.Namespace(scriptNamespace(s, "c.lua")).Put("a", int64(2)))
+	namespace("c.lua")
+	assert.Empty(t, buf.String())
+}
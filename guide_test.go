@@ -3,6 +3,7 @@ package main
 import (
 	"bytes"
 	"context"
+	"encoding/json"
 	"net/http"
 	"os"
 	"regexp"
@@ -13,6 +14,7 @@ import (
 
 	"github.com/h2non/gock"
 	"github.com/henry40408/lmb/internal/eval_context"
+	"github.com/henry40408/lmb/internal/http_policy"
 	"github.com/henry40408/lmb/internal/store"
 	"github.com/stretchr/testify/assert"
 	"github.com/yuin/goldmark"
@@ -21,8 +23,9 @@ import (
 )
 
 var (
-	IN_PATTERN  = regexp.MustCompile(`--\s*input:\s*(.+)`)
-	OUT_PATTERN = regexp.MustCompile(`--\s*output:\s*(.+)`)
+	IN_PATTERN    = regexp.MustCompile(`--\s*input:\s*(.+)`)
+	OUT_PATTERN   = regexp.MustCompile(`--\s*output:\s*(.+)`)
+	STATE_PATTERN = regexp.MustCompile(`--\s*state:\s*(.+)`)
 )
 
 func TestGuide(t *testing.T) {
@@ -41,7 +44,12 @@ func TestGuide(t *testing.T) {
 	blocks, err := extractCodeBlocks("guides/lua.md")
 	assert.NoError(t, err)
 
-	store, err := store.NewStore(":memory:")
+	store, err := store.NewStore(":memory:", store.WithHistory(0))
+	assert.NoError(t, err)
+
+	// gock answers for httpbingo.org, which is allowed by name because the policy
+	// would otherwise resolve it before the request reaches gock
+	policy, err := http_policy.NewPolicy([]string{"httpbingo.org"}, nil)
 	assert.NoError(t, err)
 
 	for _, block := range blocks {
@@ -55,13 +63,26 @@ func TestGuide(t *testing.T) {
 			// 2. Remove extra '\n' on Windows
 			input = strings.ReplaceAll(strings.ReplaceAll(inMatches[1], "\\n", "\n"), "\r", "")
 		}
-		e := eval_context.NewEvalContext(store, strings.NewReader(input), http.DefaultClient)
+		// state is set like lmb serve or lmb schedule would, e.g. m.state.schedule
+		if stateMatches := STATE_PATTERN.FindStringSubmatch(block); len(stateMatches) > 1 {
+			var values map[string]interface{}
+			assert.NoError(t, json.Unmarshal([]byte(stateMatches[1]), &values))
+			for key, value := range values {
+				state.Store(key, value)
+			}
+		}
+		e := eval_context.NewEvalContext(
+			store,
+			http.DefaultClient,
+			eval_context.WithHttpPolicy(policy),
+			eval_context.WithStoreNamespaces("shared"),
+		)
 
 		c, err := e.Compile(strings.NewReader(block), "")
 		assert.NoError(t, err)
 
 		assert.NoError(t, err)
-		res, err := e.Eval(context.Background(), c, &state, &w)
+		res, err := e.Eval(context.Background(), c, &state, strings.NewReader(input), &w)
 		assert.NoError(t, err)
 
 		if w.Len() > 0 {
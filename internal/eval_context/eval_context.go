@@ -1,10 +1,10 @@
 package eval_context
 
 import (
-	"bufio"
 	"context"
 	"io"
 	"net/http"
+	"runtime"
 	"strconv"
 	"strings"
 	"sync"
@@ -16,6 +16,7 @@ import (
 	logMod "github.com/cosmotek/loguago"
 	"github.com/henry40408/lmb/internal/eval_context/modules/io_mod"
 	"github.com/henry40408/lmb/internal/eval_context/modules/lmb_mod"
+	"github.com/henry40408/lmb/internal/http_policy"
 	"github.com/henry40408/lmb/internal/lua_convert"
 	"github.com/henry40408/lmb/internal/store"
 	jsonMod "github.com/layeh/gopher-json"
@@ -30,30 +31,122 @@ import (
 type EvalContext struct {
 	compiled   sync.Map
 	httpClient *http.Client
-	input      *bufio.Reader
-	store      *store.Store
+	httpPolicy *http_policy.Policy
+	limits     limits
+	modules    []module
+	pool       chan *luaState
+	poolSize   int
+	store      store.Store
+	namespace  func(script string) string
+	namespaces []string
+	watchCtx   context.Context
 }
 
-func NewEvalContext(store *store.Store, input io.Reader, httpClient *http.Client) *EvalContext {
-	return &EvalContext{
+type Option func(*EvalContext)
+
+type module struct {
+	name   string
+	loader lua.LGFunction
+}
+
+// WithModule makes the module available to scripts with require(name). The
+// loader runs once per evaluation that requires the module.
+func WithModule(name string, loader lua.LGFunction) Option {
+	return func(e *EvalContext) {
+		e.modules = append(e.modules, module{name, loader})
+	}
+}
+
+// WithPoolSize sets how many idle Lua states are kept for reuse. Zero disables
+// pooling, so that every evaluation creates a fresh state. It defaults to
+// GOMAXPROCS.
+func WithPoolSize(size int) Option {
+	return func(e *EvalContext) {
+		e.poolSize = size
+	}
+}
+
+// WithHttpPolicy restricts the hosts that the http module can connect to.
+func WithHttpPolicy(policy *http_policy.Policy) Option {
+	return func(e *EvalContext) {
+		e.httpPolicy = policy
+	}
+}
+
+// WithStoreNamespace sets the namespace of the store that scripts read and
+// write. Without it, scripts use the namespace of the given store.
+func WithStoreNamespace(namespace string) Option {
+	return WithStoreNamespaceFunc(func(string) string {
+		return namespace
+	})
+}
+
+// WithStoreNamespaceFunc sets the namespace of the store for each script. The
+// function receives the name the script was compiled with.
+func WithStoreNamespaceFunc(f func(script string) string) Option {
+	return func(e *EvalContext) {
+		e.namespace = f
+	}
+}
+
+// WithStoreNamespaces allows scripts to open other namespaces of the store with
+// m.store:namespace(name). "*" allows every namespace.
+func WithStoreNamespaces(namespaces ...string) Option {
+	return func(e *EvalContext) {
+		e.namespaces = namespaces
+	}
+}
+
+// WithStoreWatchContext ends every m.store:watch when ctx is done as if nothing
+// changed, so that servers can answer long polls when they shut down instead of
+// waiting for changes.
+func WithStoreWatchContext(ctx context.Context) Option {
+	return func(e *EvalContext) {
+		e.watchCtx = ctx
+	}
+}
+
+func NewEvalContext(store store.Store, httpClient *http.Client, options ...Option) *EvalContext {
+	e := &EvalContext{
 		compiled:   sync.Map{},
 		httpClient: httpClient,
-		input:      bufio.NewReader(input),
+		poolSize:   runtime.GOMAXPROCS(0),
 		store:      store,
 	}
+	for _, option := range options {
+		option(e)
+	}
+	if e.httpClient == nil {
+		e.httpClient = http.DefaultClient
+	}
+	if e.httpPolicy != nil {
+		e.httpClient = e.httpPolicy.Client(e.httpClient)
+	}
+	if e.poolSize > 0 {
+		e.pool = make(chan *luaState, e.poolSize)
+	}
+	return e
 }
 
-func NewTestEvalContext(input io.Reader, httpClient *http.Client) (*EvalContext, *store.Store) {
+func NewTestEvalContext(httpClient *http.Client, options ...Option) (*EvalContext, store.Store) {
 	store, err := store.NewStore(":memory:")
 	if err != nil {
 		log.Fatal().Err(err).Msg("")
 	}
-	return NewEvalContext(store, input, httpClient), store
+	return NewEvalContext(store, httpClient, options...), store
 }
 
-func (e *EvalContext) initState(ctx context.Context, state *sync.Map, w io.Writer) *lua.LState {
-	L := lua.NewState(lua.Options{SkipOpenLibs: true})
-	L.SetContext(ctx)
+func (e *EvalContext) newLuaState() *luaState {
+	options := lua.Options{
+		CallStackSize: callStackSize,
+		RegistrySize:  registrySize,
+		SkipOpenLibs:  true,
+	}
+	if size := e.limits.maxStackSize; size > 0 {
+		options.RegistrySize = min(registrySize, size)
+		options.RegistryMaxSize = size
+	}
+	L := lua.NewState(options)
 	for _, pair := range []struct {
 		n string
 		f lua.LGFunction
@@ -75,7 +168,8 @@ func (e *EvalContext) initState(ctx context.Context, state *sync.Map, w io.Write
 
 	cryptoMod.Preload(L)
 
-	L.PreloadModule("http", httpMod.NewHttpModule(&http.Client{}).Loader)
+	httpClient, transport := newEvalHttpClient(e.httpClient)
+	L.PreloadModule("http", httpMod.NewHttpModule(httpClient).Loader)
 	L.PreloadModule("json", jsonMod.Loader)
 
 	logger := logMod.NewLogger(log.Logger)
@@ -84,21 +178,72 @@ func (e *EvalContext) initState(ctx context.Context, state *sync.Map, w io.Write
 	L.PreloadModule("re", regexMod.Loader)
 	L.PreloadModule("url", urlMod.Loader)
 
-	L.PreloadModule("io", io_mod.NewIoMod(e.input, w).Loader)
-	L.PreloadModule("@lmb", lmb_mod.NewLmbModule(state, e.store).Loader)
-	return L
+	ioModule := io_mod.NewIoMod(strings.NewReader(""), io.Discard)
+	L.PreloadModule("io", ioModule.Loader)
+	lmbModule := lmb_mod.NewLmbModule(nil, e.store, lmb_mod.WithNamespaces(e.namespaces...), lmb_mod.WithWatchContext(e.watchCtx))
+	L.PreloadModule("@lmb", lmbModule.Loader)
+	for _, m := range e.modules {
+		L.PreloadModule(m.name, m.loader)
+	}
+
+	s := &luaState{L: L, io: ioModule, lmb: lmbModule, transport: transport}
+	s.takeSnapshot()
+	return s
+}
+
+// acquireState takes an idle state from the pool, or creates one when the pool
+// is empty or disabled.
+func (e *EvalContext) acquireState() *luaState {
+	select {
+	case s := <-e.pool:
+		return s
+	default:
+		return e.newLuaState()
+	}
+}
+
+// releaseState returns the state to the pool. A state is discarded instead when
+// the evaluation failed, since it may have been interrupted half way, or when the
+// pool is full.
+func (e *EvalContext) releaseState(s *luaState, failed bool) {
+	if !failed {
+		s.reset()
+		select {
+		case e.pool <- s:
+			return
+		default:
+		}
+	} else {
+		// stops the watchers of the evaluation
+		s.lmb.Reset(nil, nil, nil)
+	}
+	s.L.Close()
 }
 
+// Close releases idle states in the pool.
+func (e *EvalContext) Close() {
+	for {
+		select {
+		case s := <-e.pool:
+			s.L.Close()
+		default:
+			return
+		}
+	}
+}
+
+// Compile parses and compiles the script. Syntax errors are returned as
+// *EvalError.
 func (e *EvalContext) Compile(reader io.Reader, name string) (*lua.FunctionProto, error) {
 	start := time.Now()
 
 	parsed, err := e.Parse(reader, name)
 	if err != nil {
-		return nil, err
+		return nil, newSyntaxError(name, err)
 	}
 	compiled, err := lua.Compile(parsed, name)
 	if err != nil {
-		return nil, err
+		return nil, newSyntaxError(name, err)
 	}
 
 	duration := time.Since(start)
@@ -107,23 +252,41 @@ func (e *EvalContext) Compile(reader io.Reader, name string) (*lua.FunctionProto
 	return compiled, nil
 }
 
-func (e *EvalContext) Eval(ctx context.Context, compiled *lua.FunctionProto, state *sync.Map, writer io.Writer) (interface{}, error) {
-	L := e.initState(ctx, state, writer)
-	defer L.Close()
+// Eval evaluates the compiled function. Each evaluation reads from its own input
+// through the io module, so concurrent evaluations never share a reader. A nil
+// input behaves like an empty one. Errors are returned as *EvalError.
+func (e *EvalContext) Eval(ctx context.Context, compiled *lua.FunctionProto, state *sync.Map, input io.Reader, writer io.Writer) (interface{}, error) {
+	s := e.acquireState()
+	st := e.store
+	if st != nil {
+		// changes are recorded in the history as made by the script
+		st = st.Script(compiled.SourceName)
+		if e.namespace != nil {
+			st = st.Namespace(e.namespace(compiled.SourceName))
+		}
+	}
+	s.bind(ctx, state, st, input, writer)
+	L := s.L
+	if e.limits.maxInstructions > 0 || e.limits.maxMemory > 0 {
+		// the http module keeps the parent context, because requests are sent
+		// from other goroutines
+		ctx = newLimitContext(ctx, L, e.limits)
+		L.SetContext(ctx)
+	}
 
 	lf := L.NewFunctionFromProto(compiled)
 	L.Push(lf)
 	if err := L.PCall(0, lua.MultRet, nil); err != nil {
-		return nil, err
+		e.releaseState(s, true)
+		return nil, newEvalError(ctx, e.limits, compiled.SourceName, err)
 	}
 
+	var result interface{}
 	if L.GetTop() > 0 {
-		result := L.Get(-1)
-		L.Pop(1)
-		return lua_convert.FromLuaValue(result), nil
+		result = lua_convert.FromLuaValue(L.Get(-1))
 	}
-
-	return nil, nil
+	e.releaseState(s, false)
+	return result, nil
 }
 
 func (e *EvalContext) findOrCompile(reader io.ReadSeeker) (*lua.FunctionProto, error) {
@@ -148,24 +311,21 @@ func (e *EvalContext) findOrCompile(reader io.ReadSeeker) (*lua.FunctionProto, e
 	return actual, nil
 }
 
-func (e *EvalContext) EvalReader(ctx context.Context, reader io.ReadSeeker, state *sync.Map, writer io.Writer) (interface{}, error) {
+func (e *EvalContext) EvalReader(ctx context.Context, reader io.ReadSeeker, state *sync.Map, input io.Reader, writer io.Writer) (interface{}, error) {
 	compiled, err := e.findOrCompile(reader)
 	if err != nil {
 		return nil, err
 	}
-	return e.Eval(ctx, compiled, state, writer)
+	return e.Eval(ctx, compiled, state, input, writer)
 }
 
-func (e *EvalContext) EvalScript(ctx context.Context, script string, state *sync.Map, writer io.Writer) (interface{}, error) {
-	L := e.initState(ctx, state, writer)
-	defer L.Close()
-
+func (e *EvalContext) EvalScript(ctx context.Context, script string, state *sync.Map, input io.Reader, writer io.Writer) (interface{}, error) {
 	compiled, err := e.findOrCompile(strings.NewReader(script))
 	if err != nil {
 		return nil, err
 	}
 
-	return e.Eval(ctx, compiled, state, writer)
+	return e.Eval(ctx, compiled, state, input, writer)
 }
 
 func (e *EvalContext) Parse(reader io.Reader, name string) ([]ast.Stmt, error) {
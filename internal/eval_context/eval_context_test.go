@@ -3,16 +3,22 @@ package eval_context
 import (
 	"bytes"
 	"context"
+	"errors"
 	"fmt"
+	"io"
 	"net"
 	"net/http"
+	"net/http/httptest"
 	"os"
 	"path/filepath"
+	"runtime"
 	"strings"
 	"sync"
 	"testing"
 	"time"
 
+	"github.com/henry40408/lmb/internal/http_policy"
+	"github.com/henry40408/lmb/internal/store"
 	"github.com/rs/zerolog"
 	"github.com/stretchr/testify/assert"
 )
@@ -23,7 +29,7 @@ func TestMain(m *testing.M) {
 }
 
 func BenchmarkCompile(b *testing.B) {
-	e, _ := NewTestEvalContext(strings.NewReader(""), http.DefaultClient)
+	e, _ := NewTestEvalContext(http.DefaultClient)
 	for range b.N {
 		e.Compile(strings.NewReader("return 1"), "a")
 	}
@@ -31,11 +37,11 @@ func BenchmarkCompile(b *testing.B) {
 
 func BenchmarkEvalCompiled(b *testing.B) {
 	var state sync.Map
-	e, _ := NewTestEvalContext(strings.NewReader(""), http.DefaultClient)
+	e, _ := NewTestEvalContext(http.DefaultClient)
 	compiled, _ := e.Compile(strings.NewReader("return 1"), "a")
 	for range b.N {
 		var w bytes.Buffer
-		_, err := e.Eval(context.Background(), compiled, &state, &w)
+		_, err := e.Eval(context.Background(), compiled, &state, nil, &w)
 		if err != nil {
 			b.Error(err)
 		}
@@ -43,30 +49,63 @@ func BenchmarkEvalCompiled(b *testing.B) {
 }
 
 func BenchmarkEvalConcurrency(b *testing.B) {
-	var state sync.Map
-	e, _ := NewTestEvalContext(strings.NewReader(""), http.DefaultClient)
-	compiled, _ := e.Compile(strings.NewReader(`
+	for _, bc := range []struct {
+		name     string
+		poolSize int
+	}{
+		{"pool", runtime.GOMAXPROCS(0)},
+		{"no_pool", 0},
+	} {
+		b.Run(bc.name, func(b *testing.B) {
+			e, _ := NewTestEvalContext(http.DefaultClient, WithPoolSize(bc.poolSize))
+			defer e.Close()
+			compiled, _ := e.Compile(strings.NewReader(`
   local m = require('@lmb')
   m.store:update(function(store)
     store['counter'] = (store['counter'] or 0) + 1
   end)
   return true
   `), "concurrency")
-	for range b.N {
-		var w bytes.Buffer
-		_, err := e.Eval(context.Background(), compiled, &state, &w)
-		if err != nil {
-			b.Error(err)
-		}
+			b.RunParallel(func(pb *testing.PB) {
+				for pb.Next() {
+					var state sync.Map
+					var w bytes.Buffer
+					_, err := e.Eval(context.Background(), compiled, &state, nil, &w)
+					if err != nil {
+						b.Error(err)
+					}
+				}
+			})
+		})
 	}
 }
 
+func BenchmarkEvalIncrConcurrency(b *testing.B) {
+	e, _ := NewTestEvalContext(http.DefaultClient, WithPoolSize(runtime.GOMAXPROCS(0)))
+	defer e.Close()
+	compiled, _ := e.Compile(strings.NewReader(`
+  local m = require('@lmb')
+  m.store:incr('counter')
+  return true
+  `), "concurrency")
+	b.RunParallel(func(pb *testing.PB) {
+		for pb.Next() {
+			var state sync.Map
+			var w bytes.Buffer
+			_, err := e.Eval(context.Background(), compiled, &state, nil, &w)
+			if err != nil {
+				b.Error(err)
+			}
+		}
+	})
+}
+
 func BenchmarkEvalScript(b *testing.B) {
 	var state sync.Map
-	e, _ := NewTestEvalContext(strings.NewReader(""), http.DefaultClient)
+	e, _ := NewTestEvalContext(http.DefaultClient)
 	for range b.N {
 		var w bytes.Buffer
-		e.EvalScript(context.Background(), "return 1", &state, &w)
+		e.EvalScript(context.Background(), "return 1", &state, nil, &w)
 	}
 }
 
@@ -86,25 +125,437 @@ func TestEval(t *testing.T) {
 	}
 	for _, tc := range testCases {
 		t.Run(tc.name, func(t *testing.T) {
-			e, _ := NewTestEvalContext(strings.NewReader(""), http.DefaultClient)
+			e, _ := NewTestEvalContext(http.DefaultClient)
 			var w bytes.Buffer
-			res, err := e.EvalScript(context.Background(), tc.script, &state, &w)
+			res, err := e.EvalScript(context.Background(), tc.script, &state, nil, &w)
 			assert.NoError(t, err)
 			assert.Equal(t, tc.expected, res)
 		})
 	}
 }
 
+func TestEvalWithInput(t *testing.T) {
+	var state sync.Map
+	e, _ := NewTestEvalContext(http.DefaultClient)
+	compiled, err := e.Compile(strings.NewReader("return require('io').read('*a')"), "input")
+	assert.NoError(t, err)
+
+	var w bytes.Buffer
+	res, err := e.Eval(context.Background(), compiled, &state, strings.NewReader("request body"), &w)
+	assert.NoError(t, err)
+	assert.Equal(t, "request body", res)
+
+	res, err = e.Eval(context.Background(), compiled, &state, nil, &w)
+	assert.NoError(t, err)
+	assert.Nil(t, res)
+}
+
+func TestEvalWithInputConcurrency(t *testing.T) {
+	e, _ := NewTestEvalContext(http.DefaultClient)
+	compiled, err := e.Compile(strings.NewReader("return require('io').read('*a')"), "input")
+	assert.NoError(t, err)
+
+	var wg sync.WaitGroup
+
+	count := 100
+	wg.Add(count)
+	for i := 0; i < count; i++ {
+		go func(i int) {
+			var state sync.Map
+			var w bytes.Buffer
+
+			defer wg.Done()
+
+			input := fmt.Sprintf("input %d", i)
+			res, err := e.Eval(context.Background(), compiled, &state, strings.NewReader(input), &w)
+			assert.NoError(t, err)
+			assert.Equal(t, input, res)
+		}(i)
+	}
+
+	wg.Wait()
+}
+
+func TestEvalStoreNamespace(t *testing.T) {
+	var state sync.Map
+	e, s := NewTestEvalContext(http.DefaultClient, WithPoolSize(1), WithStoreNamespaceFunc(func(script string) string {
+		return "ns-" + script
+	}))
+	defer e.Close()
+
+	for _, script := range []string{"a", "b", "a"} {
+		compiled, err := e.Compile(strings.NewReader("return require('@lmb').store:incr('counter')"), script)
+		assert.NoError(t, err)
+		var w bytes.Buffer
+		_, err = e.Eval(context.Background(), compiled, &state, nil, &w)
+		assert.NoError(t, err)
+	}
+
+	for script, expected := range map[string]int64{"a": 2, "b": 1} {
+		value, err := s.Namespace("ns-" + script).Get("counter")
+		assert.NoError(t, err)
+		assert.Equal(t, expected, value)
+	}
+	has, err := s.Has("counter")
+	assert.NoError(t, err)
+	assert.False(t, has)
+}
+
+func TestEvalStoreHistory(t *testing.T) {
+	s, err := store.NewStore(":memory:", store.WithHistory(0))
+	assert.NoError(t, err)
+	defer s.Close()
+	e := NewEvalContext(s, http.DefaultClient)
+	defer e.Close()
+
+	var state sync.Map
+	for _, script := range []string{"a.lua", "b.lua"} {
+		compiled, err := e.Compile(strings.NewReader("require('@lmb').store:incr('counter')"), script)
+		assert.NoError(t, err)
+		var w bytes.Buffer
+		_, err = e.Eval(context.Background(), compiled, &state, nil, &w)
+		assert.NoError(t, err)
+	}
+
+	changes, err := s.History("counter", 10)
+	assert.NoError(t, err)
+	assert.Len(t, changes, 2)
+	assert.Equal(t, "b.lua", changes[0].Script)
+	assert.Equal(t, "a.lua", changes[1].Script)
+}
+
+func TestEvalStoreWatch(t *testing.T) {
+	var state sync.Map
+	e, s := NewTestEvalContext(http.DefaultClient)
+	defer e.Close()
+	defer s.Close()
+
+	// another evaluation changes the value while the first one watches it
+	watched := make(chan interface{})
+	go func() {
+		var w bytes.Buffer
+		res, err := e.EvalScript(context.Background(), "return require('@lmb').store:watch('a', 5)", &state, nil, &w)
+		assert.NoError(t, err)
+		watched <- res
+	}()
+	var w bytes.Buffer
+	for {
+		_, err := e.EvalScript(context.Background(), "require('@lmb').store.a = 1", &state, nil, &w)
+		assert.NoError(t, err)
+		select {
+		case res := <-watched:
+			assert.Equal(t, "a", res)
+		case <-time.After(10 * time.Millisecond):
+			continue
+		}
+		break
+	}
+
+	ctx, cancel := context.WithTimeout(context.Background(), 50*time.Millisecond)
+	defer cancel()
+	_, err := e.EvalScript(ctx, "require('@lmb').store:watch('a')", &state, nil, &w)
+	var evalErr *EvalError
+	assert.ErrorAs(t, err, &evalErr)
+	assert.Equal(t, ErrorKindTimeout, evalErr.Kind)
+}
+
 func TestEvalWithTimeout(t *testing.T) {
 	var state sync.Map
-	e, _ := NewTestEvalContext(strings.NewReader(""), http.DefaultClient)
+	e, _ := NewTestEvalContext(http.DefaultClient)
 	ctx, cancel := context.WithTimeout(context.Background(), 1*time.Millisecond)
 	defer cancel()
 	var w bytes.Buffer
-	_, err := e.EvalScript(ctx, "while true do; end", &state, &w)
+	_, err := e.EvalScript(ctx, "while true do; end", &state, nil, &w)
 	assert.Contains(t, err.Error(), "context deadline exceeded")
 }
 
+type recordingTransport struct {
+	urls []string
+}
+
+func (t *recordingTransport) RoundTrip(req *http.Request) (*http.Response, error) {
+	t.urls = append(t.urls, req.URL.String())
+	return &http.Response{
+		StatusCode: http.StatusOK,
+		Header:     http.Header{},
+		Body:       io.NopCloser(strings.NewReader("recorded")),
+		Request:    req,
+	}, nil
+}
+
+func TestEvalHttpClient(t *testing.T) {
+	var state sync.Map
+	transport := &recordingTransport{}
+	e, _ := NewTestEvalContext(&http.Client{Transport: transport})
+	var w bytes.Buffer
+	res, err := e.EvalScript(context.Background(), `
+  local res = require('http').get('http://example.invalid/path')
+  return res.body
+  `, &state, nil, &w)
+	assert.NoError(t, err)
+	assert.Equal(t, "recorded", res)
+	assert.Equal(t, []string{"http://example.invalid/path"}, transport.urls)
+}
+
+func TestEvalHttpWithTimeout(t *testing.T) {
+	var state sync.Map
+
+	done := make(chan struct{})
+	defer close(done)
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		select {
+		case <-done:
+		case <-r.Context().Done():
+		}
+	}))
+	defer server.Close()
+	state.Store("url", server.URL)
+
+	e, _ := NewTestEvalContext(http.DefaultClient)
+	ctx, cancel := context.WithTimeout(context.Background(), 100*time.Millisecond)
+	defer cancel()
+
+	start := time.Now()
+	var w bytes.Buffer
+	_, err := e.EvalScript(ctx, `
+  local m = require('@lmb')
+  local _, err = require('http').get(m.state.url)
+  error(err)
+  `, &state, nil, &w)
+	assert.ErrorContains(t, err, "context deadline exceeded")
+	assert.Less(t, time.Since(start), 5*time.Second)
+}
+
+func TestEvalHttpPolicy(t *testing.T) {
+	var state sync.Map
+
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		fmt.Fprint(w, "OK")
+	}))
+	defer server.Close()
+	state.Store("url", server.URL)
+
+	script := `
+  local m = require('@lmb')
+  local res, err = require('http').get(m.state.url)
+  return res and res.body or err
+  `
+
+	policy, err := http_policy.NewPolicy(nil, nil)
+	assert.NoError(t, err)
+	e := NewEvalContext(nil, http.DefaultClient, WithHttpPolicy(policy))
+	var w bytes.Buffer
+	res, err := e.EvalScript(context.Background(), script, &state, nil, &w)
+	assert.NoError(t, err)
+	assert.Contains(t, res, "request to 127.0.0.1 refused")
+
+	policy, err = http_policy.NewPolicy([]string{"127.0.0.1"}, nil)
+	assert.NoError(t, err)
+	e = NewEvalContext(nil, http.DefaultClient, WithHttpPolicy(policy))
+	res, err = e.EvalScript(context.Background(), script, &state, nil, &w)
+	assert.NoError(t, err)
+	assert.Equal(t, "OK", res)
+}
+
+func TestEvalPool(t *testing.T) {
+	e, _ := NewTestEvalContext(http.DefaultClient, WithPoolSize(1))
+	defer e.Close()
+
+	var state sync.Map
+	var w bytes.Buffer
+	_, err := e.EvalScript(context.Background(), `
+  leaked = true
+  string.leaked = true
+  package.loaded['leaked'] = true
+  local io = require('io')
+  local m = require('@lmb')
+  m.state.value = io.read('*a')
+  io.write('first')
+  `, &state, strings.NewReader("input"), &w)
+	assert.NoError(t, err)
+	assert.Equal(t, "first", w.String())
+	value, _ := state.Load("value")
+	assert.Equal(t, "input", value)
+
+	var other sync.Map
+	w.Reset()
+	res, err := e.EvalScript(context.Background(), `
+  local io = require('io')
+  local m = require('@lmb')
+  io.write('second')
+  return {
+    global = leaked == nil,
+    string = string.leaked == nil,
+    loaded = package.loaded['leaked'] == nil,
+    state = m.state.value == nil,
+    input = io.read('*a') == nil,
+  }
+  `, &other, nil, &w)
+	assert.NoError(t, err)
+	assert.Equal(t, "second", w.String())
+	assert.Equal(t, map[string]interface{}{
+		"global": true,
+		"string": true,
+		"loaded": true,
+		"state":  true,
+		"input":  true,
+	}, res)
+}
+
+func TestEvalPoolAfterError(t *testing.T) {
+	e, _ := NewTestEvalContext(http.DefaultClient, WithPoolSize(1))
+	defer e.Close()
+
+	var state sync.Map
+	var w bytes.Buffer
+	_, err := e.EvalScript(context.Background(), "leaked = true; error('failed')", &state, nil, &w)
+	assert.ErrorContains(t, err, "failed")
+
+	res, err := e.EvalScript(context.Background(), "return leaked", &state, nil, &w)
+	assert.NoError(t, err)
+	assert.Nil(t, res)
+}
+
+func TestEvalLimits(t *testing.T) {
+	testCases := []struct {
+		name     string
+		options  []Option
+		script   string
+		expected error
+	}{
+		{"instructions", []Option{WithMaxInstructions(1000)}, "while true do end", ErrInstructionLimit},
+		{"memory", []Option{WithMaxMemory(16 * 1024 * 1024)}, `
+  local t = {}
+  for i = 1, 1e8 do t[i] = tostring(i) end
+  `, ErrMemoryLimit},
+		{"memory in closures", []Option{WithMaxMemory(1024 * 1024)}, `
+  local t = {}
+  local function add(i) t[#t + 1] = string.rep('x', 100) .. i end
+  for i = 1, 1e8 do add(i) end
+  `, ErrMemoryLimit},
+		{"stack", nil, "local function f() return 1 + f() end return f()", ErrStackLimit},
+		{"stack size", []Option{WithMaxStackSize(1000)}, `
+  local t = {}
+  for i = 1, 2000 do t[i] = i end
+  return unpack(t)
+  `, ErrStackLimit},
+	}
+	for _, tc := range testCases {
+		t.Run(tc.name, func(t *testing.T) {
+			var state sync.Map
+			e, _ := NewTestEvalContext(http.DefaultClient, tc.options...)
+			var w bytes.Buffer
+			_, err := e.EvalScript(context.Background(), tc.script, &state, nil, &w)
+			assert.ErrorIs(t, err, tc.expected)
+			var limitErr *LimitError
+			assert.ErrorAs(t, err, &limitErr)
+		})
+	}
+}
+
+func TestEvalMemoryLimitConcurrency(t *testing.T) {
+	var state sync.Map
+	e, _ := NewTestEvalContext(http.DefaultClient, WithMaxMemory(1024*1024))
+
+	// memory allocated elsewhere in the process does not count
+	done := make(chan struct{})
+	var held [][]byte
+	go func() {
+		defer close(done)
+		for i := 0; i < 64; i++ {
+			held = append(held, make([]byte, 1024*1024))
+		}
+	}()
+	var w bytes.Buffer
+	res, err := e.EvalScript(context.Background(), `
+  local n = 0
+  for i = 1, 1e6 do n = n + i % 7 end
+  return n
+  `, &state, nil, &w)
+	<-done
+	assert.NoError(t, err)
+	assert.NotNil(t, res)
+	assert.Len(t, held, 64)
+}
+
+func TestEvalStackSize(t *testing.T) {
+	var state sync.Map
+	e, _ := NewTestEvalContext(http.DefaultClient, WithMaxStackSize(10000))
+	var w bytes.Buffer
+	res, err := e.EvalScript(context.Background(), `
+  local t = {}
+  for i = 1, 8000 do t[i] = i end
+  return select('#', unpack(t))
+  `, &state, nil, &w)
+	assert.NoError(t, err)
+	assert.Equal(t, int64(8000), res)
+}
+
+func TestEvalWithinLimits(t *testing.T) {
+	var state sync.Map
+	e, _ := NewTestEvalContext(http.DefaultClient, WithMaxInstructions(1000), WithMaxMemory(16*1024*1024))
+	var w bytes.Buffer
+	res, err := e.EvalScript(context.Background(), "local n = 0 for i = 1, 10 do n = n + i end return n", &state, nil, &w)
+	assert.NoError(t, err)
+	assert.Equal(t, int64(55), res)
+
+	_, err = e.EvalScript(context.Background(), "error('failed')", &state, nil, &w)
+	assert.ErrorContains(t, err, "failed")
+	var limitErr *LimitError
+	assert.False(t, errors.As(err, &limitErr))
+}
+
+func TestEvalError(t *testing.T) {
+	testCases := []struct {
+		name    string
+		options []Option
+		timeout time.Duration
+		cancel  bool
+		script  string
+		kind    ErrorKind
+		line    int
+		message string
+	}{
+		{"syntax", nil, 0, false, "return 1\nret 1", ErrorKindSyntax, 2, "syntax error"},
+		{"runtime", nil, 0, false, "local a = 1\nerror('failed')", ErrorKindRuntime, 2, "failed"},
+		{"timeout", nil, 100 * time.Millisecond, false, "while true do end", ErrorKindTimeout, 1, "context deadline exceeded"},
+		{"canceled", nil, 100 * time.Millisecond, true, "while true do end", ErrorKindCanceled, 1, "context canceled"},
+		{"resource_limit", []Option{WithMaxInstructions(100)}, 0, false, "while true do end", ErrorKindResourceLimit, 1, "instruction limit exceeded"},
+	}
+	for _, tc := range testCases {
+		t.Run(tc.name, func(t *testing.T) {
+			e, _ := NewTestEvalContext(http.DefaultClient, tc.options...)
+			ctx := context.Background()
+			if tc.cancel {
+				var cancel context.CancelFunc
+				ctx, cancel = context.WithCancel(ctx)
+				defer time.AfterFunc(tc.timeout, cancel).Stop()
+			} else if tc.timeout > 0 {
+				var cancel context.CancelFunc
+				ctx, cancel = context.WithTimeout(ctx, tc.timeout)
+				defer cancel()
+			}
+
+			compiled, err := e.Compile(strings.NewReader(tc.script), "script.lua")
+			if err == nil {
+				var state sync.Map
+				var w bytes.Buffer
+				_, err = e.Eval(ctx, compiled, &state, nil, &w)
+			}
+
+			var evalErr *EvalError
+			assert.ErrorAs(t, err, &evalErr)
+			assert.Equal(t, tc.kind, evalErr.Kind)
+			assert.Equal(t, "script.lua", evalErr.Script)
+			assert.Equal(t, tc.line, evalErr.Line)
+			assert.Contains(t, evalErr.Message, tc.message)
+			if tc.kind != ErrorKindSyntax {
+				assert.Contains(t, evalErr.Traceback, "stack traceback")
+			}
+		})
+	}
+}
+
 func TestEvalReader(t *testing.T) {
 	var state sync.Map
 
@@ -115,18 +566,18 @@ func TestEvalReader(t *testing.T) {
 	matches, err := filepath.Glob("../lua-examples/*.lua")
 	assert.NoError(t, err)
 	for _, path := range matches {
-		e, _ := NewTestEvalContext(strings.NewReader(""), http.DefaultClient)
+		e, _ := NewTestEvalContext(http.DefaultClient)
 		file, err := os.Open(path)
 		assert.NoError(t, err)
 		defer file.Close()
 		var w bytes.Buffer
-		_, err = e.EvalReader(context.Background(), file, &state, &w)
+		_, err = e.EvalReader(context.Background(), file, &state, nil, &w)
 		assert.NoError(t, err, path)
 	}
 }
 
 func TestParse(t *testing.T) {
-	e, _ := NewTestEvalContext(strings.NewReader(""), http.DefaultClient)
+	e, _ := NewTestEvalContext(http.DefaultClient)
 	_, err := e.Parse(strings.NewReader("ret 1"), "invalid")
 	assert.ErrorContains(t, err, "line:1(column:5)")
 }
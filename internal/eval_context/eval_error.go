@@ -0,0 +1,107 @@
+package eval_context
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"strconv"
+	"strings"
+
+	lua "github.com/yuin/gopher-lua"
+	"github.com/yuin/gopher-lua/parse"
+)
+
+type ErrorKind string
+
+const (
+	ErrorKindSyntax        ErrorKind = "syntax"
+	ErrorKindRuntime       ErrorKind = "runtime"
+	ErrorKindTimeout       ErrorKind = "timeout"
+	ErrorKindCanceled      ErrorKind = "canceled"
+	ErrorKindResourceLimit ErrorKind = "resource_limit"
+)
+
+// EvalError describes why a script failed to compile or to evaluate. Line is
+// zero when the position is unknown.
+type EvalError struct {
+	Kind      ErrorKind `json:"kind"`
+	Script    string    `json:"script"`
+	Line      int       `json:"line,omitempty"`
+	Message   string    `json:"message"`
+	Traceback string    `json:"traceback,omitempty"`
+	err       error
+}
+
+func (e *EvalError) Error() string {
+	return e.err.Error()
+}
+
+func (e *EvalError) Unwrap() error {
+	return e.err
+}
+
+func newSyntaxError(script string, err error) *EvalError {
+	evalErr := &EvalError{Kind: ErrorKindSyntax, Script: script, Message: err.Error(), err: err}
+
+	var parseErr *parse.Error
+	var compileErr *lua.CompileError
+	switch {
+	case errors.As(err, &parseErr):
+		if parseErr.Pos.Line > 0 {
+			evalErr.Line = parseErr.Pos.Line
+		}
+		evalErr.Message = parseErr.Message
+		if parseErr.Token != "" {
+			evalErr.Message = fmt.Sprintf("%s near '%s'", parseErr.Message, parseErr.Token)
+		}
+	case errors.As(err, &compileErr):
+		evalErr.Line = compileErr.Line
+		evalErr.Message = compileErr.Message
+	}
+	return evalErr
+}
+
+func newEvalError(ctx context.Context, l limits, script string, err error) *EvalError {
+	evalErr := &EvalError{Kind: ErrorKindRuntime, Script: script, Message: err.Error(), err: err}
+
+	var apiErr *lua.ApiError
+	if errors.As(err, &apiErr) {
+		evalErr.Traceback = apiErr.StackTrace
+		if apiErr.Object != nil {
+			evalErr.Line, evalErr.Message = splitPosition(script, apiErr.Object.String())
+		}
+	}
+
+	var limitErr *LimitError
+	if errors.As(limitError(ctx, l, err), &limitErr) {
+		evalErr.Kind = ErrorKindResourceLimit
+		evalErr.Message = limitErr.Error()
+		evalErr.err = limitErr
+	} else if errors.Is(ctx.Err(), context.DeadlineExceeded) {
+		evalErr.Kind = ErrorKindTimeout
+		evalErr.Message = ctx.Err().Error()
+	} else if ctx.Err() != nil {
+		// e.g. the client disconnected or the server is shutting down
+		evalErr.Kind = ErrorKindCanceled
+		evalErr.Message = ctx.Err().Error()
+	}
+	return evalErr
+}
+
+// splitPosition separates the position that Lua prepends to error messages e.g.
+// "script.lua:3: message" from the message itself.
+func splitPosition(script, message string) (int, string) {
+	rest, ok := strings.CutPrefix(message, script+":")
+	if !ok {
+		return 0, message
+	}
+	rawLine, rest, ok := strings.Cut(rest, ":")
+	if !ok {
+		return 0, message
+	}
+	line, err := strconv.Atoi(rawLine)
+	if err != nil {
+		return 0, message
+	}
+	return line, strings.TrimPrefix(rest, " ")
+}
@@ -0,0 +1,35 @@
+package eval_context
+
+import (
+	"context"
+	"net/http"
+)
+
+// contextTransport binds outgoing requests to the context of an evaluation, so
+// that cancelling the evaluation also cancels its in-flight requests. The
+// context is replaced whenever a pooled state is reused.
+type contextTransport struct {
+	ctx  context.Context
+	base http.RoundTripper
+}
+
+func (t *contextTransport) RoundTrip(req *http.Request) (*http.Response, error) {
+	base := t.base
+	if base == nil {
+		base = http.DefaultTransport
+	}
+	ctx := t.ctx
+	if ctx == nil {
+		ctx = context.Background()
+	}
+	return base.RoundTrip(req.WithContext(ctx))
+}
+
+// newEvalHttpClient returns a copy of the client whose requests are cancelled
+// together with the evaluation, and the transport to bind the evaluation to.
+func newEvalHttpClient(client *http.Client) (*http.Client, *contextTransport) {
+	transport := &contextTransport{base: client.Transport}
+	c := *client
+	c.Transport = transport
+	return &c, transport
+}
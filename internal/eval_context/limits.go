@@ -0,0 +1,238 @@
+package eval_context
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"strings"
+
+	lua "github.com/yuin/gopher-lua"
+)
+
+var (
+	ErrInstructionLimit = errors.New("instruction limit exceeded")
+	ErrMemoryLimit      = errors.New("memory limit exceeded")
+	ErrStackLimit       = errors.New("stack limit exceeded")
+)
+
+const (
+	// callStackSize bounds the depth of nested Lua calls, which is the default of
+	// gopher-lua.
+	callStackSize = 256
+	// registrySize is the number of values on the Lua stack, which is the default
+	// of gopher-lua. It is fixed unless WithMaxStackSize lets it grow.
+	registrySize = 256 * 20
+	// memoryCheckInterval is the minimum number of instructions between two
+	// estimates of the memory held by an evaluation.
+	memoryCheckInterval = 1000
+)
+
+// LimitError is returned when an evaluation exceeds one of its limits. It wraps
+// ErrInstructionLimit, ErrMemoryLimit or ErrStackLimit.
+type LimitError struct {
+	Err   error
+	Limit int64
+}
+
+func (e *LimitError) Error() string {
+	return fmt.Sprintf("%s: limit is %d", e.Err, e.Limit)
+}
+
+func (e *LimitError) Unwrap() error {
+	return e.Err
+}
+
+// limits are enforced on every evaluation. Zero means unlimited, or the default
+// size of the stack.
+type limits struct {
+	maxInstructions int64
+	maxMemory       int64
+	maxStackSize    int
+}
+
+// stackSize is the maximum number of values on the Lua stack.
+func (l limits) stackSize() int {
+	if l.maxStackSize > 0 {
+		return l.maxStackSize
+	}
+	return registrySize
+}
+
+// WithMaxInstructions limits the number of Lua instructions an evaluation can
+// execute.
+func WithMaxInstructions(n int64) Option {
+	return func(e *EvalContext) {
+		e.limits.maxInstructions = n
+	}
+}
+
+// WithMaxMemory limits the memory held by the Lua values an evaluation can
+// reach, such as tables, strings and closures, in bytes. The size is estimated
+// from the values themselves, so evaluations running concurrently do not count
+// towards each other's limits. Memory allocated by Go modules is not counted.
+func WithMaxMemory(size int64) Option {
+	return func(e *EvalContext) {
+		e.limits.maxMemory = size
+	}
+}
+
+// WithMaxStackSize limits the number of values on the Lua stack of an
+// evaluation. The stack grows on demand up to size instead of having the fixed
+// default size.
+func WithMaxStackSize(size int) Option {
+	return func(e *EvalContext) {
+		e.limits.maxStackSize = size
+	}
+}
+
+var closedDone = func() chan struct{} {
+	done := make(chan struct{})
+	close(done)
+	return done
+}()
+
+// limitContext counts instructions and estimates the memory held by the
+// evaluation. The Lua VM checks Done before every instruction, so it is only
+// used by the goroutine running the evaluation.
+type limitContext struct {
+	context.Context
+	L            *lua.LState
+	limits       limits
+	instructions int64
+	baseline     int64
+	// nextCheck is when the memory is estimated again. Estimating walks every
+	// reachable value, so the interval grows with the number of values.
+	nextCheck int64
+	exceeded  *LimitError
+}
+
+func newLimitContext(ctx context.Context, L *lua.LState, l limits) *limitContext {
+	c := &limitContext{Context: ctx, L: L, limits: l}
+	if l.maxMemory > 0 {
+		c.baseline, _ = estimateMemory(L)
+		c.nextCheck = memoryCheckInterval
+	}
+	return c
+}
+
+func (c *limitContext) memoryExceeded() bool {
+	size, values := estimateMemory(c.L)
+	c.nextCheck = c.instructions + max(memoryCheckInterval, int64(values))
+	return size-c.baseline > c.limits.maxMemory
+}
+
+func (c *limitContext) Done() <-chan struct{} {
+	if c.exceeded != nil {
+		return closedDone
+	}
+	c.instructions++
+	if max := c.limits.maxInstructions; max > 0 && c.instructions > max {
+		c.exceeded = &LimitError{ErrInstructionLimit, max}
+		return closedDone
+	}
+	if c.limits.maxMemory > 0 && c.instructions >= c.nextCheck && c.memoryExceeded() {
+		c.exceeded = &LimitError{ErrMemoryLimit, c.limits.maxMemory}
+		return closedDone
+	}
+	return c.Context.Done()
+}
+
+func (c *limitContext) Err() error {
+	if c.exceeded != nil {
+		return c.exceeded
+	}
+	return c.Context.Err()
+}
+
+// limitError translates an error raised by an evaluation into a LimitError when
+// the evaluation was stopped by one of its limits.
+func limitError(ctx context.Context, l limits, err error) error {
+	if c, ok := ctx.(*limitContext); ok && c.exceeded != nil {
+		return c.exceeded
+	}
+	var apiErr *lua.ApiError
+	if errors.As(err, &apiErr) && apiErr.Object != nil {
+		message := apiErr.Object.String()
+		if strings.HasSuffix(message, "stack overflow") {
+			return &LimitError{ErrStackLimit, int64(callStackSize)}
+		}
+		if strings.HasSuffix(message, "registry overflow") {
+			return &LimitError{ErrStackLimit, int64(l.stackSize())}
+		}
+	}
+	return err
+}
+
+// Rough sizes of Lua values in bytes. They only need to grow with the values a
+// script holds.
+const (
+	valueSize  = 16 // an interface
+	entrySize  = 2 * valueSize
+	objectSize = 64 // a table, function or userdata without its contents
+)
+
+// estimateMemory walks the values reachable from the globals, the registry and
+// the locals of every running function, and returns their estimated size and
+// the number of values walked.
+func estimateMemory(L *lua.LState) (int64, int) {
+	var size int64
+	var count int
+	seen := make(map[lua.LValue]struct{})
+	pending := []lua.LValue{L.G.Global, L.G.Registry}
+	for level := 0; ; level++ {
+		dbg, ok := L.GetStack(level)
+		if !ok {
+			break
+		}
+		if fn, err := L.GetInfo("f", dbg, lua.LNil); err == nil {
+			pending = append(pending, fn)
+		}
+		for n := 1; ; n++ {
+			name, value := L.GetLocal(dbg, n)
+			if name == "" {
+				break
+			}
+			pending = append(pending, value)
+		}
+	}
+
+	for len(pending) > 0 {
+		value := pending[len(pending)-1]
+		pending = pending[:len(pending)-1]
+		count++
+		switch v := value.(type) {
+		case lua.LString:
+			size += valueSize + int64(len(v))
+			continue
+		case *lua.LTable, *lua.LFunction, *lua.LUserData:
+			if _, ok := seen[value]; ok {
+				continue
+			}
+			seen[value] = struct{}{}
+		default:
+			continue
+		}
+		size += objectSize
+		switch v := value.(type) {
+		case *lua.LTable:
+			v.ForEach(func(key, value lua.LValue) {
+				size += entrySize
+				pending = append(pending, key, value)
+			})
+			pending = append(pending, v.Metatable)
+		case *lua.LFunction:
+			for _, upvalue := range v.Upvalues {
+				pending = append(pending, upvalue.Value())
+			}
+			if v.Env != nil {
+				pending = append(pending, v.Env)
+			}
+		case *lua.LUserData:
+			pending = append(pending, v.Metatable)
+			if v.Env != nil {
+				pending = append(pending, v.Env)
+			}
+		}
+	}
+	return size, count
+}
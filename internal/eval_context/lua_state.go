@@ -0,0 +1,113 @@
+package eval_context
+
+import (
+	"context"
+	"io"
+	"strings"
+	"sync"
+
+	"github.com/henry40408/lmb/internal/store"
+	lua "github.com/yuin/gopher-lua"
+)
+
+type ioModule interface {
+	Reset(r io.Reader, w io.Writer)
+}
+
+type lmbModule interface {
+	Reset(state *sync.Map, store store.Store, w io.Writer)
+}
+
+// luaState is a Lua state with every library opened and every module preloaded,
+// which can be bound to one evaluation after another.
+type luaState struct {
+	L         *lua.LState
+	io        ioModule
+	lmb       lmbModule
+	snapshot  []tableSnapshot
+	transport *contextTransport
+}
+
+// tableSnapshot records the fields and the metatable of a table as they were
+// right after the state was initialized.
+type tableSnapshot struct {
+	table     *lua.LTable
+	fields    map[lua.LValue]lua.LValue
+	metatable lua.LValue
+}
+
+func newTableSnapshot(L *lua.LState, table *lua.LTable) tableSnapshot {
+	fields := make(map[lua.LValue]lua.LValue)
+	table.ForEach(func(k, v lua.LValue) {
+		fields[k] = v
+	})
+	return tableSnapshot{table, fields, L.GetMetatable(table)}
+}
+
+func (s *tableSnapshot) restore(L *lua.LState) {
+	var added []lua.LValue
+	s.table.ForEach(func(k, _ lua.LValue) {
+		if _, ok := s.fields[k]; !ok {
+			added = append(added, k)
+		}
+	})
+	for _, k := range added {
+		s.table.RawSet(k, lua.LNil)
+	}
+	for k, v := range s.fields {
+		s.table.RawSet(k, v)
+	}
+	L.SetMetatable(s.table, s.metatable)
+}
+
+// takeSnapshot records the global table, the tables it holds such as string and
+// math, the loaded and preloaded modules, and the metatable of strings.
+func (s *luaState) takeSnapshot() {
+	L := s.L
+	seen := make(map[*lua.LTable]bool)
+	add := func(v lua.LValue) {
+		t, ok := v.(*lua.LTable)
+		if !ok || seen[t] {
+			return
+		}
+		seen[t] = true
+		s.snapshot = append(s.snapshot, newTableSnapshot(L, t))
+	}
+
+	globals := L.G.Global
+	add(globals)
+	globals.ForEach(func(_, v lua.LValue) {
+		add(v)
+	})
+	if pkg, ok := L.GetGlobal(lua.LoadLibName).(*lua.LTable); ok {
+		add(L.GetField(pkg, "loaded"))
+		add(L.GetField(pkg, "preload"))
+	}
+	add(L.GetMetatable(lua.LString("")))
+}
+
+// bind prepares the state for an evaluation.
+func (s *luaState) bind(ctx context.Context, state *sync.Map, store store.Store, r io.Reader, w io.Writer) {
+	if r == nil {
+		r = strings.NewReader("")
+	}
+	s.io.Reset(r, w)
+	s.lmb.Reset(state, store, w)
+	s.transport.ctx = ctx
+	s.L.SetContext(ctx)
+}
+
+// reset undoes everything an evaluation did to the globals, so that the next
+// evaluation cannot observe it, and drops references to the evaluation.
+func (s *luaState) reset() {
+	L := s.L
+	L.RemoveContext()
+	L.SetTop(0)
+	L.Env = L.G.Global
+	for i := range s.snapshot {
+		s.snapshot[i].restore(L)
+	}
+	s.io.Reset(strings.NewReader(""), io.Discard)
+	s.lmb.Reset(nil, nil, nil)
+	s.transport.ctx = nil
+}
@@ -14,12 +14,32 @@ import (
 )
 
 type ioModule struct {
+	// buffer is owned by the module and reused when the module is reset.
+	buffer *bufio.Reader
 	reader *bufio.Reader
 	writer io.Writer
 }
 
-func NewIoMod(br *bufio.Reader, w io.Writer) *ioModule {
-	return &ioModule{br, w}
+func NewIoMod(r io.Reader, w io.Writer) *ioModule {
+	m := &ioModule{}
+	m.Reset(r, w)
+	return m
+}
+
+// Reset binds the module to another reader and writer, so that a Lua state can
+// be reused across evaluations.
+func (m *ioModule) Reset(r io.Reader, w io.Writer) {
+	if br, ok := r.(*bufio.Reader); ok {
+		m.reader = br
+	} else {
+		if m.buffer == nil {
+			m.buffer = bufio.NewReader(r)
+		} else {
+			m.buffer.Reset(r)
+		}
+		m.reader = m.buffer
+	}
+	m.writer = w
 }
 
 func (m *ioModule) Loader(L *lua.LState) int {
@@ -1,7 +1,11 @@
 package lmb_mod
 
 import (
+	"context"
+	"errors"
+	"io"
 	"sync"
+	"time"
 
 	"github.com/henry40408/lmb/internal/lua_convert"
 	"github.com/henry40408/lmb/internal/store"
@@ -16,11 +20,65 @@ type lmbModule struct {
 	// store represents persistent data storage using SQLite. It's designed to maintain
 	// data across multiple evaluation cycles and program executions. Use the store for
 	// data that needs to persist long-term and be accessible in future runs.
-	store *store.Store
+	store store.Store
+	// tx is the innermost transaction of m.store:update. Every access to the
+	// store goes through it until it finishes.
+	tx store.Tx
+	// namespaces are the other namespaces of the store that scripts can open.
+	namespaces []string
+	// watchCtx ends m.store:watch early when it is done.
+	watchCtx context.Context
+	// cancels stop the watchers of m.store:watcher when the evaluation ends.
+	cancels []func()
+	// writer is the output of the evaluation. m.response:flush() flushes it if it
+	// implements Flusher.
+	writer io.Writer
 }
 
-func NewLmbModule(state *sync.Map, store *store.Store) *lmbModule {
-	return &lmbModule{state, store}
+// Flusher is implemented by outputs which buffer what scripts write, such as
+// streamed HTTP responses.
+type Flusher interface {
+	Flush() error
+}
+
+type Option func(*lmbModule)
+
+// WithNamespaces allows scripts to open the namespaces of the store with
+// m.store:namespace(name). "*" allows every namespace.
+func WithNamespaces(namespaces ...string) Option {
+	return func(m *lmbModule) {
+		m.namespaces = namespaces
+	}
+}
+
+// WithWatchContext ends m.store:watch when ctx is done as if nothing changed,
+// e.g. when a server shuts down.
+func WithWatchContext(ctx context.Context) Option {
+	return func(m *lmbModule) {
+		m.watchCtx = ctx
+	}
+}
+
+func NewLmbModule(state *sync.Map, store store.Store, options ...Option) *lmbModule {
+	m := &lmbModule{state: state, store: store}
+	for _, option := range options {
+		option(m)
+	}
+	return m
+}
+
+// Reset binds the module to the state, store and output of another evaluation,
+// so that a Lua state can be reused across evaluations.
+// Watchers of the previous evaluation are stopped.
+func (m *lmbModule) Reset(state *sync.Map, store store.Store, w io.Writer) {
+	for _, cancel := range m.cancels {
+		cancel()
+	}
+	m.cancels = nil
+	m.state = state
+	m.store = store
+	m.tx = nil
+	m.writer = w
 }
 
 func (m *lmbModule) Loader(L *lua.LState) int {
@@ -33,18 +91,25 @@ func (m *lmbModule) Loader(L *lua.LState) int {
 	L.SetMetatable(stateTable, stateMeta)
 	L.SetField(mod, "state", stateTable)
 
-	storeTable := L.NewTable()
-	L.SetField(storeTable, "update", L.NewFunction(m.storeUpdate))
-	storeMeta := L.NewTable()
-	L.SetField(storeMeta, "__index", L.NewFunction(m.storeGet))
-	L.SetField(storeMeta, "__newindex", L.NewFunction(m.storePut))
-	L.SetMetatable(storeTable, storeMeta)
-	L.SetField(mod, "store", storeTable)
+	responseTable := L.NewTable()
+	L.SetField(responseTable, "flush", L.NewFunction(m.flush))
+	L.SetField(mod, "response", responseTable)
+
+	L.SetField(mod, "store", m.newStoreTable(L, ""))
 
 	L.Push(mod)
 	return 1
 }
 
+func (m *lmbModule) flush(L *lua.LState) int {
+	if f, ok := m.writer.(Flusher); ok {
+		if err := f.Flush(); err != nil {
+			L.RaiseError(err.Error())
+		}
+	}
+	return 0
+}
+
 func (m *lmbModule) get(L *lua.LState) int {
 	name := L.CheckString(2)
 	value, ok := m.state.Load(name)
@@ -63,73 +128,370 @@ func (m *lmbModule) set(L *lua.LState) int {
 	return 0
 }
 
-func (m *lmbModule) storeGet(L *lua.LState) int {
-	name := L.CheckString(2)
-	value, err := m.store.Get(name)
-	if err != nil {
-		L.RaiseError(err.Error())
+// checkNamespace returns the namespace of the first argument after self, and
+// raises an error when scripts are not allowed to open it.
+func (m *lmbModule) checkNamespace(L *lua.LState) string {
+	namespace := L.CheckString(2)
+	if namespace == "" {
+		L.ArgError(2, "namespace must not be empty")
 	}
-	L.Push(lua_convert.ToLuaValue(L, value))
-	return 1
+	for _, allowed := range m.namespaces {
+		if allowed == "*" || allowed == namespace {
+			return namespace
+		}
+	}
+	L.RaiseError("namespace %s is not allowed", namespace)
+	return ""
 }
 
-func (m *lmbModule) storePut(L *lua.LState) int {
-	name := L.CheckString(2)
-	value := lua_convert.FromLuaValue(L.Get(3))
-	err := m.store.Put(name, value)
-	if err != nil {
-		L.RaiseError(err.Error())
+// accessor returns the store, or the active transaction, in namespace. An empty
+// namespace is the namespace of the evaluation.
+func (m *lmbModule) accessor(namespace string) store.Accessor {
+	switch {
+	case m.tx != nil && namespace == "":
+		return m.tx
+	case m.tx != nil:
+		return m.tx.Namespace(namespace)
+	case namespace == "":
+		return m.store
+	default:
+		return m.store.Namespace(namespace)
 	}
-	return 0
 }
 
-func (m *lmbModule) storeUpdate(L *lua.LState) int {
-	f := L.CheckFunction(2)
+func (m *lmbModule) newStoreTable(L *lua.LState, namespace string) *lua.LTable {
+	t := L.NewTable()
+	L.SetField(t, "namespace", L.NewFunction(func(L *lua.LState) int {
+		L.Push(m.newStoreTable(L, m.checkNamespace(L)))
+		return 1
+	}))
+	L.SetField(t, "update", L.NewFunction(func(L *lua.LState) int {
+		return m.storeUpdate(L, namespace)
+	}))
+	L.SetField(t, "watch", L.NewFunction(func(L *lua.LState) int {
+		return m.storeWatch(L, namespace)
+	}))
+	L.SetField(t, "watcher", L.NewFunction(func(L *lua.LState) int {
+		return m.storeWatcher(L, namespace)
+	}))
+	setStoreFunctions(L, t, func() store.Accessor {
+		return m.accessor(namespace)
+	})
+	return t
+}
 
-	st, err := m.store.Begin()
-	if err != nil {
-		L.RaiseError(err.Error())
-	}
-	defer st.Rollback()
+// scanPageSize is the number of entries fetched at once by the pairs iterator.
+const scanPageSize = 100
 
-	t := L.NewTable()
-	mt := L.NewTable()
-	L.SetField(mt, "__index", L.NewFunction(func(l *lua.LState) int {
+// defaultHistoryLimit is the number of changes m.store:history returns by default.
+const defaultHistoryLimit = 10
+
+// setStoreFunctions sets the functions reading and writing values through the
+// accessor returned by s, which is resolved on every call.
+func setStoreFunctions(L *lua.LState, t *lua.LTable, s func() store.Accessor) {
+	L.SetField(t, "cas", L.NewFunction(func(L *lua.LState) int {
+		name := L.CheckString(2)
+		expected := lua_convert.FromLuaValue(L.Get(3))
+		value := lua_convert.FromLuaValue(L.Get(4))
+		swapped, err := s().CompareAndSwap(name, expected, value)
+		if err != nil {
+			L.RaiseError(err.Error())
+		}
+		L.Push(lua.LBool(swapped))
+		return 1
+	}))
+	L.SetField(t, "delete", L.NewFunction(func(L *lua.LState) int {
+		name := L.CheckString(2)
+		if err := s().Delete(name); err != nil {
+			L.RaiseError(err.Error())
+		}
+		return 0
+	}))
+	L.SetField(t, "get_at", L.NewFunction(func(L *lua.LState) int {
 		name := L.CheckString(2)
-		value, err := st.Get(name)
+		var at time.Time
+		switch v := L.CheckAny(3).(type) {
+		case lua.LNumber:
+			at = time.UnixMilli(int64(float64(v) * 1000))
+		case lua.LString:
+			parsed, err := time.Parse(time.RFC3339, string(v))
+			if err != nil {
+				L.ArgError(3, "time must be in RFC3339")
+			}
+			at = parsed
+		default:
+			L.ArgError(3, "time must be a string in RFC3339 or a number of seconds")
+		}
+		value, err := s().GetAt(name, at)
 		if err != nil {
 			L.RaiseError(err.Error())
 		}
 		L.Push(lua_convert.ToLuaValue(L, value))
 		return 1
 	}))
-	L.SetField(mt, "__newindex", L.NewFunction(func(l *lua.LState) int {
+	L.SetField(t, "has", L.NewFunction(func(L *lua.LState) int {
+		name := L.CheckString(2)
+		found, err := s().Has(name)
+		if err != nil {
+			L.RaiseError(err.Error())
+		}
+		L.Push(lua.LBool(found))
+		return 1
+	}))
+	L.SetField(t, "history", L.NewFunction(func(L *lua.LState) int {
+		name := L.CheckString(2)
+		limit := L.OptInt(3, defaultHistoryLimit)
+		if limit <= 0 {
+			L.ArgError(3, "limit must be positive")
+		}
+		changes, err := s().History(name, limit)
+		if err != nil {
+			L.RaiseError(err.Error())
+		}
+		list := L.CreateTable(len(changes), 0)
+		for _, change := range changes {
+			row := L.CreateTable(0, 4)
+			row.RawSetString("value", lua_convert.ToLuaValue(L, change.Value))
+			row.RawSetString("previous", lua_convert.ToLuaValue(L, change.Previous))
+			row.RawSetString("script", lua.LString(change.Script))
+			row.RawSetString("changed_at", lua.LString(change.ChangedAt.Format(time.RFC3339)))
+			list.Append(row)
+		}
+		L.Push(list)
+		return 1
+	}))
+	L.SetField(t, "incr", L.NewFunction(func(L *lua.LState) int {
+		name := L.CheckString(2)
+		delta := L.OptNumber(3, 1)
+		if float64(delta) != float64(int64(delta)) {
+			L.ArgError(3, "delta must be an integer")
+		}
+		n, err := s().Incr(name, int64(delta))
+		if err != nil {
+			L.RaiseError(err.Error())
+		}
+		L.Push(lua.LNumber(n))
+		return 1
+	}))
+	L.SetField(t, "keys", L.NewFunction(func(L *lua.LState) int {
+		prefix := L.OptString(2, "")
+		names, err := s().Keys(prefix)
+		if err != nil {
+			L.RaiseError(err.Error())
+		}
+		L.Push(lua_convert.ToLuaValue(L, names))
+		return 1
+	}))
+	L.SetField(t, "pairs", L.NewFunction(func(L *lua.LState) int {
+		prefix := L.OptString(2, "")
+		L.Push(L.NewFunction(storeIterator(s, prefix)))
+		return 1
+	}))
+	L.SetField(t, "set", L.NewFunction(func(L *lua.LState) int {
 		name := L.CheckString(2)
 		value := lua_convert.FromLuaValue(L.Get(3))
-		err := st.Put(name, value)
+		var ttl time.Duration
+		if opts := L.OptTable(4, nil); opts != nil {
+			switch v := opts.RawGetString("ttl").(type) {
+			case *lua.LNilType:
+			case lua.LNumber:
+				if v <= 0 {
+					L.ArgError(4, "ttl must be positive")
+				}
+				ttl = time.Duration(float64(v) * float64(time.Second))
+			default:
+				L.ArgError(4, "ttl must be a number of seconds")
+			}
+		}
+		storeSet(L, s(), name, value, ttl)
+		return 0
+	}))
+
+	mt := L.NewTable()
+	L.SetField(mt, "__index", L.NewFunction(func(L *lua.LState) int {
+		name := L.CheckString(2)
+		value, err := s().Get(name)
 		if err != nil {
 			L.RaiseError(err.Error())
 		}
+		L.Push(lua_convert.ToLuaValue(L, value))
+		return 1
+	}))
+	L.SetField(mt, "__newindex", L.NewFunction(func(L *lua.LState) int {
+		name := L.CheckString(2)
+		value := lua_convert.FromLuaValue(L.Get(3))
+		storeSet(L, s(), name, value, 0)
 		return 0
 	}))
 	L.SetMetatable(t, mt)
+}
 
-	L.Push(f)
-	L.Push(t)
-	err = L.PCall(1, lua.MultRet, nil)
+// storeSet writes the value with an optional TTL. Setting nil deletes the key.
+func storeSet(L *lua.LState, s store.Accessor, name string, value interface{}, ttl time.Duration) {
+	var err error
+	switch {
+	case value == nil:
+		err = s.Delete(name)
+	case ttl > 0:
+		err = s.PutWithTTL(name, value, ttl)
+	default:
+		err = s.Put(name, value)
+	}
 	if err != nil {
 		L.RaiseError(err.Error())
 	}
+}
+
+// storeIterator returns a stateful iterator for the generic for statement. It
+// fetches entries page by page so that large stores are never loaded at once.
+func storeIterator(s func() store.Accessor, prefix string) lua.LGFunction {
+	var page []store.Entry
+	after := ""
+	done := false
+	return func(L *lua.LState) int {
+		if len(page) == 0 && !done {
+			entries, err := s().Scan(prefix, after, scanPageSize)
+			if err != nil {
+				L.RaiseError(err.Error())
+			}
+			page = entries
+			done = len(entries) < scanPageSize
+		}
+		if len(page) == 0 {
+			L.Push(lua.LNil)
+			return 1
+		}
+		entry := page[0]
+		page = page[1:]
+		after = entry.Name
+		L.Push(lua.LString(entry.Name))
+		L.Push(lua_convert.ToLuaValue(L, entry.Value))
+		return 2
+	}
+}
+
+// storeUpdate calls the function in a transaction, which is nested with a
+// savepoint when another update is running. The transaction is rolled back when
+// the function raises an error, and the error is raised again as is.
+func (m *lmbModule) storeUpdate(L *lua.LState, namespace string) int {
+	f := L.CheckFunction(2)
 
-	err = st.Commit()
+	var tx store.Tx
+	var err error
+	if m.tx != nil {
+		tx, err = m.tx.Begin()
+	} else {
+		tx, err = m.store.Begin()
+	}
 	if err != nil {
 		L.RaiseError(err.Error())
 	}
+	parent := m.tx
+	m.tx = tx
+	defer func() {
+		tx.Rollback()
+		m.tx = parent
+	}()
+
+	base := L.GetTop()
+	L.Push(f)
+	L.Push(m.newStoreTable(L, namespace))
+	if err := L.PCall(1, lua.MultRet, nil); err != nil {
+		var apiErr *lua.ApiError
+		if errors.As(err, &apiErr) && apiErr.Object != nil {
+			L.Error(apiErr.Object, 0)
+		}
+		L.RaiseError(err.Error())
+	}
+
+	if err := tx.Commit(); err != nil {
+		L.RaiseError(err.Error())
+	}
 
-	nResults := L.GetTop() - 1
+	nResults := L.GetTop() - base
 	if nResults == 0 {
 		L.Push(lua.LNil)
 		return 1
 	}
 	return nResults
 }
+
+// storeWatch waits until a value in namespace starting with the prefix is
+// written or deleted, and returns its name. It returns nil when the timeout in
+// seconds passes first, and raises an error when the evaluation is cancelled.
+func (m *lmbModule) storeWatch(L *lua.LState, namespace string) int {
+	prefix := L.OptString(2, "")
+	names, cancel := m.watch(namespace, prefix)
+	defer cancel()
+	return m.wait(L, names, 3)
+}
+
+// storeWatcher starts watching values in namespace starting with the prefix,
+// and returns a watcher whose wait method returns the names changed since, so
+// that changes made between reading a value and waiting are not missed.
+func (m *lmbModule) storeWatcher(L *lua.LState, namespace string) int {
+	prefix := L.OptString(2, "")
+	names, cancel := m.watch(namespace, prefix)
+	m.cancels = append(m.cancels, cancel)
+
+	t := L.NewTable()
+	L.SetField(t, "wait", L.NewFunction(func(L *lua.LState) int {
+		return m.wait(L, names, 2)
+	}))
+	L.SetField(t, "close", L.NewFunction(func(L *lua.LState) int {
+		cancel()
+		return 0
+	}))
+	L.Push(t)
+	return 1
+}
+
+func (m *lmbModule) watch(namespace, prefix string) (<-chan string, func()) {
+	s := m.store
+	if namespace != "" {
+		s = s.Namespace(namespace)
+	}
+	return s.Watch(prefix)
+}
+
+// wait waits for a name from names with the timeout in seconds at index n, see
+// storeWatch.
+func (m *lmbModule) wait(L *lua.LState, names <-chan string, n int) int {
+	timeout := L.OptNumber(n, 0)
+	if timeout < 0 {
+		L.ArgError(n, "timeout must not be negative")
+	}
+	// values cannot change while the transaction holds the store
+	if m.tx != nil {
+		L.RaiseError("cannot watch in m.store:update")
+	}
+
+	ctx := L.Context()
+	if ctx == nil {
+		ctx = context.Background()
+	}
+	var expired <-chan time.Time
+	if timeout > 0 {
+		timer := time.NewTimer(time.Duration(float64(timeout) * float64(time.Second)))
+		defer timer.Stop()
+		expired = timer.C
+	}
+	var stopped <-chan struct{}
+	if m.watchCtx != nil {
+		stopped = m.watchCtx.Done()
+	}
+
+	select {
+	case name, ok := <-names:
+		if ok {
+			L.Push(lua.LString(name))
+			return 1
+		}
+	case <-ctx.Done():
+		L.RaiseError(ctx.Err().Error())
+	case <-expired:
+	case <-stopped:
+	}
+	L.Push(lua.LNil)
+	return 1
+}
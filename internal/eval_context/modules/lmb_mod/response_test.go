@@ -0,0 +1,46 @@
+package lmb_mod
+
+import (
+	"bytes"
+	"sync"
+	"testing"
+
+	"github.com/henry40408/lmb/internal/eval_context/modules/testutil"
+	"github.com/henry40408/lmb/internal/store"
+	"github.com/stretchr/testify/assert"
+)
+
+type flushWriter struct {
+	bytes.Buffer
+	flushed int
+}
+
+func (w *flushWriter) Flush() error {
+	w.flushed++
+	return nil
+}
+
+func TestResponseFlush(t *testing.T) {
+	L := testutil.NewLuaTestState()
+	defer L.Close()
+
+	var state sync.Map
+	store, err := store.NewStore(":memory:")
+	assert.NoError(t, err)
+	m := NewLmbModule(&state, store)
+	L.PreloadModule("@lmb", m.Loader)
+
+	// flushing an output which cannot be flushed does nothing
+	err = L.DoString(`require('@lmb').response:flush()`)
+	assert.NoError(t, err)
+
+	var w flushWriter
+	m.Reset(&state, store, &w)
+	err = L.DoString(`
+  local m = require('@lmb')
+  m.response:flush()
+  m.response:flush()
+  `)
+	assert.NoError(t, err)
+	assert.Equal(t, 2, w.flushed)
+}
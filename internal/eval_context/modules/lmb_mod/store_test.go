@@ -1,9 +1,12 @@
 package lmb_mod
 
 import (
+	"context"
+	"fmt"
 	"strings"
 	"sync"
 	"testing"
+	"time"
 
 	"github.com/henry40408/lmb/internal/eval_context/modules/testutil"
 	"github.com/henry40408/lmb/internal/lua_convert"
@@ -31,6 +34,192 @@ func TestStore(t *testing.T) {
 	assert.Equal(t, true, res)
 }
 
+func TestStoreTable(t *testing.T) {
+	L, _, store := setupEvalContext()
+	defer store.Close()
+	defer L.Close()
+
+	err := L.DoString(`
+  local m = require('@lmb')
+  m.store['t'] = { a = 1, b = { 1.5, 'c' } }
+  local t = m.store['t']
+  assert(t.a == 1 and t.b[1] == 1.5 and t.b[2] == 'c')
+  return true
+  `)
+	assert.NoError(t, err)
+
+	value, err := store.Get("t")
+	assert.NoError(t, err)
+	assert.Equal(t, map[string]interface{}{"a": int64(1), "b": []interface{}{1.5, "c"}}, value)
+}
+
+func TestStoreDelete(t *testing.T) {
+	L, _, store := setupEvalContext()
+	defer store.Close()
+	defer L.Close()
+
+	err := L.DoString(`
+  local m = require('@lmb')
+  m.store['a'] = 1
+  m.store['b'] = 2
+  assert(m.store:has('a'))
+  m.store:delete('a')
+  assert(not m.store:has('a'))
+  m.store['b'] = nil
+  assert(not m.store:has('b'))
+  m.store:delete('c')
+  return true
+  `)
+	assert.NoError(t, err)
+
+	res := lua_convert.FromLuaValue(L.Get(-1))
+	assert.Equal(t, true, res)
+
+	names, err := store.Keys("")
+	assert.NoError(t, err)
+	assert.Empty(t, names)
+}
+
+func TestStoreKeys(t *testing.T) {
+	L, _, store := setupEvalContext()
+	defer store.Close()
+	defer L.Close()
+
+	for _, name := range []string{"user:2", "user:1", "session:1", "user"} {
+		assert.NoError(t, store.Put(name, int64(1)))
+	}
+
+	err := L.DoString(`
+  local m = require('@lmb')
+  return m.store:keys('user:')
+  `)
+	assert.NoError(t, err)
+
+	res := lua_convert.FromLuaValue(L.Get(-1))
+	assert.Equal(t, []interface{}{"user:1", "user:2"}, res)
+
+	names, err := store.Keys("")
+	assert.NoError(t, err)
+	assert.Equal(t, []string{"session:1", "user", "user:1", "user:2"}, names)
+}
+
+func TestStorePairs(t *testing.T) {
+	L, _, store := setupEvalContext()
+	defer store.Close()
+	defer L.Close()
+
+	count := scanPageSize*2 + 1
+	for i := 0; i < count; i++ {
+		assert.NoError(t, store.Put(fmt.Sprintf("item:%04d", i), int64(i)))
+	}
+	assert.NoError(t, store.Put("other", int64(1)))
+
+	err := L.DoString(`
+  local m = require('@lmb')
+  local count, sum, last = 0, 0, ''
+  for name, value in m.store:pairs('item:') do
+    assert(name > last, 'expect names in order')
+    count = count + 1
+    sum = sum + value
+    last = name
+  end
+  return { count = count, sum = sum }
+  `)
+	assert.NoError(t, err)
+
+	res := lua_convert.FromLuaValue(L.Get(-1))
+	assert.Equal(t, map[string]interface{}{
+		"count": int64(count),
+		"sum":   int64(count * (count - 1) / 2),
+	}, res)
+
+	entries, err := store.Scan("item:", "item:0199", 10)
+	assert.NoError(t, err)
+	assert.Len(t, entries, 1)
+	assert.Equal(t, "item:0200", entries[0].Name)
+	assert.Equal(t, int64(200), entries[0].Value)
+}
+
+func TestStoreUpdateDelete(t *testing.T) {
+	L, _, store := setupEvalContext()
+	defer store.Close()
+	defer L.Close()
+
+	err := L.DoString(`
+  local m = require('@lmb')
+  m.store['a'] = 1
+  m.store['b'] = 2
+  return m.store:update(function(tx)
+    tx:delete('a')
+    assert(not tx:has('a'))
+    return tx:keys()
+  end)
+  `)
+	assert.NoError(t, err)
+
+	res := lua_convert.FromLuaValue(L.Get(-1))
+	assert.Equal(t, []interface{}{"b"}, res)
+
+	found, err := store.Has("a")
+	assert.NoError(t, err)
+	assert.False(t, found)
+}
+
+func TestStoreSetWithTTL(t *testing.T) {
+	L, _, store := setupEvalContext()
+	defer store.Close()
+	defer L.Close()
+
+	err := L.DoString(`
+  local m = require('@lmb')
+  m.store:set('a', 1, { ttl = 0.05 })
+  m.store:set('b', 2)
+  assert(m.store['a'] == 1)
+  assert(m.store:has('a'))
+  local ok, err = pcall(function() m.store:set('c', 3, { ttl = 0 }) end)
+  assert(not ok and tostring(err):find('ttl must be positive'))
+  return true
+  `)
+	assert.NoError(t, err)
+
+	time.Sleep(100 * time.Millisecond)
+
+	err = L.DoString(`
+  local m = require('@lmb')
+  assert(not m.store:has('a'))
+  assert(not m.store['a'])
+  assert(m.store['b'] == 2)
+  return m.store:keys()
+  `)
+	assert.NoError(t, err)
+
+	res := lua_convert.FromLuaValue(L.Get(-1))
+	assert.Equal(t, []interface{}{"b"}, res)
+}
+
+func TestStoreLimits(t *testing.T) {
+	L := testutil.NewLuaTestState()
+	defer L.Close()
+
+	var state sync.Map
+	s, err := store.NewStore(":memory:", store.WithMaxValueSize(16))
+	assert.NoError(t, err)
+	defer s.Close()
+	L.PreloadModule("@lmb", NewLmbModule(&state, s).Loader)
+
+	err = L.DoString(`
+  local m = require('@lmb')
+  m.store['a'] = 'small'
+  local ok, err = pcall(function() m.store['b'] = string.rep('x', 32) end)
+  assert(not ok)
+  return tostring(err)
+  `)
+	assert.NoError(t, err)
+
+	res := lua_convert.FromLuaValue(L.Get(-1))
+	assert.Contains(t, res, "value too large: b is 34 bytes, the limit is 16 bytes")
+}
+
 func TestStoreUpdate(t *testing.T) {
 	L, _, store := setupEvalContext()
 	defer store.Close()
@@ -159,7 +348,7 @@ func TestStoreUpdateReturn(t *testing.T) {
 	assert.Equal(t, int64(1949), res)
 }
 
-func setupEvalContext() (*lua.LState, *sync.Map, *store.Store) {
+func setupEvalContext() (*lua.LState, *sync.Map, store.Store) {
 	L := testutil.NewLuaTestState()
 
 	var state sync.Map
@@ -173,3 +362,356 @@ func setupEvalContext() (*lua.LState, *sync.Map, *store.Store) {
 
 	return L, &state, store
 }
+
+func TestStoreIncr(t *testing.T) {
+	L, _, store := setupEvalContext()
+	defer store.Close()
+	defer L.Close()
+
+	err := L.DoString(`
+  local m = require('@lmb')
+  assert(m.store:incr('a') == 1)
+  assert(m.store:incr('a', 10) == 11)
+  assert(m.store:incr('a', -1) == 10)
+  m.store:update(function(s)
+    assert(s:incr('a') == 11)
+  end)
+  m.store['b'] = 'c'
+  assert(not pcall(function() m.store:incr('b') end))
+  assert(not pcall(function() m.store:incr('a', 1.5) end))
+  `)
+	assert.NoError(t, err)
+
+	value, err := store.Get("a")
+	assert.NoError(t, err)
+	assert.Equal(t, int64(11), value)
+}
+
+func TestStoreIncrConcurrency(t *testing.T) {
+	store, err := store.NewStore(":memory:")
+	assert.NoError(t, err)
+	defer store.Close()
+
+	chunk, err := parse.Parse(strings.NewReader(`require('@lmb').store:incr('counter')`), "compiled")
+	assert.NoError(t, err)
+	proto, err := lua.Compile(chunk, "compiled")
+	assert.NoError(t, err)
+
+	var wg sync.WaitGroup
+
+	count := 100
+	wg.Add(count)
+	for i := 0; i < count; i++ {
+		go func() {
+			var state sync.Map
+
+			defer wg.Done()
+
+			L := testutil.NewLuaTestState()
+			defer L.Close()
+
+			L.PreloadModule("@lmb", NewLmbModule(&state, store).Loader)
+
+			L.Push(L.NewFunctionFromProto(proto))
+			assert.NoError(t, L.PCall(0, lua.MultRet, nil))
+		}()
+	}
+
+	wg.Wait()
+
+	value, err := store.Get("counter")
+	assert.NoError(t, err)
+	assert.Equal(t, int64(count), value)
+}
+
+func TestStoreCas(t *testing.T) {
+	L, _, store := setupEvalContext()
+	defer store.Close()
+	defer L.Close()
+
+	err := L.DoString(`
+  local m = require('@lmb')
+  assert(m.store:cas('a', nil, 1))
+  assert(not m.store:cas('a', nil, 2))
+  assert(not m.store:cas('a', 2, 3))
+  assert(m.store:cas('a', 1, { b = 'c' }))
+  assert(m.store:cas('a', { b = 'c' }, 'd'))
+  assert(m.store['a'] == 'd')
+  assert(m.store:cas('a', 'd', nil))
+  assert(not m.store:has('a'))
+  `)
+	assert.NoError(t, err)
+}
+
+func TestStoreNamespace(t *testing.T) {
+	s, err := store.NewStore(":memory:")
+	assert.NoError(t, err)
+	defer s.Close()
+
+	var state sync.Map
+	L := testutil.NewLuaTestState()
+	defer L.Close()
+	L.PreloadModule("@lmb", NewLmbModule(&state, s.Namespace("script"), WithNamespaces("shared")).Loader)
+
+	err = L.DoString(`
+  local m = require('@lmb')
+  m.store['a'] = 1
+  local shared = m.store:namespace('shared')
+  assert(not shared['a'])
+  shared['a'] = 2
+  assert(shared:incr('b') == 1)
+  shared:update(function(tx)
+    tx['c'] = 3
+  end)
+  m.store:update(function(tx)
+    tx['d'] = 4
+    tx:namespace('shared')['d'] = 5
+  end)
+  assert(m.store['a'] == 1)
+  assert(not pcall(function() m.store:namespace('other') end))
+  `)
+	assert.NoError(t, err)
+
+	keys, err := s.Namespace("script").Keys("")
+	assert.NoError(t, err)
+	assert.Equal(t, []string{"a", "d"}, keys)
+	keys, err = s.Namespace("shared").Keys("")
+	assert.NoError(t, err)
+	assert.Equal(t, []string{"a", "b", "c", "d"}, keys)
+	keys, err = s.Keys("")
+	assert.NoError(t, err)
+	assert.Empty(t, keys)
+}
+
+func TestStoreNamespaceNotAllowed(t *testing.T) {
+	L, _, store := setupEvalContext()
+	defer store.Close()
+	defer L.Close()
+
+	err := L.DoString(`require('@lmb').store:namespace('other')`)
+	assert.ErrorContains(t, err, "namespace other is not allowed")
+}
+
+func TestStoreUpdateNested(t *testing.T) {
+	L, _, store := setupEvalContext()
+	defer store.Close()
+	defer L.Close()
+
+	err := L.DoString(`
+  local m = require('@lmb')
+  m.store:update(function(tx)
+    tx['a'] = 1
+    m.store:update(function(inner)
+      inner['b'] = 2
+    end)
+    local ok = pcall(function()
+      m.store:update(function(inner)
+        inner['a'] = 3
+        inner['c'] = 3
+        error('rollback')
+      end)
+    end)
+    assert(not ok)
+    assert(tx['a'] == 1 and tx['b'] == 2 and not tx['c'])
+  end)
+  `)
+	assert.NoError(t, err)
+
+	keys, err := store.Keys("")
+	assert.NoError(t, err)
+	assert.Equal(t, []string{"a", "b"}, keys)
+}
+
+func TestStoreUpdateDirectAccess(t *testing.T) {
+	L, _, store := setupEvalContext()
+	defer store.Close()
+	defer L.Close()
+
+	err := L.DoString(`
+  local m = require('@lmb')
+  m.store['a'] = 1
+  pcall(function()
+    m.store:update(function(tx)
+      -- m.store goes through the transaction instead of waiting for it
+      m.store['a'] = m.store['a'] + 1
+      assert(tx['a'] == 2)
+      assert(m.store:incr('b') == 1)
+      error('rollback')
+    end)
+  end)
+  assert(m.store['a'] == 1 and not m.store['b'])
+  `)
+	assert.NoError(t, err)
+}
+
+func TestStoreUpdateError(t *testing.T) {
+	L, _, store := setupEvalContext()
+	defer store.Close()
+	defer L.Close()
+
+	err := L.DoString(`
+  local m = require('@lmb')
+  local ok, err = pcall(function()
+    m.store:update(function(tx)
+      tx['a'] = 1
+      error({ code = 'conflict' })
+    end)
+  end)
+  assert(not ok)
+  assert(type(err) == 'table' and err.code == 'conflict')
+
+  ok, err = pcall(function()
+    m.store:update(function()
+      error('message', 0)
+    end)
+  end)
+  assert(not ok and err == 'message')
+  assert(not m.store['a'])
+  `)
+	assert.NoError(t, err)
+}
+
+func TestStoreUpdateResults(t *testing.T) {
+	L, _, store := setupEvalContext()
+	defer store.Close()
+	defer L.Close()
+
+	err := L.DoString(`
+  local m = require('@lmb')
+  assert(m.store:update(function() end) == nil)
+  local a, b = m.store:update(function() return 1, 2 end)
+  assert(a == 1 and b == 2)
+  assert(select('#', m.store:update(function() return 1, 2 end)) == 2)
+  `)
+	assert.NoError(t, err)
+}
+
+func TestStoreHistory(t *testing.T) {
+	s, err := store.NewStore(":memory:", store.WithHistory(0))
+	assert.NoError(t, err)
+	defer s.Close()
+
+	var state sync.Map
+	L := testutil.NewLuaTestState()
+	defer L.Close()
+	L.PreloadModule("@lmb", NewLmbModule(&state, s.Script("a.lua")).Loader)
+
+	err = L.DoString(`
+  local m = require('@lmb')
+  m.store.a = 1
+  m.store.a = { b = 'c' }
+  m.store.a = nil
+  local changes = m.store:history('a')
+  assert(#changes == 3)
+  assert(changes[1].value == nil and changes[1].previous.b == 'c')
+  assert(changes[2].value.b == 'c' and changes[2].previous == 1)
+  assert(changes[3].value == 1 and changes[3].previous == nil)
+  assert(changes[3].script == 'a.lua')
+  assert(changes[3].changed_at)
+  assert(#m.store:history('a', 1) == 1)
+  assert(not pcall(function() m.store:history('a', 0) end))
+  assert(m.store:get_at('a', os.time()) == nil)
+  assert(m.store:get_at('a', os.time() - 60) == nil)
+  assert(m.store:get_at('a', '2000-01-01T00:00:00Z') == nil)
+  assert(not pcall(function() m.store:get_at('a', 'yesterday') end))
+  `)
+	assert.NoError(t, err)
+}
+
+func TestStoreWatch(t *testing.T) {
+	L, _, s := setupEvalContext()
+	defer s.Close()
+	defer L.Close()
+
+	done := make(chan struct{})
+	defer close(done)
+	go func() {
+		for {
+			select {
+			case <-done:
+				return
+			case <-time.After(10 * time.Millisecond):
+				s.Put("b", int64(1))
+				s.Put("a", int64(1))
+			}
+		}
+	}()
+
+	err := L.DoString(`
+  local m = require('@lmb')
+  assert(m.store:watch('a', 1) == 'a')
+  assert(m.store:watch('c', 0.05) == nil)
+  assert(not pcall(function() m.store:watch('a', -1) end))
+  m.store:update(function()
+    local ok, err = pcall(function() m.store:watch('a', 1) end)
+    assert(not ok and string.find(err, 'cannot watch'))
+  end)
+  `)
+	assert.NoError(t, err)
+}
+
+func TestStoreWatcher(t *testing.T) {
+	s, err := store.NewStore(":memory:")
+	assert.NoError(t, err)
+	defer s.Close()
+
+	var state sync.Map
+	L := testutil.NewLuaTestState()
+	defer L.Close()
+	m := NewLmbModule(&state, s)
+	L.PreloadModule("@lmb", m.Loader)
+
+	err = L.DoString(`
+  local m = require('@lmb')
+  m.store.a = 1
+  local w = m.store:watcher('a')
+  -- changes before the watcher started are not seen
+  assert(w:wait(0.05) == nil)
+  -- changes between starting the watcher and waiting are not missed
+  m.store.a = 2
+  assert(w:wait(1) == 'a')
+  assert(w:wait(0.05) == nil)
+  assert(not pcall(function() w:wait(-1) end))
+  m.store:update(function()
+    local ok, err = pcall(function() w:wait(1) end)
+    assert(not ok and string.find(err, 'cannot watch'))
+  end)
+  w:close()
+  m.store.a = 3
+  assert(w:wait(1) == nil)
+  watcher = m.store:watcher('a')
+  `)
+	assert.NoError(t, err)
+
+	// watchers stop when the evaluation ends
+	m.Reset(&state, s, nil)
+	start := time.Now()
+	err = L.DoString(`assert(watcher:wait() == nil)`)
+	assert.NoError(t, err)
+	assert.Less(t, time.Since(start), time.Second)
+}
+
+func TestStoreWatchContext(t *testing.T) {
+	s, err := store.NewStore(":memory:")
+	assert.NoError(t, err)
+	defer s.Close()
+
+	watchCtx, stop := context.WithCancel(context.Background())
+	var state sync.Map
+	L := testutil.NewLuaTestState()
+	defer L.Close()
+	L.PreloadModule("@lmb", NewLmbModule(&state, s, WithWatchContext(watchCtx)).Loader)
+
+	// the evaluation is cancelled
+	ctx, cancel := context.WithTimeout(context.Background(), 50*time.Millisecond)
+	defer cancel()
+	L.SetContext(ctx)
+	err = L.DoString(`require('@lmb').store:watch('a')`)
+	assert.ErrorContains(t, err, "context deadline exceeded")
+	L.RemoveContext()
+
+	// watches end as if nothing changed
+	time.AfterFunc(50*time.Millisecond, stop)
+	err = L.DoString(`assert(require('@lmb').store:watch('a') == nil)`)
+	assert.NoError(t, err)
+}
@@ -0,0 +1,306 @@
+package http_policy
+
+import (
+	"context"
+	"fmt"
+	"net"
+	"net/http"
+	"strings"
+)
+
+// blockedNetworks are refused unless they are explicitly allowed, so scripts
+// cannot reach the host itself or cloud metadata services by default.
+var blockedNetworks = mustParseCIDRs(
+	"0.0.0.0/8",          // "this" network
+	"127.0.0.0/8",        // loopback
+	"169.254.0.0/16",     // link-local, including 169.254.169.254
+	"100.100.100.200/32", // Alibaba Cloud metadata
+	"::/128",             // unspecified
+	"::1/128",            // loopback
+	"fe80::/10",          // link-local
+	"fd00:ec2::254/128",  // AWS metadata over IPv6
+)
+
+// DeniedError is returned when a request is refused by the policy.
+type DeniedError struct {
+	Host   string
+	Reason string
+}
+
+func (e *DeniedError) Error() string {
+	return fmt.Sprintf("request to %s refused: %s", e.Host, e.Reason)
+}
+
+type pattern struct {
+	raw     string
+	host    string
+	network *net.IPNet
+}
+
+func (p *pattern) match(host string, ip net.IP) bool {
+	if p.network != nil {
+		return ip != nil && p.network.Contains(ip)
+	}
+	if strings.HasPrefix(p.host, "*.") {
+		return strings.HasSuffix(host, p.host[1:])
+	}
+	return host == p.host
+}
+
+// Policy decides which hosts scripts can connect to. Patterns are host names,
+// wildcard host names like "*.example.com", IP addresses, or CIDRs.
+//
+// A host is refused when it matches a deny pattern. Otherwise it is accepted
+// when it matches an allow pattern. Otherwise it is refused when it resolves to
+// a blocked network, or when the allow list is not empty.
+type Policy struct {
+	allow []pattern
+	deny  []pattern
+}
+
+func NewPolicy(allow, deny []string) (*Policy, error) {
+	allowPatterns, err := parsePatterns(allow)
+	if err != nil {
+		return nil, err
+	}
+	denyPatterns, err := parsePatterns(deny)
+	if err != nil {
+		return nil, err
+	}
+	return &Policy{allowPatterns, denyPatterns}, nil
+}
+
+func parsePatterns(raws []string) ([]pattern, error) {
+	patterns := make([]pattern, 0, len(raws))
+	for _, raw := range raws {
+		p := pattern{raw: raw}
+		switch {
+		case strings.Contains(raw, "/"):
+			_, network, err := net.ParseCIDR(raw)
+			if err != nil {
+				return nil, fmt.Errorf("invalid CIDR %q: %w", raw, err)
+			}
+			p.network = network
+		case net.ParseIP(raw) != nil:
+			ip := normalizeIP(net.ParseIP(raw))
+			p.network = &net.IPNet{IP: ip, Mask: net.CIDRMask(len(ip)*8, len(ip)*8)}
+		default:
+			host := normalizeHost(raw)
+			if host == "" || host == "*." {
+				return nil, fmt.Errorf("invalid host pattern %q", raw)
+			}
+			p.host = host
+		}
+		patterns = append(patterns, p)
+	}
+	return patterns, nil
+}
+
+// Check decides whether host can be connected to through the given addresses.
+func (p *Policy) Check(host string, ips []net.IP) error {
+	host = normalizeHost(host)
+	normalized := make([]net.IP, 0, len(ips))
+	for _, ip := range ips {
+		normalized = append(normalized, normalizeIP(ip))
+	}
+	ips = normalized
+
+	if raw, ok := matchAny(p.deny, host, ips, false); ok {
+		return &DeniedError{host, fmt.Sprintf("denied by %q", raw)}
+	}
+	if _, ok := matchAny(p.allow, host, ips, true); ok {
+		return nil
+	}
+	for _, ip := range ips {
+		for _, network := range blockedNetworks {
+			if network.Contains(ip) {
+				return &DeniedError{host, fmt.Sprintf("address %s is in blocked network %s", ip, network)}
+			}
+		}
+	}
+	if len(p.allow) > 0 {
+		return &DeniedError{host, "not in allow list"}
+	}
+	return nil
+}
+
+// matchAny reports the first pattern matching the host name or the addresses.
+// When every is true, all addresses must match a network pattern.
+func matchAny(patterns []pattern, host string, ips []net.IP, every bool) (string, bool) {
+	for _, p := range patterns {
+		if p.network == nil && p.match(host, nil) {
+			return p.raw, true
+		}
+	}
+	if len(ips) == 0 {
+		return "", false
+	}
+	matched := 0
+	var raw string
+	for _, ip := range ips {
+		for _, p := range patterns {
+			if p.network != nil && p.match(host, ip) {
+				if !every {
+					return p.raw, true
+				}
+				raw = p.raw
+				matched++
+				break
+			}
+		}
+	}
+	return raw, every && matched == len(ips)
+}
+
+func (p *Policy) lookup(ctx context.Context, host string) ([]net.IP, error) {
+	if ip := net.ParseIP(host); ip != nil {
+		return []net.IP{ip}, nil
+	}
+	addrs, err := net.DefaultResolver.LookupIPAddr(ctx, host)
+	if err != nil {
+		return nil, err
+	}
+	ips := make([]net.IP, 0, len(addrs))
+	for _, addr := range addrs {
+		ips = append(ips, addr.IP)
+	}
+	return ips, nil
+}
+
+// DialContext resolves the address, checks every resolved address, and only
+// then connects, so a host name cannot be rebound to a refused address between
+// the check and the connection.
+func (p *Policy) DialContext(ctx context.Context, network, address string) (net.Conn, error) {
+	host, port, err := net.SplitHostPort(address)
+	if err != nil {
+		return nil, err
+	}
+	ips, err := p.lookup(ctx, host)
+	if err != nil {
+		return nil, err
+	}
+	if err := p.Check(host, ips); err != nil {
+		return nil, err
+	}
+
+	var dialer net.Dialer
+	var lastErr error
+	for _, ip := range ips {
+		conn, err := dialer.DialContext(ctx, network, net.JoinHostPort(ip.String(), port))
+		if err == nil {
+			return conn, nil
+		}
+		lastErr = err
+	}
+	return nil, lastErr
+}
+
+type roundTripper struct {
+	policy *Policy
+	base   http.RoundTripper
+	// resolve checks the addresses of host names before requests are sent, for
+	// base transports which do not connect through DialContext.
+	resolve bool
+}
+
+func (t *roundTripper) RoundTrip(req *http.Request) (*http.Response, error) {
+	host := req.URL.Hostname()
+	if err := t.policy.checkURLHost(host); err != nil {
+		return nil, err
+	}
+	if t.resolve && net.ParseIP(host) == nil && !t.policy.decidedByName(host) {
+		ips, err := t.policy.lookup(req.Context(), host)
+		if err != nil {
+			return nil, err
+		}
+		if err := t.policy.Check(host, ips); err != nil {
+			return nil, err
+		}
+	}
+	return t.base.RoundTrip(req)
+}
+
+// decidedByName reports whether a host name pattern decides the host, so that
+// its addresses do not matter.
+func (p *Policy) decidedByName(host string) bool {
+	host = normalizeHost(host)
+	if _, ok := matchAny(p.deny, host, nil, false); ok {
+		return true
+	}
+	_, ok := matchAny(p.allow, host, nil, true)
+	return ok
+}
+
+// checkURLHost checks the host of a request URL without resolving it. Host names
+// that can only be decided by their addresses are left to DialContext.
+func (p *Policy) checkURLHost(host string) error {
+	if ip := net.ParseIP(host); ip != nil {
+		return p.Check(host, []net.IP{ip})
+	}
+	err := p.Check(host, nil)
+	if err != nil && hasNetworkPattern(p.allow) {
+		if _, denied := matchAny(p.deny, normalizeHost(host), nil, false); !denied {
+			return nil
+		}
+	}
+	return err
+}
+
+func hasNetworkPattern(patterns []pattern) bool {
+	for _, p := range patterns {
+		if p.network != nil {
+			return true
+		}
+	}
+	return false
+}
+
+// Transport checks every request, including redirects, before it is sent.
+// When base is nil or an *http.Transport, it is cloned to connect through
+// DialContext, and its proxy is removed because connecting through a proxy
+// would hide the target from DialContext. Other transports connect on their
+// own, so host names are resolved and checked before requests are sent, which
+// does not protect against a host name being rebound to another address in
+// between.
+func (p *Policy) Transport(base http.RoundTripper) http.RoundTripper {
+	if base == nil {
+		base = http.DefaultTransport
+	}
+	if transport, ok := base.(*http.Transport); ok {
+		transport = transport.Clone()
+		transport.DialContext = p.DialContext
+		transport.Proxy = nil
+		return &roundTripper{policy: p, base: transport}
+	}
+	return &roundTripper{policy: p, base: base, resolve: true}
+}
+
+// Client returns a copy of the client whose requests are checked by the policy.
+func (p *Policy) Client(client *http.Client) *http.Client {
+	c := *client
+	c.Transport = p.Transport(client.Transport)
+	return &c
+}
+
+func normalizeHost(host string) string {
+	return strings.TrimSuffix(strings.ToLower(strings.TrimSpace(host)), ".")
+}
+
+func normalizeIP(ip net.IP) net.IP {
+	if v4 := ip.To4(); v4 != nil {
+		return v4
+	}
+	return ip
+}
+
+func mustParseCIDRs(cidrs ...string) []*net.IPNet {
+	networks := make([]*net.IPNet, 0, len(cidrs))
+	for _, cidr := range cidrs {
+		_, network, err := net.ParseCIDR(cidr)
+		if err != nil {
+			panic(err)
+		}
+		networks = append(networks, network)
+	}
+	return networks
+}
@@ -0,0 +1,142 @@
+package http_policy
+
+import (
+	"context"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestCheck(t *testing.T) {
+	testCases := []struct {
+		name    string
+		allow   []string
+		deny    []string
+		host    string
+		ips     []string
+		allowed bool
+	}{
+		{"public", nil, nil, "example.com", []string{"93.184.215.14"}, true},
+		{"loopback", nil, nil, "localhost", []string{"127.0.0.1"}, false},
+		{"loopback ipv6", nil, nil, "localhost", []string{"::1"}, false},
+		{"mapped loopback", nil, nil, "localhost", []string{"::ffff:127.0.0.1"}, false},
+		{"metadata", nil, nil, "metadata.google.internal", []string{"169.254.169.254"}, false},
+		{"allowed loopback", []string{"127.0.0.1"}, nil, "localhost", []string{"127.0.0.1"}, true},
+		{"allowed host", []string{"localhost"}, nil, "localhost", []string{"127.0.0.1"}, true},
+		{"allowed cidr", []string{"127.0.0.0/8"}, nil, "localhost", []string{"127.0.0.1"}, true},
+		{"allowed wildcard", []string{"*.example.com"}, nil, "api.example.com", []string{"93.184.215.14"}, true},
+		{"wildcard excludes apex", []string{"*.example.com"}, nil, "example.com", []string{"93.184.215.14"}, false},
+		{"not allowed", []string{"example.com"}, nil, "example.org", []string{"93.184.215.14"}, false},
+		{"denied host", nil, []string{"example.com"}, "EXAMPLE.com.", []string{"93.184.215.14"}, false},
+		{"denied cidr", nil, []string{"93.184.0.0/16"}, "example.com", []string{"93.184.215.14"}, false},
+		{"deny wins", []string{"example.com"}, []string{"example.com"}, "example.com", []string{"93.184.215.14"}, false},
+		{"partially allowed", []string{"10.0.0.0/8"}, nil, "internal", []string{"10.0.0.1", "127.0.0.1"}, false},
+	}
+	for _, tc := range testCases {
+		t.Run(tc.name, func(t *testing.T) {
+			p, err := NewPolicy(tc.allow, tc.deny)
+			assert.NoError(t, err)
+
+			ips := make([]net.IP, 0, len(tc.ips))
+			for _, ip := range tc.ips {
+				ips = append(ips, net.ParseIP(ip))
+			}
+			err = p.Check(tc.host, ips)
+			if tc.allowed {
+				assert.NoError(t, err)
+			} else {
+				var denied *DeniedError
+				assert.ErrorAs(t, err, &denied)
+			}
+		})
+	}
+}
+
+func TestNewPolicy(t *testing.T) {
+	_, err := NewPolicy([]string{"10.0.0.0/33"}, nil)
+	assert.ErrorContains(t, err, "invalid CIDR")
+	_, err = NewPolicy(nil, []string{""})
+	assert.ErrorContains(t, err, "invalid host pattern")
+}
+
+func TestClient(t *testing.T) {
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {}))
+	defer server.Close()
+
+	p, err := NewPolicy(nil, nil)
+	assert.NoError(t, err)
+	_, err = p.Client(http.DefaultClient).Get(server.URL)
+	assert.ErrorContains(t, err, "request to 127.0.0.1 refused: address 127.0.0.1 is in blocked network 127.0.0.0/8")
+
+	p, err = NewPolicy([]string{"127.0.0.1"}, nil)
+	assert.NoError(t, err)
+	res, err := p.Client(http.DefaultClient).Get(server.URL)
+	assert.NoError(t, err)
+	res.Body.Close()
+}
+
+type fakeTransport struct{}
+
+func (fakeTransport) RoundTrip(req *http.Request) (*http.Response, error) {
+	return &http.Response{StatusCode: http.StatusOK, Body: http.NoBody, Request: req}, nil
+}
+
+func TestTransport(t *testing.T) {
+	p, err := NewPolicy(nil, nil)
+	assert.NoError(t, err)
+
+	// proxies would connect to the target instead of DialContext
+	proxied := http.DefaultTransport.(*http.Transport).Clone()
+	proxied.Proxy = http.ProxyFromEnvironment
+	transport := p.Transport(proxied).(*roundTripper).base.(*http.Transport)
+	assert.Nil(t, transport.Proxy)
+	assert.NotNil(t, transport.DialContext)
+
+	// other transports check the addresses of host names before requests
+	client := p.Client(&http.Client{Transport: fakeTransport{}})
+	_, err = client.Get("http://localhost/")
+	assert.ErrorContains(t, err, "refused")
+	_, err = client.Get("http://127.0.0.1/")
+	assert.ErrorContains(t, err, "refused")
+
+	p, err = NewPolicy([]string{"example.invalid"}, nil)
+	assert.NoError(t, err)
+	client = p.Client(&http.Client{Transport: fakeTransport{}})
+	res, err := client.Get("http://example.invalid/")
+	assert.NoError(t, err)
+	res.Body.Close()
+}
+
+func TestDialContext(t *testing.T) {
+	listener, err := net.Listen("tcp", "127.0.0.1:0")
+	assert.NoError(t, err)
+	defer listener.Close()
+
+	p, err := NewPolicy(nil, nil)
+	assert.NoError(t, err)
+	_, err = p.DialContext(context.Background(), "tcp", listener.Addr().String())
+	assert.ErrorContains(t, err, "refused")
+
+	p, err = NewPolicy([]string{"127.0.0.0/8"}, nil)
+	assert.NoError(t, err)
+	conn, err := p.DialContext(context.Background(), "tcp", listener.Addr().String())
+	assert.NoError(t, err)
+	conn.Close()
+}
+
+func TestCheckURLHost(t *testing.T) {
+	p, err := NewPolicy([]string{"10.0.0.0/8"}, []string{"evil.example.com"})
+	assert.NoError(t, err)
+	assert.NoError(t, p.checkURLHost("internal.example.com")) // decided by its addresses when dialing
+	assert.Error(t, p.checkURLHost("evil.example.com"))
+	assert.Error(t, p.checkURLHost("192.168.0.1"))
+	assert.NoError(t, p.checkURLHost("10.0.0.1"))
+
+	p, err = NewPolicy([]string{"example.com"}, nil)
+	assert.NoError(t, err)
+	assert.NoError(t, p.checkURLHost("example.com"))
+	assert.Error(t, p.checkURLHost("example.org"))
+}
@@ -0,0 +1,762 @@
+package store
+
+import (
+	"math"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+)
+
+// backends are tested against the same expectations, so they are interchangeable.
+var backends = map[string]func(options ...Option) (Store, error){
+	"memory": func(options ...Option) (Store, error) {
+		return Open("memory://", options...)
+	},
+	"sqlite": func(options ...Option) (Store, error) {
+		return Open("sqlite://:memory:", options...)
+	},
+}
+
+func forEachBackend(t *testing.T, f func(t *testing.T, s Store), options ...Option) {
+	for name, open := range backends {
+		t.Run(name, func(t *testing.T) {
+			s, err := open(options...)
+			assert.NoError(t, err)
+			defer s.Close()
+			f(t, s)
+		})
+	}
+}
+
+func TestOpen(t *testing.T) {
+	_, err := Open("db.sqlite3")
+	assert.ErrorContains(t, err, "invalid store URL")
+	_, err = Open("redis://localhost")
+	assert.ErrorContains(t, err, "unsupported store URL")
+}
+
+func TestConformanceGetPut(t *testing.T) {
+	forEachBackend(t, func(t *testing.T, s Store) {
+		value, err := s.Get("a")
+		assert.NoError(t, err)
+		assert.Nil(t, value)
+
+		values := map[string]interface{}{
+			"bool":   true,
+			"int":    int64(1),
+			"float":  1.5,
+			"string": "hello",
+			"list":   []interface{}{int64(1), "a"},
+			"table":  map[string]interface{}{"a": int64(1)},
+		}
+		for name, value := range values {
+			assert.NoError(t, s.Put(name, value))
+		}
+		for name, expected := range values {
+			value, err := s.Get(name)
+			assert.NoError(t, err)
+			assert.Equal(t, expected, value, name)
+		}
+		assert.Error(t, s.Put("nil", nil))
+
+		has, err := s.Has("int")
+		assert.NoError(t, err)
+		assert.True(t, has)
+		assert.NoError(t, s.Delete("int"))
+		has, err = s.Has("int")
+		assert.NoError(t, err)
+		assert.False(t, has)
+	})
+}
+
+func TestConformanceKeysScan(t *testing.T) {
+	forEachBackend(t, func(t *testing.T, s Store) {
+		keys, err := s.Keys("")
+		assert.NoError(t, err)
+		assert.Equal(t, []string{}, keys)
+
+		for _, name := range []string{"b:2", "a:1", "b:1", "c"} {
+			assert.NoError(t, s.Put(name, name))
+		}
+		keys, err = s.Keys("b:")
+		assert.NoError(t, err)
+		assert.Equal(t, []string{"b:1", "b:2"}, keys)
+
+		entries, err := s.Scan("", "", 2)
+		assert.NoError(t, err)
+		assert.Equal(t, []Entry{{Name: "a:1", Value: "a:1"}, {Name: "b:1", Value: "b:1"}}, entries)
+		entries, err = s.Scan("", "b:1", 2)
+		assert.NoError(t, err)
+		assert.Equal(t, []Entry{{Name: "b:2", Value: "b:2"}, {Name: "c", Value: "c"}}, entries)
+	})
+}
+
+func TestConformanceEmptyName(t *testing.T) {
+	forEachBackend(t, func(t *testing.T, s Store) {
+		check := func(a Accessor) {
+			assert.ErrorIs(t, a.Put("", int64(1)), ErrEmptyName)
+			assert.ErrorIs(t, a.PutWithTTL("", int64(1), time.Minute), ErrEmptyName)
+			_, err := a.Incr("", 1)
+			assert.ErrorIs(t, err, ErrEmptyName)
+			_, err = a.CompareAndSwap("", nil, int64(1))
+			assert.ErrorIs(t, err, ErrEmptyName)
+			// deleting is harmless
+			assert.NoError(t, a.Delete(""))
+			swapped, err := a.CompareAndSwap("", nil, nil)
+			assert.NoError(t, err)
+			assert.True(t, swapped)
+		}
+		check(s)
+		tx, err := s.Begin()
+		assert.NoError(t, err)
+		check(tx)
+		assert.NoError(t, tx.Commit())
+
+		keys, err := s.Keys("")
+		assert.NoError(t, err)
+		assert.Equal(t, []string{}, keys)
+	})
+}
+
+func TestConformanceTTL(t *testing.T) {
+	forEachBackend(t, func(t *testing.T, s Store) {
+		assert.ErrorIs(t, s.PutWithTTL("a", int64(1), 0), ErrInvalidTTL)
+		assert.NoError(t, s.PutWithTTL("a", int64(1), 50*time.Millisecond))
+		assert.NoError(t, s.PutWithTTL("b", int64(2), time.Hour))
+
+		entries, err := s.Scan("", "", 10)
+		assert.NoError(t, err)
+		assert.Len(t, entries, 2)
+		assert.False(t, entries[1].ExpiresAt.IsZero())
+
+		time.Sleep(100 * time.Millisecond)
+
+		value, err := s.Get("a")
+		assert.NoError(t, err)
+		assert.Nil(t, value)
+		has, err := s.Has("a")
+		assert.NoError(t, err)
+		assert.False(t, has)
+		keys, err := s.Keys("")
+		assert.NoError(t, err)
+		assert.Equal(t, []string{"b"}, keys)
+
+		_, err = s.DeleteExpired()
+		assert.NoError(t, err)
+		keys, err = s.Keys("")
+		assert.NoError(t, err)
+		assert.Equal(t, []string{"b"}, keys)
+	})
+}
+
+func TestConformanceTx(t *testing.T) {
+	forEachBackend(t, func(t *testing.T, s Store) {
+		assert.NoError(t, s.Put("a", int64(1)))
+
+		tx, err := s.Begin()
+		assert.NoError(t, err)
+		assert.NoError(t, tx.Put("b", int64(2)))
+		assert.NoError(t, tx.Delete("a"))
+		has, err := tx.Has("a")
+		assert.NoError(t, err)
+		assert.False(t, has)
+		keys, err := tx.Keys("")
+		assert.NoError(t, err)
+		assert.Equal(t, []string{"b"}, keys)
+		assert.NoError(t, tx.Rollback())
+		assert.ErrorIs(t, tx.Commit(), ErrTxDone)
+
+		keys, err = s.Keys("")
+		assert.NoError(t, err)
+		assert.Equal(t, []string{"a"}, keys)
+
+		tx, err = s.Begin()
+		assert.NoError(t, err)
+		assert.NoError(t, tx.Put("b", int64(2)))
+		assert.NoError(t, tx.Delete("a"))
+		assert.NoError(t, tx.Commit())
+
+		keys, err = s.Keys("")
+		assert.NoError(t, err)
+		assert.Equal(t, []string{"b"}, keys)
+	})
+}
+
+func TestConformanceTxConcurrency(t *testing.T) {
+	forEachBackend(t, func(t *testing.T, s Store) {
+		var wg sync.WaitGroup
+		for range 10 {
+			wg.Add(1)
+			go func() {
+				defer wg.Done()
+				tx, err := s.Begin()
+				if !assert.NoError(t, err) {
+					return
+				}
+				defer tx.Rollback()
+				value, err := tx.Get("counter")
+				assert.NoError(t, err)
+				n, _ := value.(int64)
+				assert.NoError(t, tx.Put("counter", n+1))
+				assert.NoError(t, tx.Commit())
+			}()
+		}
+		wg.Wait()
+
+		value, err := s.Get("counter")
+		assert.NoError(t, err)
+		assert.Equal(t, int64(10), value)
+	})
+}
+
+func TestConformanceLimits(t *testing.T) {
+	forEachBackend(t, func(t *testing.T, s Store) {
+		assert.ErrorIs(t, s.Put("a", "0123456789"), ErrValueTooLarge)
+		assert.NoError(t, s.Put("a", "0123"))
+		assert.NoError(t, s.Put("b", "0123"))
+		// overwriting a value only counts its new size
+		assert.NoError(t, s.Put("b", "01234"))
+		assert.ErrorIs(t, s.Put("c", "0123"), ErrQuotaExceeded)
+
+		tx, err := s.Begin()
+		assert.NoError(t, err)
+		defer tx.Rollback()
+		assert.ErrorIs(t, tx.Put("c", "0123"), ErrQuotaExceeded)
+		assert.NoError(t, tx.Delete("a"))
+		assert.NoError(t, tx.Put("c", "0123"))
+		assert.NoError(t, tx.Commit())
+	}, WithMaxValueSize(8), WithMaxTotalSize(16))
+}
+
+func TestConformanceIncr(t *testing.T) {
+	forEachBackend(t, func(t *testing.T, s Store) {
+		n, err := s.Incr("counter", 1)
+		assert.NoError(t, err)
+		assert.Equal(t, int64(1), n)
+		n, err = s.Incr("counter", 41)
+		assert.NoError(t, err)
+		assert.Equal(t, int64(42), n)
+		n, err = s.Incr("counter", -50)
+		assert.NoError(t, err)
+		assert.Equal(t, int64(-8), n)
+		value, err := s.Get("counter")
+		assert.NoError(t, err)
+		assert.Equal(t, int64(-8), value)
+
+		assert.NoError(t, s.Put("string", "a"))
+		_, err = s.Incr("string", 1)
+		assert.ErrorIs(t, err, ErrNotInteger)
+		// whole numbers are not integers either
+		assert.NoError(t, s.Put("float", 1.0))
+		_, err = s.Incr("float", 1)
+		assert.ErrorIs(t, err, ErrNotInteger)
+
+		// the TTL of a live value is kept, while an expired value starts over
+		assert.NoError(t, s.PutWithTTL("ttl", int64(1), 50*time.Millisecond))
+		n, err = s.Incr("ttl", 1)
+		assert.NoError(t, err)
+		assert.Equal(t, int64(2), n)
+		time.Sleep(100 * time.Millisecond)
+		n, err = s.Incr("ttl", 1)
+		assert.NoError(t, err)
+		assert.Equal(t, int64(1), n)
+		entries, err := s.Scan("ttl", "", 1)
+		assert.NoError(t, err)
+		assert.True(t, entries[0].ExpiresAt.IsZero())
+
+		// an expired value which is not an integer starts over as well
+		assert.NoError(t, s.PutWithTTL("expired", "hello", time.Millisecond))
+		time.Sleep(10 * time.Millisecond)
+		n, err = s.Incr("expired", 1)
+		assert.NoError(t, err)
+		assert.Equal(t, int64(1), n)
+		n, err = s.Incr("expired", 1)
+		assert.NoError(t, err)
+		assert.Equal(t, int64(2), n)
+
+		tx, err := s.Begin()
+		assert.NoError(t, err)
+		n, err = tx.Incr("counter", 10)
+		assert.NoError(t, err)
+		assert.Equal(t, int64(2), n)
+		assert.NoError(t, tx.Rollback())
+		value, err = s.Get("counter")
+		assert.NoError(t, err)
+		assert.Equal(t, int64(-8), value)
+	})
+}
+
+func TestConformanceIncrOverflow(t *testing.T) {
+	forEachBackend(t, func(t *testing.T, s Store) {
+		assert.NoError(t, s.Put("max", int64(math.MaxInt64)))
+		_, err := s.Incr("max", 1)
+		assert.ErrorIs(t, err, ErrOverflow)
+		value, err := s.Get("max")
+		assert.NoError(t, err)
+		assert.Equal(t, int64(math.MaxInt64), value)
+
+		assert.NoError(t, s.Put("min", int64(math.MinInt64)))
+		_, err = s.Incr("min", -1)
+		assert.ErrorIs(t, err, ErrOverflow)
+		n, err := s.Incr("min", math.MaxInt64)
+		assert.NoError(t, err)
+		assert.Equal(t, int64(-1), n)
+	})
+}
+
+func TestConformanceIncrConcurrency(t *testing.T) {
+	forEachBackend(t, func(t *testing.T, s Store) {
+		var wg sync.WaitGroup
+		for range 50 {
+			wg.Add(1)
+			go func() {
+				defer wg.Done()
+				_, err := s.Incr("counter", 1)
+				assert.NoError(t, err)
+			}()
+		}
+		wg.Wait()
+		value, err := s.Get("counter")
+		assert.NoError(t, err)
+		assert.Equal(t, int64(50), value)
+	})
+}
+
+func TestConformanceCompareAndSwap(t *testing.T) {
+	forEachBackend(t, func(t *testing.T, s Store) {
+		swapped, err := s.CompareAndSwap("a", nil, nil)
+		assert.NoError(t, err)
+		assert.True(t, swapped)
+
+		swapped, err = s.CompareAndSwap("a", nil, int64(1))
+		assert.NoError(t, err)
+		assert.True(t, swapped)
+		swapped, err = s.CompareAndSwap("a", nil, int64(2))
+		assert.NoError(t, err)
+		assert.False(t, swapped)
+
+		swapped, err = s.CompareAndSwap("a", int64(2), int64(3))
+		assert.NoError(t, err)
+		assert.False(t, swapped)
+		swapped, err = s.CompareAndSwap("a", int64(1), map[string]interface{}{"b": "c"})
+		assert.NoError(t, err)
+		assert.True(t, swapped)
+
+		swapped, err = s.CompareAndSwap("a", map[string]interface{}{"b": "c"}, nil)
+		assert.NoError(t, err)
+		assert.True(t, swapped)
+		has, err := s.Has("a")
+		assert.NoError(t, err)
+		assert.False(t, has)
+
+		// an expired value is missing
+		assert.NoError(t, s.PutWithTTL("b", int64(1), 50*time.Millisecond))
+		time.Sleep(100 * time.Millisecond)
+		swapped, err = s.CompareAndSwap("b", int64(1), int64(2))
+		assert.NoError(t, err)
+		assert.False(t, swapped)
+		swapped, err = s.CompareAndSwap("b", nil, int64(2))
+		assert.NoError(t, err)
+		assert.True(t, swapped)
+		value, err := s.Get("b")
+		assert.NoError(t, err)
+		assert.Equal(t, int64(2), value)
+	})
+}
+
+func TestConformanceNamespace(t *testing.T) {
+	forEachBackend(t, func(t *testing.T, s Store) {
+		a, b := s.Namespace("a"), s.Namespace("b")
+		assert.NoError(t, a.Put("counter", int64(1)))
+		assert.NoError(t, b.Put("counter", int64(2)))
+		assert.NoError(t, s.Put("counter", int64(3)))
+
+		for _, c := range []struct {
+			s        Store
+			expected int64
+		}{{a, 1}, {b, 2}, {s, 3}} {
+			value, err := c.s.Get("counter")
+			assert.NoError(t, err)
+			assert.Equal(t, c.expected, value)
+			n, err := c.s.Incr("counter", 10)
+			assert.NoError(t, err)
+			assert.Equal(t, c.expected+10, n)
+		}
+		value, err := s.Namespace(DefaultNamespace).Get("counter")
+		assert.NoError(t, err)
+		assert.Equal(t, int64(13), value)
+
+		assert.NoError(t, a.Put("only-a", "a"))
+		keys, err := b.Keys("")
+		assert.NoError(t, err)
+		assert.Equal(t, []string{"counter"}, keys)
+		entries, err := a.Scan("", "", 10)
+		assert.NoError(t, err)
+		assert.Len(t, entries, 2)
+		has, err := b.Has("only-a")
+		assert.NoError(t, err)
+		assert.False(t, has)
+
+		assert.NoError(t, b.Delete("counter"))
+		has, err = a.Has("counter")
+		assert.NoError(t, err)
+		assert.True(t, has)
+
+		namespaces, err := s.Namespaces()
+		assert.NoError(t, err)
+		assert.Equal(t, []string{"a", DefaultNamespace}, namespaces)
+	})
+}
+
+func TestConformanceNamespaceTx(t *testing.T) {
+	forEachBackend(t, func(t *testing.T, s Store) {
+		a := s.Namespace("a")
+		tx, err := a.Begin()
+		assert.NoError(t, err)
+		assert.NoError(t, tx.Put("name", "a"))
+		b := tx.Namespace("b")
+		assert.NoError(t, b.Put("name", "b"))
+		value, err := tx.Get("name")
+		assert.NoError(t, err)
+		assert.Equal(t, "a", value)
+		keys, err := b.Keys("")
+		assert.NoError(t, err)
+		assert.Equal(t, []string{"name"}, keys)
+		assert.NoError(t, tx.Commit())
+		assert.ErrorIs(t, b.Put("name", "c"), ErrTxDone)
+
+		value, err = s.Namespace("b").Get("name")
+		assert.NoError(t, err)
+		assert.Equal(t, "b", value)
+		has, err := s.Has("name")
+		assert.NoError(t, err)
+		assert.False(t, has)
+	})
+}
+
+func TestConformanceNamespaceTotalSize(t *testing.T) {
+	forEachBackend(t, func(t *testing.T, s Store) {
+		assert.NoError(t, s.Namespace("a").Put("a", "12345678"))
+		// the limit applies to every namespace together
+		assert.ErrorIs(t, s.Namespace("b").Put("a", "12345678"), ErrQuotaExceeded)
+		assert.NoError(t, s.Namespace("a").Put("a", "1234567890"))
+	}, WithMaxTotalSize(16))
+}
+
+func TestConformanceNestedTx(t *testing.T) {
+	forEachBackend(t, func(t *testing.T, s Store) {
+		tx, err := s.Begin()
+		assert.NoError(t, err)
+		defer tx.Rollback()
+		assert.NoError(t, tx.Put("a", int64(1)))
+
+		committed, err := tx.Begin()
+		assert.NoError(t, err)
+		assert.NoError(t, committed.Put("b", int64(2)))
+		value, err := committed.Get("a")
+		assert.NoError(t, err)
+		assert.Equal(t, int64(1), value)
+
+		rolledBack, err := committed.Begin()
+		assert.NoError(t, err)
+		assert.NoError(t, rolledBack.Put("a", int64(3)))
+		assert.NoError(t, rolledBack.Namespace("other").Put("c", int64(3)))
+		assert.NoError(t, rolledBack.Delete("b"))
+		assert.NoError(t, rolledBack.Rollback())
+		assert.ErrorIs(t, rolledBack.Put("a", int64(4)), ErrTxDone)
+		assert.ErrorIs(t, rolledBack.Commit(), ErrTxDone)
+
+		assert.NoError(t, committed.Commit())
+		assert.ErrorIs(t, committed.Rollback(), ErrTxDone)
+
+		keys, err := tx.Keys("")
+		assert.NoError(t, err)
+		assert.Equal(t, []string{"a", "b"}, keys)
+		value, err = tx.Get("a")
+		assert.NoError(t, err)
+		assert.Equal(t, int64(1), value)
+		has, err := tx.Namespace("other").Has("c")
+		assert.NoError(t, err)
+		assert.False(t, has)
+
+		// a nested transaction can begin again after another one finished
+		again, err := tx.Begin()
+		assert.NoError(t, err)
+		assert.NoError(t, again.Put("d", int64(4)))
+		assert.NoError(t, again.Commit())
+
+		assert.NoError(t, tx.Commit())
+		keys, err = s.Keys("")
+		assert.NoError(t, err)
+		assert.Equal(t, []string{"a", "b", "d"}, keys)
+	})
+}
+
+func TestConformanceNestedTxRollback(t *testing.T) {
+	forEachBackend(t, func(t *testing.T, s Store) {
+		tx, err := s.Begin()
+		assert.NoError(t, err)
+		nested, err := tx.Begin()
+		assert.NoError(t, err)
+		assert.NoError(t, nested.Put("a", int64(1)))
+		assert.NoError(t, nested.Commit())
+		// rolling back the enclosing transaction undoes committed nested ones
+		assert.NoError(t, tx.Rollback())
+
+		has, err := s.Has("a")
+		assert.NoError(t, err)
+		assert.False(t, has)
+	})
+}
+
+func TestConformanceHistory(t *testing.T) {
+	forEachBackend(t, func(t *testing.T, s Store) {
+		assert.NoError(t, s.Put("a", int64(1)))
+		changes, err := s.History("a", 10)
+		assert.NoError(t, err)
+		assert.Empty(t, changes)
+	})
+
+	forEachBackend(t, func(t *testing.T, s Store) {
+		assert.NoError(t, s.Script("a.lua").Put("a", int64(1)))
+		_, err := s.Incr("a", 1)
+		assert.NoError(t, err)
+		swapped, err := s.CompareAndSwap("a", int64(2), "b")
+		assert.NoError(t, err)
+		assert.True(t, swapped)
+		assert.NoError(t, s.Delete("a"))
+		// deleting a missing value changes nothing
+		assert.NoError(t, s.Delete("a"))
+		assert.NoError(t, s.Namespace("other").Put("a", int64(3)))
+
+		changes, err := s.History("a", 10)
+		assert.NoError(t, err)
+		assert.Len(t, changes, 4)
+		for i, expected := range [][2]interface{}{{nil, "b"}, {"b", int64(2)}, {int64(2), int64(1)}, {int64(1), nil}} {
+			assert.Equal(t, expected[0], changes[i].Value, i)
+			assert.Equal(t, expected[1], changes[i].Previous, i)
+		}
+		assert.Equal(t, "a.lua", changes[3].Script)
+		assert.Equal(t, "", changes[0].Script)
+		assert.False(t, changes[0].ChangedAt.Before(changes[3].ChangedAt))
+
+		changes, err = s.History("a", 1)
+		assert.NoError(t, err)
+		assert.Len(t, changes, 1)
+	}, WithHistory(0))
+}
+
+func TestConformanceHistoryTx(t *testing.T) {
+	forEachBackend(t, func(t *testing.T, s Store) {
+		tx, err := s.Begin()
+		assert.NoError(t, err)
+		assert.NoError(t, tx.Put("a", int64(1)))
+		nested, err := tx.Begin()
+		assert.NoError(t, err)
+		assert.NoError(t, nested.Put("a", int64(2)))
+		changes, err := nested.History("a", 10)
+		assert.NoError(t, err)
+		assert.Len(t, changes, 2)
+		assert.NoError(t, nested.Rollback())
+		assert.NoError(t, tx.Commit())
+
+		changes, err = s.History("a", 10)
+		assert.NoError(t, err)
+		assert.Len(t, changes, 1)
+		assert.Equal(t, int64(1), changes[0].Value)
+
+		tx, err = s.Begin()
+		assert.NoError(t, err)
+		assert.NoError(t, tx.Put("a", int64(3)))
+		assert.NoError(t, tx.Rollback())
+		changes, err = s.History("a", 10)
+		assert.NoError(t, err)
+		assert.Len(t, changes, 1)
+	}, WithHistory(0))
+}
+
+func TestConformanceGetAtExpired(t *testing.T) {
+	// expired values are removed by reading, by sweeping, and by overwriting
+	for name, remove := range map[string]func(s Store) error{
+		"kept": func(s Store) error { return nil },
+		"get": func(s Store) error {
+			_, err := s.Get("a")
+			return err
+		},
+		"sweep": func(s Store) error {
+			_, err := s.DeleteExpired()
+			return err
+		},
+		"put": func(s Store) error { return s.Put("a", "c") },
+	} {
+		t.Run(name, func(t *testing.T) {
+			forEachBackend(t, func(t *testing.T, s Store) {
+				assert.NoError(t, s.PutWithTTL("a", "b", 100*time.Millisecond))
+				at := time.Now()
+				time.Sleep(150 * time.Millisecond)
+				assert.NoError(t, remove(s))
+
+				value, err := s.GetAt("a", at)
+				assert.NoError(t, err)
+				assert.Equal(t, "b", value)
+				value, err = s.GetAt("a", at.Add(120*time.Millisecond))
+				assert.NoError(t, err)
+				assert.Nil(t, value)
+			}, WithHistory(0))
+		})
+	}
+
+	forEachBackend(t, func(t *testing.T, s Store) {
+		assert.NoError(t, s.PutWithTTL("a", "b", 50*time.Millisecond))
+		time.Sleep(100 * time.Millisecond)
+		_, err := s.DeleteExpired()
+		assert.NoError(t, err)
+
+		changes, err := s.History("a", 10)
+		assert.NoError(t, err)
+		assert.Len(t, changes, 2)
+		assert.Nil(t, changes[0].Value)
+		assert.Equal(t, "b", changes[0].Previous)
+		assert.Equal(t, "", changes[0].Script)
+	}, WithHistory(0))
+}
+
+func TestConformanceHistoryRetention(t *testing.T) {
+	forEachBackend(t, func(t *testing.T, s Store) {
+		assert.NoError(t, s.Put("a", int64(1)))
+		time.Sleep(100 * time.Millisecond)
+		assert.NoError(t, s.Put("a", int64(2)))
+
+		_, err := s.DeleteExpired()
+		assert.NoError(t, err)
+		changes, err := s.History("a", 10)
+		assert.NoError(t, err)
+		assert.Len(t, changes, 1)
+		assert.Equal(t, int64(2), changes[0].Value)
+	}, WithHistory(50*time.Millisecond))
+}
+
+func TestConformanceGetAt(t *testing.T) {
+	forEachBackend(t, func(t *testing.T, s Store) {
+		_, err := s.GetAt("a", time.Now())
+		assert.ErrorIs(t, err, ErrNoHistory)
+	})
+
+	forEachBackend(t, func(t *testing.T, s Store) {
+		before := time.Now()
+		time.Sleep(5 * time.Millisecond)
+		assert.NoError(t, s.Put("a", int64(1)))
+		time.Sleep(5 * time.Millisecond)
+		first := time.Now()
+		time.Sleep(5 * time.Millisecond)
+		assert.NoError(t, s.Put("a", "b"))
+		time.Sleep(5 * time.Millisecond)
+		second := time.Now()
+		time.Sleep(5 * time.Millisecond)
+		assert.NoError(t, s.Delete("a"))
+
+		for _, expected := range []struct {
+			at    time.Time
+			value interface{}
+		}{{before, nil}, {first, int64(1)}, {second, "b"}, {time.Now(), nil}} {
+			value, err := s.GetAt("a", expected.at)
+			assert.NoError(t, err)
+			assert.Equal(t, expected.value, value)
+		}
+
+		tx, err := s.Begin()
+		assert.NoError(t, err)
+		time.Sleep(5 * time.Millisecond)
+		third := time.Now()
+		time.Sleep(5 * time.Millisecond)
+		assert.NoError(t, tx.Put("a", int64(3)))
+		value, err := tx.GetAt("a", third)
+		assert.NoError(t, err)
+		assert.Nil(t, value)
+		value, err = tx.GetAt("a", time.Now())
+		assert.NoError(t, err)
+		assert.Equal(t, int64(3), value)
+		assert.NoError(t, tx.Rollback())
+		_, err = tx.GetAt("a", third)
+		assert.ErrorIs(t, err, ErrTxDone)
+	}, WithHistory(0))
+
+	forEachBackend(t, func(t *testing.T, s Store) {
+		_, err := s.GetAt("a", time.Now().Add(-time.Hour))
+		assert.ErrorIs(t, err, ErrNoHistory)
+	}, WithHistory(time.Minute))
+}
+
+// receive returns the next name from the channel, or an empty string when
+// nothing arrives in time.
+func receive(names <-chan string) string {
+	select {
+	case name := <-names:
+		return name
+	case <-time.After(100 * time.Millisecond):
+		return ""
+	}
+}
+
+func TestConformanceWatch(t *testing.T) {
+	forEachBackend(t, func(t *testing.T, s Store) {
+		names, cancel := s.Watch("a")
+		defer cancel()
+
+		assert.NoError(t, s.Put("a1", int64(1)))
+		assert.Equal(t, "a1", receive(names))
+		assert.NoError(t, s.Put("b", int64(1)))
+		assert.NoError(t, s.Namespace("other").Put("a2", int64(1)))
+		assert.Equal(t, "", receive(names))
+
+		_, err := s.Incr("a1", 1)
+		assert.NoError(t, err)
+		assert.Equal(t, "a1", receive(names))
+		swapped, err := s.CompareAndSwap("a1", int64(1), int64(3))
+		assert.NoError(t, err)
+		assert.False(t, swapped)
+		assert.Equal(t, "", receive(names))
+		assert.NoError(t, s.Delete("a1"))
+		assert.Equal(t, "a1", receive(names))
+
+		cancel()
+		_, ok := <-names
+		assert.False(t, ok)
+	})
+}
+
+func TestConformanceWatchTx(t *testing.T) {
+	forEachBackend(t, func(t *testing.T, s Store) {
+		names, cancel := s.Watch("")
+		defer cancel()
+
+		tx, err := s.Begin()
+		assert.NoError(t, err)
+		assert.NoError(t, tx.Put("a", int64(1)))
+		nested, err := tx.Begin()
+		assert.NoError(t, err)
+		assert.NoError(t, nested.Put("b", int64(1)))
+		assert.NoError(t, nested.Rollback())
+		assert.Equal(t, "", receive(names))
+		assert.NoError(t, tx.Commit())
+		assert.Equal(t, "a", receive(names))
+		assert.Equal(t, "", receive(names))
+
+		tx, err = s.Begin()
+		assert.NoError(t, err)
+		assert.NoError(t, tx.Put("a", int64(2)))
+		assert.NoError(t, tx.Rollback())
+		assert.Equal(t, "", receive(names))
+	})
+}
+
+func TestConformanceWatchClose(t *testing.T) {
+	forEachBackend(t, func(t *testing.T, s Store) {
+		names, _ := s.Watch("")
+		assert.NoError(t, s.Close())
+		_, ok := <-names
+		assert.False(t, ok)
+	})
+}
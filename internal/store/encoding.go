@@ -0,0 +1,119 @@
+package store
+
+import (
+	"bytes"
+	"encoding/gob"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"reflect"
+)
+
+// Values are stored with the name of their encoding so that the format can
+// evolve without breaking existing databases.
+const (
+	// ENCODING_GOB is the legacy encoding. It is only decoded, never written.
+	ENCODING_GOB = "gob"
+	// ENCODING_JSON_V1 stores values as JSON documents.
+	ENCODING_JSON_V1 = "json-v1"
+)
+
+// Type hints describe values in terms of Lua so that other tools can tell
+// integers from numbers and arrays from tables without decoding the value.
+const (
+	TYPE_HINT_ARRAY   = "array"
+	TYPE_HINT_BOOLEAN = "boolean"
+	TYPE_HINT_INTEGER = "integer"
+	TYPE_HINT_NUMBER  = "number"
+	TYPE_HINT_STRING  = "string"
+	TYPE_HINT_TABLE   = "table"
+)
+
+func init() {
+	// Tables converted from Lua are stored as these types behind interface{}.
+	gob.Register(map[string]interface{}{})
+	gob.Register([]interface{}{})
+}
+
+func typeHint(value interface{}) string {
+	switch reflect.ValueOf(value).Kind() {
+	case reflect.Bool:
+		return TYPE_HINT_BOOLEAN
+	case reflect.Int, reflect.Int8, reflect.Int16, reflect.Int32, reflect.Int64,
+		reflect.Uint, reflect.Uint8, reflect.Uint16, reflect.Uint32, reflect.Uint64:
+		return TYPE_HINT_INTEGER
+	case reflect.Float32, reflect.Float64:
+		return TYPE_HINT_NUMBER
+	case reflect.String:
+		return TYPE_HINT_STRING
+	case reflect.Slice, reflect.Array:
+		return TYPE_HINT_ARRAY
+	default:
+		return TYPE_HINT_TABLE
+	}
+}
+
+func serializeData(value interface{}) ([]byte, string, error) {
+	if value == nil {
+		return nil, "", errors.New("nil cannot be stored")
+	}
+	serialized, err := json.Marshal(value)
+	if err != nil {
+		return nil, "", err
+	}
+	return serialized, typeHint(value), nil
+}
+
+func deserializeData(encoding string, value []byte) (interface{}, error) {
+	switch encoding {
+	case ENCODING_JSON_V1:
+		return DecodeJSON(value)
+	case ENCODING_GOB:
+		var deserialized interface{}
+		decoder := gob.NewDecoder(bytes.NewBuffer(value))
+		if err := decoder.Decode(&deserialized); err != nil {
+			return nil, err
+		}
+		return deserialized, nil
+	default:
+		return nil, fmt.Errorf("unsupported encoding %q", encoding)
+	}
+}
+
+// DecodeJSON decodes JSON the way Lua values are converted, i.e. integers
+// become int64 and other numbers become float64.
+func DecodeJSON(data []byte) (interface{}, error) {
+	decoder := json.NewDecoder(bytes.NewReader(data))
+	decoder.UseNumber()
+	var value interface{}
+	if err := decoder.Decode(&value); err != nil {
+		return nil, err
+	}
+	if decoder.More() {
+		return nil, errors.New("unexpected data after JSON value")
+	}
+	return normalizeJSON(value), nil
+}
+
+func normalizeJSON(value interface{}) interface{} {
+	switch v := value.(type) {
+	case json.Number:
+		if n, err := v.Int64(); err == nil {
+			return n
+		}
+		f, _ := v.Float64()
+		return f
+	case map[string]interface{}:
+		for key, item := range v {
+			v[key] = normalizeJSON(item)
+		}
+		return v
+	case []interface{}:
+		for i, item := range v {
+			v[i] = normalizeJSON(item)
+		}
+		return v
+	default:
+		return v
+	}
+}
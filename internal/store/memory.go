@@ -0,0 +1,730 @@
+package store
+
+import (
+	"bytes"
+	"fmt"
+	"maps"
+	"math"
+	"slices"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+)
+
+// memoryEntry keeps values serialized, so that stored values are copies and
+// round-trip exactly like values stored in SQLite. typeHint tells integers from
+// whole numbers, which serialize alike.
+type memoryEntry struct {
+	value     []byte
+	typeHint  string
+	expiresAt time.Time
+}
+
+func (e *memoryEntry) expired(now time.Time) bool {
+	return !e.expiresAt.IsZero() && !e.expiresAt.After(now)
+}
+
+func newMemoryEntry(l limits, name string, value interface{}, ttl time.Duration) (*memoryEntry, error) {
+	if err := checkName(name); err != nil {
+		return nil, err
+	}
+	serialized, typeHint, err := serializeData(value)
+	if err != nil {
+		return nil, err
+	}
+	if err := l.checkValueSize(name, int64(len(serialized))); err != nil {
+		return nil, err
+	}
+	entry := &memoryEntry{value: serialized, typeHint: typeHint}
+	if ttl > 0 {
+		entry.expiresAt = time.Now().Add(ttl)
+	}
+	return entry, nil
+}
+
+func (e *memoryEntry) decode() (interface{}, error) {
+	return deserializeData(ENCODING_JSON_V1, e.value)
+}
+
+type memoryKey struct {
+	namespace, name string
+}
+
+// memoryChange is a change recorded in the history, see Change.
+type memoryChange struct {
+	key             memoryKey
+	value, previous []byte
+	script          string
+	changedAt       time.Time
+}
+
+func (c *memoryChange) decode() (change Change, err error) {
+	change.Script, change.ChangedAt = c.script, c.changedAt
+	if change.Value, err = decodeChange(c.value); err != nil {
+		return change, err
+	}
+	change.Previous, err = decodeChange(c.previous)
+	return change, err
+}
+
+// memoryData is shared by a store and its views.
+type memoryData struct {
+	// mu guards entries and changeLog.
+	mu        sync.RWMutex
+	entries   map[memoryKey]*memoryEntry
+	changeLog map[memoryKey][]memoryChange
+	watchers  *watchers
+	// writer is held by transactions until they finish and by every write, so
+	// that only one writer runs at a time like in SQLite.
+	writer sync.Mutex
+	config
+}
+
+// MemoryStore keeps values in memory. Values are lost when the process exits.
+type MemoryStore struct {
+	*memoryData
+	namespace string
+	script    string
+}
+
+func NewMemoryStore(options ...Option) *MemoryStore {
+	s := &MemoryStore{
+		memoryData: &memoryData{
+			entries:   make(map[memoryKey]*memoryEntry),
+			changeLog: make(map[memoryKey][]memoryChange),
+			watchers:  newWatchers(),
+		},
+		namespace: DefaultNamespace,
+	}
+	for _, option := range options {
+		option(&s.config)
+	}
+	return s
+}
+
+func (s *MemoryStore) Close() error {
+	s.watchers.close()
+	return nil
+}
+
+func (s *MemoryStore) Namespace(namespace string) Store {
+	view := *s
+	view.namespace = namespace
+	return &view
+}
+
+func (s *MemoryStore) Script(script string) Store {
+	view := *s
+	view.script = script
+	return &view
+}
+
+func (s *MemoryStore) Watch(prefix string) (<-chan string, func()) {
+	return s.watchers.watch(s.namespace, prefix)
+}
+
+// SharedNamespace returns an empty string, since memory stores never predate
+// namespaces.
+func (s *MemoryStore) SharedNamespace() string {
+	return ""
+}
+
+func (s *MemoryStore) Namespaces() ([]string, error) {
+	now := time.Now()
+	seen := make(map[string]bool)
+	namespaces := make([]string, 0)
+	s.mu.RLock()
+	for key, entry := range s.entries {
+		if !seen[key.namespace] && !entry.expired(now) {
+			seen[key.namespace] = true
+			namespaces = append(namespaces, key.namespace)
+		}
+	}
+	s.mu.RUnlock()
+	sort.Strings(namespaces)
+	return namespaces, nil
+}
+
+func (s *MemoryStore) key(name string) memoryKey {
+	return memoryKey{s.namespace, name}
+}
+
+// entry returns the entry of name from the writes of a transaction, or from the
+// store when the transaction has not written it, even when it has expired.
+func (s *MemoryStore) entry(writes map[memoryKey]*memoryEntry, name string) *memoryEntry {
+	entry, ok := writes[s.key(name)]
+	if !ok {
+		s.mu.RLock()
+		entry = s.entries[s.key(name)]
+		s.mu.RUnlock()
+	}
+	return entry
+}
+
+// lookup returns the live entry of name, see entry.
+func (s *MemoryStore) lookup(writes map[memoryKey]*memoryEntry, name string) *memoryEntry {
+	entry := s.entry(writes, name)
+	if entry == nil || entry.expired(time.Now()) {
+		return nil
+	}
+	return entry
+}
+
+// names returns the live names in the namespace starting with prefix in lexical
+// order.
+func (s *MemoryStore) names(writes map[memoryKey]*memoryEntry, prefix string) []string {
+	var names []string
+	s.live(writes, func(key memoryKey, _ *memoryEntry) {
+		if key.namespace == s.namespace && strings.HasPrefix(key.name, prefix) {
+			names = append(names, key.name)
+		}
+	})
+	sort.Strings(names)
+	return names
+}
+
+// live calls f with every live entry of every namespace, where the writes of a
+// transaction replace the entries of the store.
+func (s *MemoryStore) live(writes map[memoryKey]*memoryEntry, f func(key memoryKey, entry *memoryEntry)) {
+	now := time.Now()
+	s.mu.RLock()
+	for key, entry := range s.entries {
+		if _, ok := writes[key]; !ok && !entry.expired(now) {
+			f(key, entry)
+		}
+	}
+	s.mu.RUnlock()
+	for key, entry := range writes {
+		if entry != nil && !entry.expired(now) {
+			f(key, entry)
+		}
+	}
+}
+
+// totalSize returns the size of the live values of every namespace except name.
+func (s *MemoryStore) totalSize(writes map[memoryKey]*memoryEntry, name string) int64 {
+	var total int64
+	s.live(writes, func(key memoryKey, entry *memoryEntry) {
+		if key != s.key(name) {
+			total += int64(len(entry.value))
+		}
+	})
+	return total
+}
+
+func (s *MemoryStore) get(writes map[memoryKey]*memoryEntry, name string) (interface{}, error) {
+	entry := s.lookup(writes, name)
+	if entry == nil {
+		return nil, nil
+	}
+	return entry.decode()
+}
+
+// put prepares the entry of a write. The caller holds the writer lock.
+func (s *MemoryStore) put(writes map[memoryKey]*memoryEntry, name string, value interface{}, ttl time.Duration) (*memoryEntry, error) {
+	entry, err := newMemoryEntry(s.limits, name, value, ttl)
+	if err != nil {
+		return nil, err
+	}
+	if s.limits.maxTotalSize > 0 {
+		if err := s.limits.checkTotalSize(name, s.totalSize(writes, name), int64(len(entry.value))); err != nil {
+			return nil, err
+		}
+	}
+	return entry, nil
+}
+
+func (s *MemoryStore) incr(writes map[memoryKey]*memoryEntry, name string, delta int64) (*memoryEntry, int64, error) {
+	if err := checkName(name); err != nil {
+		return nil, 0, err
+	}
+	var n int64
+	var expiresAt time.Time
+	if entry := s.lookup(writes, name); entry != nil {
+		if entry.typeHint != TYPE_HINT_INTEGER {
+			return nil, 0, fmt.Errorf("%w: %s", ErrNotInteger, name)
+		}
+		value, err := entry.decode()
+		if err != nil {
+			return nil, 0, err
+		}
+		current, ok := value.(int64)
+		if !ok {
+			return nil, 0, fmt.Errorf("%w: %s", ErrNotInteger, name)
+		}
+		n, expiresAt = current, entry.expiresAt
+	}
+	if (delta > 0 && n > math.MaxInt64-delta) || (delta < 0 && n < math.MinInt64-delta) {
+		return nil, 0, fmt.Errorf("%w: %s", ErrOverflow, name)
+	}
+	n += delta
+	entry, err := s.put(writes, name, n, 0)
+	if err != nil {
+		return nil, 0, err
+	}
+	entry.expiresAt = expiresAt
+	return entry, n, nil
+}
+
+// compareAndSwap returns the entry replacing the current one, which is nil for
+// deletion, and whether the current value equals expected.
+func (s *MemoryStore) compareAndSwap(writes map[memoryKey]*memoryEntry, name string, expected, value interface{}) (*memoryEntry, bool, error) {
+	if value != nil {
+		if err := checkName(name); err != nil {
+			return nil, false, err
+		}
+	}
+	current := s.lookup(writes, name)
+	if expected == nil {
+		if current != nil {
+			return nil, false, nil
+		}
+	} else {
+		serialized, _, err := serializeData(expected)
+		if err != nil {
+			return nil, false, err
+		}
+		if current == nil || !bytes.Equal(current.value, serialized) {
+			return nil, false, nil
+		}
+	}
+	if value == nil {
+		return nil, true, nil
+	}
+	entry, err := s.put(writes, name, value, 0)
+	if err != nil {
+		return nil, false, err
+	}
+	return entry, true, nil
+}
+
+func (s *MemoryStore) scan(writes map[memoryKey]*memoryEntry, prefix, after string, limit int) ([]Entry, error) {
+	entries := make([]Entry, 0)
+	for _, name := range s.names(writes, prefix) {
+		if len(entries) >= limit {
+			break
+		}
+		if name <= after {
+			continue
+		}
+		entry := s.lookup(writes, name)
+		if entry == nil {
+			continue
+		}
+		value, err := entry.decode()
+		if err != nil {
+			return nil, err
+		}
+		entries = append(entries, Entry{Name: name, Value: value, ExpiresAt: entry.expiresAt})
+	}
+	return entries, nil
+}
+
+// change returns the changes of replacing the entry of name with entry, which
+// are none when the store does not record history or nothing changes. An
+// expired entry is recorded as deleted at the time it expired first.
+func (s *MemoryStore) change(writes map[memoryKey]*memoryEntry, name string, entry *memoryEntry) []memoryChange {
+	if !s.history {
+		return nil
+	}
+	var changes []memoryChange
+	now := time.Now()
+	change := memoryChange{key: s.key(name), script: s.script, changedAt: now}
+	if previous := s.entry(writes, name); previous != nil {
+		if previous.expired(now) {
+			changes = append(changes, expiration(s.key(name), previous))
+		} else {
+			change.previous = previous.value
+		}
+	}
+	if entry != nil {
+		change.value = entry.value
+	}
+	if change.value != nil || change.previous != nil {
+		changes = append(changes, change)
+	}
+	return changes
+}
+
+// expiration is the change of an entry which expired.
+func expiration(key memoryKey, entry *memoryEntry) memoryChange {
+	return memoryChange{key: key, previous: entry.value, changedAt: entry.expiresAt}
+}
+
+// record appends changes to the history. The caller holds mu.
+func (s *MemoryStore) record(changes ...memoryChange) {
+	for _, change := range changes {
+		s.changeLog[change.key] = append(s.changeLog[change.key], change)
+	}
+}
+
+// changes returns at most limit changes of name from the newest to the oldest,
+// where pending changes of a transaction are newer than recorded ones.
+func (s *MemoryStore) changes(pending []memoryChange, name string, limit int) ([]Change, error) {
+	all := s.changeList(pending, name)
+	changes := make([]Change, 0)
+	for i := len(all) - 1; i >= 0 && len(changes) < limit; i-- {
+		change, err := all[i].decode()
+		if err != nil {
+			return nil, err
+		}
+		changes = append(changes, change)
+	}
+	return changes, nil
+}
+
+// changeList returns the changes of name from the oldest to the newest,
+// including pending changes of a transaction.
+func (s *MemoryStore) changeList(pending []memoryChange, name string) []memoryChange {
+	key := s.key(name)
+	s.mu.RLock()
+	all := slices.Clone(s.changeLog[key])
+	s.mu.RUnlock()
+	for _, change := range pending {
+		if change.key == key {
+			all = append(all, change)
+		}
+	}
+	return all
+}
+
+// getAt returns the previous value of the first change after at, or the
+// current value when nothing changed since, which may have expired after at.
+func (s *MemoryStore) getAt(writes map[memoryKey]*memoryEntry, pending []memoryChange, name string, at time.Time) (interface{}, error) {
+	if err := s.checkHistory(at); err != nil {
+		return nil, err
+	}
+	for _, change := range s.changeList(pending, name) {
+		// changes are told apart in milliseconds as in SQLite
+		if change.changedAt.UnixMilli() > at.UnixMilli() {
+			return decodeChange(change.previous)
+		}
+	}
+	entry := s.entry(writes, name)
+	if entry == nil || entry.expired(at) {
+		return nil, nil
+	}
+	return entry.decode()
+}
+
+func (s *MemoryStore) write(name string, entry *memoryEntry) {
+	changes := s.change(nil, name, entry)
+	s.mu.Lock()
+	if entry == nil {
+		delete(s.entries, s.key(name))
+	} else {
+		s.entries[s.key(name)] = entry
+	}
+	s.record(changes...)
+	s.mu.Unlock()
+	s.watchers.notify(event(s.key(name)))
+}
+
+func (s *MemoryStore) Get(name string) (interface{}, error) {
+	return s.get(nil, name)
+}
+
+func (s *MemoryStore) Put(name string, value interface{}) error {
+	return s.putWithTTL(name, value, 0)
+}
+
+func (s *MemoryStore) PutWithTTL(name string, value interface{}, ttl time.Duration) error {
+	if ttl <= 0 {
+		return ErrInvalidTTL
+	}
+	return s.putWithTTL(name, value, ttl)
+}
+
+func (s *MemoryStore) putWithTTL(name string, value interface{}, ttl time.Duration) error {
+	s.writer.Lock()
+	defer s.writer.Unlock()
+	entry, err := s.put(nil, name, value, ttl)
+	if err != nil {
+		return err
+	}
+	s.write(name, entry)
+	return nil
+}
+
+func (s *MemoryStore) Delete(name string) error {
+	s.writer.Lock()
+	defer s.writer.Unlock()
+	s.write(name, nil)
+	return nil
+}
+
+func (s *MemoryStore) Has(name string) (bool, error) {
+	return s.lookup(nil, name) != nil, nil
+}
+
+func (s *MemoryStore) Keys(prefix string) ([]string, error) {
+	names := s.names(nil, prefix)
+	if names == nil {
+		names = make([]string, 0)
+	}
+	return names, nil
+}
+
+func (s *MemoryStore) Scan(prefix, after string, limit int) ([]Entry, error) {
+	return s.scan(nil, prefix, after, limit)
+}
+
+func (s *MemoryStore) Incr(name string, delta int64) (int64, error) {
+	s.writer.Lock()
+	defer s.writer.Unlock()
+	entry, n, err := s.incr(nil, name, delta)
+	if err != nil {
+		return 0, err
+	}
+	s.write(name, entry)
+	return n, nil
+}
+
+func (s *MemoryStore) CompareAndSwap(name string, expected, value interface{}) (bool, error) {
+	s.writer.Lock()
+	defer s.writer.Unlock()
+	entry, swapped, err := s.compareAndSwap(nil, name, expected, value)
+	if err != nil || !swapped {
+		return false, err
+	}
+	s.write(name, entry)
+	return true, nil
+}
+
+func (s *MemoryStore) History(name string, limit int) ([]Change, error) {
+	return s.changes(nil, name, limit)
+}
+
+func (s *MemoryStore) GetAt(name string, at time.Time) (interface{}, error) {
+	return s.getAt(nil, nil, name, at)
+}
+
+func (s *MemoryStore) DeleteExpired() (int64, error) {
+	s.writer.Lock()
+	defer s.writer.Unlock()
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	now := time.Now()
+	if s.historyRetention > 0 {
+		cutoff := now.Add(-s.historyRetention)
+		for key, changes := range s.changeLog {
+			changes = slices.DeleteFunc(changes, func(change memoryChange) bool {
+				return !change.changedAt.After(cutoff)
+			})
+			if len(changes) == 0 {
+				delete(s.changeLog, key)
+			} else {
+				s.changeLog[key] = changes
+			}
+		}
+	}
+	var n int64
+	for key, entry := range s.entries {
+		if entry.expired(now) {
+			if s.history {
+				s.record(expiration(key, entry))
+			}
+			delete(s.entries, key)
+			n++
+		}
+	}
+	return n, nil
+}
+
+func (s *MemoryStore) Begin() (Tx, error) {
+	s.writer.Lock()
+	return &MemoryTx{store: s, writes: make(map[memoryKey]*memoryEntry), changes: new([]memoryChange), done: new(bool)}, nil
+}
+
+// MemoryTx collects writes and applies them to the store on commit. A nil entry
+// in writes is a deletion.
+type MemoryTx struct {
+	store  *MemoryStore
+	writes map[memoryKey]*memoryEntry
+	// changes are recorded to the history on commit.
+	changes *[]memoryChange
+	// done is shared with views of other namespaces.
+	done *bool
+	// savepoint is a copy of writes when a nested transaction begins, which is
+	// restored when it is rolled back. It is nil for top-level transactions.
+	savepoint        map[memoryKey]*memoryEntry
+	savepointChanges int
+}
+
+func (tx *MemoryTx) Namespace(namespace string) Accessor {
+	view := *tx
+	view.store = tx.store.Namespace(namespace).(*MemoryStore)
+	return &view
+}
+
+// Begin starts a nested transaction which shares writes with this transaction.
+func (tx *MemoryTx) Begin() (Tx, error) {
+	if *tx.done {
+		return nil, ErrTxDone
+	}
+	return &MemoryTx{
+		store:            tx.store,
+		writes:           tx.writes,
+		changes:          tx.changes,
+		done:             new(bool),
+		savepoint:        maps.Clone(tx.writes),
+		savepointChanges: len(*tx.changes),
+	}, nil
+}
+
+func (tx *MemoryTx) set(name string, entry *memoryEntry) {
+	*tx.changes = append(*tx.changes, tx.store.change(tx.writes, name, entry)...)
+	tx.writes[tx.store.key(name)] = entry
+}
+
+func (tx *MemoryTx) finish() bool {
+	if *tx.done {
+		return false
+	}
+	*tx.done = true
+	if tx.savepoint == nil {
+		tx.store.writer.Unlock()
+	}
+	return true
+}
+
+func (tx *MemoryTx) Commit() error {
+	if *tx.done {
+		return ErrTxDone
+	}
+	if tx.savepoint != nil {
+		tx.finish()
+		return nil
+	}
+	tx.store.mu.Lock()
+	for key, entry := range tx.writes {
+		if entry == nil {
+			delete(tx.store.entries, key)
+		} else {
+			tx.store.entries[key] = entry
+		}
+	}
+	tx.store.record(*tx.changes...)
+	tx.store.mu.Unlock()
+	events := make([]event, 0, len(tx.writes))
+	for key := range tx.writes {
+		events = append(events, event(key))
+	}
+	tx.store.watchers.notify(events...)
+	tx.finish()
+	return nil
+}
+
+func (tx *MemoryTx) Rollback() error {
+	if !tx.finish() {
+		return ErrTxDone
+	}
+	if tx.savepoint != nil {
+		clear(tx.writes)
+		maps.Copy(tx.writes, tx.savepoint)
+		*tx.changes = (*tx.changes)[:tx.savepointChanges]
+	}
+	return nil
+}
+
+func (tx *MemoryTx) Get(name string) (interface{}, error) {
+	if *tx.done {
+		return nil, ErrTxDone
+	}
+	return tx.store.get(tx.writes, name)
+}
+
+func (tx *MemoryTx) Put(name string, value interface{}) error {
+	return tx.putWithTTL(name, value, 0)
+}
+
+func (tx *MemoryTx) PutWithTTL(name string, value interface{}, ttl time.Duration) error {
+	if ttl <= 0 {
+		return ErrInvalidTTL
+	}
+	return tx.putWithTTL(name, value, ttl)
+}
+
+func (tx *MemoryTx) putWithTTL(name string, value interface{}, ttl time.Duration) error {
+	if *tx.done {
+		return ErrTxDone
+	}
+	entry, err := tx.store.put(tx.writes, name, value, ttl)
+	if err != nil {
+		return err
+	}
+	tx.set(name, entry)
+	return nil
+}
+
+func (tx *MemoryTx) Delete(name string) error {
+	if *tx.done {
+		return ErrTxDone
+	}
+	tx.set(name, nil)
+	return nil
+}
+
+func (tx *MemoryTx) Has(name string) (bool, error) {
+	if *tx.done {
+		return false, ErrTxDone
+	}
+	return tx.store.lookup(tx.writes, name) != nil, nil
+}
+
+func (tx *MemoryTx) Keys(prefix string) ([]string, error) {
+	if *tx.done {
+		return nil, ErrTxDone
+	}
+	names := tx.store.names(tx.writes, prefix)
+	if names == nil {
+		names = make([]string, 0)
+	}
+	return names, nil
+}
+
+func (tx *MemoryTx) Scan(prefix, after string, limit int) ([]Entry, error) {
+	if *tx.done {
+		return nil, ErrTxDone
+	}
+	return tx.store.scan(tx.writes, prefix, after, limit)
+}
+
+func (tx *MemoryTx) Incr(name string, delta int64) (int64, error) {
+	if *tx.done {
+		return 0, ErrTxDone
+	}
+	entry, n, err := tx.store.incr(tx.writes, name, delta)
+	if err != nil {
+		return 0, err
+	}
+	tx.set(name, entry)
+	return n, nil
+}
+
+func (tx *MemoryTx) CompareAndSwap(name string, expected, value interface{}) (bool, error) {
+	if *tx.done {
+		return false, ErrTxDone
+	}
+	entry, swapped, err := tx.store.compareAndSwap(tx.writes, name, expected, value)
+	if err != nil || !swapped {
+		return false, err
+	}
+	tx.set(name, entry)
+	return true, nil
+}
+
+func (tx *MemoryTx) History(name string, limit int) ([]Change, error) {
+	if *tx.done {
+		return nil, ErrTxDone
+	}
+	return tx.store.changes(*tx.changes, name, limit)
+}
+
+func (tx *MemoryTx) GetAt(name string, at time.Time) (interface{}, error) {
+	if *tx.done {
+		return nil, ErrTxDone
+	}
+	return tx.store.getAt(tx.writes, *tx.changes, name, at)
+}
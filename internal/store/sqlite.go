@@ -0,0 +1,934 @@
+package store
+
+import (
+	"database/sql"
+	"fmt"
+	"strconv"
+	"time"
+
+	"github.com/golang-migrate/migrate/v4"
+	"github.com/golang-migrate/migrate/v4/database/sqlite3"
+	_ "github.com/golang-migrate/migrate/v4/source/file"
+	"github.com/golang-migrate/migrate/v4/source/iofs"
+	"github.com/henry40408/lmb/migrations"
+	_ "github.com/mattn/go-sqlite3"
+	"github.com/rs/zerolog/log"
+)
+
+// Expiration times are stored as Unix milliseconds. Expired rows are treated as
+// missing, deleted lazily when read, and swept by DeleteExpired.
+const (
+	SQL_CAS_DELETE = `DELETE FROM store WHERE namespace = ? AND name = ? AND value = ? AND encoding = ? AND (expires_at IS NULL OR expires_at > ?)`
+	SQL_CAS_INSERT = `
+    INSERT INTO store (namespace, name, value, encoding, type_hint, size) VALUES (?, ?, ?, ?, ?, ?)
+    ON CONFLICT (namespace, name) DO UPDATE SET
+      value = excluded.value,
+      encoding = excluded.encoding,
+      type_hint = excluded.type_hint,
+      size = excluded.size,
+      expires_at = NULL,
+      updated_at = CURRENT_TIMESTAMP
+    WHERE expires_at <= ?
+  `
+	SQL_CAS_UPDATE = `
+    UPDATE store SET value = ?, encoding = ?, type_hint = ?, size = ?, expires_at = NULL, updated_at = CURRENT_TIMESTAMP
+    WHERE namespace = ? AND name = ? AND value = ? AND encoding = ? AND (expires_at IS NULL OR expires_at > ?)
+  `
+	SQL_DELETE         = `DELETE FROM store WHERE namespace = ? AND name = ?`
+	SQL_DELETE_EXPIRED = `DELETE FROM store WHERE expires_at <= ?`
+	SQL_EXPIRE         = `DELETE FROM store WHERE namespace = ? AND name = ? AND expires_at <= ? RETURNING value, encoding, expires_at`
+	// SQL_HISTORY_EXPIRED records expired values as deleted at the time they
+	// expired, before they are deleted.
+	SQL_HISTORY_EXPIRED = `
+    INSERT INTO store_history (namespace, name, value, previous, script, created_at)
+    SELECT namespace, name, NULL, CASE WHEN encoding = ?2 THEN value END, '', expires_at FROM store WHERE expires_at <= ?1 ORDER BY expires_at
+  `
+	SQL_GET            = `SELECT value, encoding, expires_at FROM store WHERE namespace = ? AND name = ?`
+	SQL_HISTORY        = `SELECT value, previous, script, created_at FROM store_history WHERE namespace = ? AND name = ? ORDER BY created_at DESC, id DESC LIMIT ?`
+	SQL_CHANGED_AFTER  = `SELECT previous FROM store_history WHERE namespace = ? AND name = ? AND created_at > ? ORDER BY created_at, id LIMIT 1`
+	SQL_HISTORY_INSERT = `INSERT INTO store_history (namespace, name, value, previous, script, created_at) VALUES (?, ?, ?, ?, ?, ?)`
+	SQL_HAS            = `SELECT EXISTS (SELECT 1 FROM store WHERE namespace = ?1 AND name = ?2 AND (expires_at IS NULL OR expires_at > ?3))`
+	// SQL_INCR adds to an integer, or inserts the delta when the value is missing
+	// or expired. It returns no row when the value is not an integer or the sum
+	// overflows, which SQLite turns into a real.
+	SQL_INCR = `
+    INSERT INTO store (namespace, name, value, encoding, type_hint, size) VALUES (?6, ?1, CAST(?2 AS BLOB), ?3, ?4, length(CAST(?2 AS BLOB)))
+    ON CONFLICT (namespace, name) DO UPDATE SET
+      value = CAST(CASE WHEN expires_at <= ?5 THEN ?2 ELSE CAST(CAST(value AS TEXT) AS INTEGER) + ?2 END AS BLOB),
+      encoding = ?3,
+      type_hint = ?4,
+      size = length(CAST(CASE WHEN expires_at <= ?5 THEN ?2 ELSE CAST(CAST(value AS TEXT) AS INTEGER) + ?2 END AS BLOB)),
+      expires_at = CASE WHEN expires_at <= ?5 THEN NULL ELSE expires_at END,
+      updated_at = CURRENT_TIMESTAMP
+    WHERE expires_at <= ?5 OR (encoding = ?3 AND type_hint = ?4 AND typeof(CAST(CAST(value AS TEXT) AS INTEGER) + ?2) = 'integer')
+    RETURNING CAST(CAST(value AS TEXT) AS INTEGER)
+  `
+	// SQL_IS_INTEGER reports whether a live value is an integer.
+	SQL_IS_INTEGER = `SELECT EXISTS (SELECT 1 FROM store WHERE namespace = ? AND name = ? AND encoding = ? AND type_hint = ? AND (expires_at IS NULL OR expires_at > ?))`
+	SQL_KEYS       = `SELECT name FROM store WHERE namespace = ?3 AND substr(name, 1, length(?1)) = ?1 AND (expires_at IS NULL OR expires_at > ?2) ORDER BY name`
+	SQL_PREVIOUS   = `SELECT value FROM store WHERE namespace = ? AND name = ? AND encoding = ? AND (expires_at IS NULL OR expires_at > ?)`
+	SQL_PRUNE      = `DELETE FROM store_history WHERE created_at <= ?`
+	SQL_NAMESPACES = `SELECT DISTINCT namespace FROM store WHERE expires_at IS NULL OR expires_at > ? ORDER BY namespace`
+	SQL_SCAN       = `SELECT name, value, encoding, expires_at FROM store WHERE namespace = ?5 AND substr(name, 1, length(?1)) = ?1 AND name > ?2 AND (expires_at IS NULL OR expires_at > ?3) ORDER BY name LIMIT ?4`
+	SQL_UPSERT     = `
+    INSERT INTO store (namespace, name, value, encoding, type_hint, size, expires_at) VALUES (?, ?, ?, ?, ?, ?, ?)
+    ON CONFLICT (namespace, name) DO UPDATE SET
+      value = excluded.value,
+      encoding = excluded.encoding,
+      type_hint = excluded.type_hint,
+      size = excluded.size,
+      expires_at = excluded.expires_at,
+      updated_at = CURRENT_TIMESTAMP
+  `
+	SQL_SELECT_LEGACY    = `SELECT id, value FROM store WHERE encoding = ?`
+	SQL_SHARED_NAMESPACE = `SELECT value FROM store_settings WHERE name = 'shared_namespace'`
+	SQL_TOTAL_SIZE       = `SELECT COALESCE(SUM(size), 0) FROM store WHERE NOT (namespace = ? AND name = ?)`
+	SQL_UPGRADE          = `UPDATE store SET value = ?, encoding = ?, type_hint = ?, size = ? WHERE id = ?`
+)
+
+// SQLiteStore stores values in a SQLite database.
+type SQLiteStore struct {
+	db *sql.DB
+	scope
+	watchers        *watchers
+	sharedNamespace string
+}
+
+func migrateDB(db *sql.DB) error {
+	d, err := iofs.New(migrations.MigrationFiles, ".")
+	if err != nil {
+		return err
+	}
+	defer d.Close()
+
+	driver, err := sqlite3.WithInstance(db, &sqlite3.Config{})
+	if err != nil {
+		return err
+	}
+	// defer driver.Close() // database is closed
+
+	m, err := migrate.NewWithInstance("iofs", d, "sqlite", driver)
+	if err != nil {
+		return err
+	}
+	// defer m.Close() // database is closed
+
+	if err := m.Up(); err != nil && err != migrate.ErrNoChange {
+		return err
+	}
+	return nil
+}
+
+// NewStore opens the SQLite database at dsn and migrates it.
+func NewStore(dsn string, options ...Option) (*SQLiteStore, error) {
+	db, err := sql.Open("sqlite3", dsn)
+	if err != nil {
+		return nil, err
+	}
+
+	// https://github.com/mattn/go-sqlite3/issues/274#issuecomment-191597862
+	db.SetMaxOpenConns(1)
+
+	// https://github.com/dani-garcia/vaultwarden/blob/3dbfc484a54c41d1759646444b439da06445060b/src/db/mod.rs#L234
+	// https://github.com/dani-garcia/vaultwarden/blob/3dbfc484a54c41d1759646444b439da06445060b/src/db/mod.rs#L447
+	_, err = db.Exec(`
+    PRAGMA busy_timeout = 5000;
+    PRAGMA foreign_keys = OFF;
+    PRAGMA journal_mode = wal;
+    PRAGMA synchronous = NORMAL;
+  `)
+	if err != nil {
+		return nil, err
+	}
+
+	err = migrateDB(db)
+	if err != nil {
+		return nil, err
+	}
+
+	err = upgradeLegacyRows(db)
+	if err != nil {
+		return nil, err
+	}
+
+	s := &SQLiteStore{db: db, scope: scope{namespace: DefaultNamespace}, watchers: newWatchers()}
+	err = db.QueryRow(SQL_SHARED_NAMESPACE).Scan(&s.sharedNamespace)
+	if err != nil && err != sql.ErrNoRows {
+		return nil, err
+	}
+	for _, option := range options {
+		option(&s.config)
+	}
+	// short-lived processes such as lmb eval never sweep, so the history is
+	// pruned whenever the store is opened as well
+	if err := s.pruneHistory(time.Now()); err != nil {
+		return nil, err
+	}
+	return s, nil
+}
+
+func (s *SQLiteStore) Close() error {
+	s.watchers.close()
+	return s.db.Close()
+}
+
+func (s *SQLiteStore) Namespace(namespace string) Store {
+	view := *s
+	view.namespace = namespace
+	return &view
+}
+
+func (s *SQLiteStore) Script(script string) Store {
+	view := *s
+	view.script = script
+	return &view
+}
+
+func (s *SQLiteStore) Watch(prefix string) (<-chan string, func()) {
+	return s.watchers.watch(s.namespace, prefix)
+}
+
+// changed notifies watchers that the value of name was changed.
+func (s *SQLiteStore) changed(name string) {
+	s.watchers.notify(event{s.namespace, name})
+}
+
+func (s *SQLiteStore) SharedNamespace() string {
+	return s.sharedNamespace
+}
+
+func (s *SQLiteStore) Namespaces() ([]string, error) {
+	rows, err := s.db.Query(SQL_NAMESPACES, time.Now().UnixMilli())
+	if err != nil {
+		return nil, err
+	}
+	return scanStrings(rows)
+}
+
+func scanStrings(rows *sql.Rows) ([]string, error) {
+	defer rows.Close()
+	values := make([]string, 0)
+	for rows.Next() {
+		var value string
+		if err := rows.Scan(&value); err != nil {
+			return nil, err
+		}
+		values = append(values, value)
+	}
+	return values, rows.Err()
+}
+
+// upgradeLegacyRows rewrites gob-encoded rows with the current encoding. Rows
+// that cannot be decoded or encoded are logged and left untouched, and fail
+// when they are read.
+func upgradeLegacyRows(db *sql.DB) error {
+	type legacyRow struct {
+		id    int64
+		value interface{}
+	}
+
+	tx, err := db.Begin()
+	if err != nil {
+		return err
+	}
+	defer tx.Rollback()
+
+	rows, err := tx.Query(SQL_SELECT_LEGACY, ENCODING_GOB)
+	if err != nil {
+		return err
+	}
+	var legacyRows []legacyRow
+	for rows.Next() {
+		var id int64
+		var value []byte
+		if err := rows.Scan(&id, &value); err != nil {
+			rows.Close()
+			return err
+		}
+		deserialized, err := deserializeData(ENCODING_GOB, value)
+		if err == nil && deserialized == nil {
+			err = fmt.Errorf("decoded to nil")
+		}
+		if err != nil {
+			log.Warn().Err(err).Int64("id", id).Msg("cannot decode legacy value")
+			continue
+		}
+		legacyRows = append(legacyRows, legacyRow{id, deserialized})
+	}
+	rows.Close()
+	if err := rows.Err(); err != nil {
+		return err
+	}
+
+	for _, row := range legacyRows {
+		serialized, typeHint, err := serializeData(row.value)
+		if err != nil {
+			log.Warn().Err(err).Int64("id", row.id).Msg("cannot encode legacy value")
+			continue
+		}
+		if _, err := tx.Exec(SQL_UPGRADE, serialized, ENCODING_JSON_V1, typeHint, len(serialized), row.id); err != nil {
+			return err
+		}
+	}
+	return tx.Commit()
+}
+
+// querier is implemented by both *sql.DB and *sql.Tx so that every operation is
+// written once and shared by SQLiteStore and SQLiteTx.
+type querier interface {
+	Exec(query string, args ...any) (sql.Result, error)
+	Query(query string, args ...any) (*sql.Rows, error)
+	QueryRow(query string, args ...any) *sql.Row
+}
+
+func get(q querier, sc scope, name string) (interface{}, error) {
+	var value []byte
+	var encoding string
+	var expiresAt sql.NullInt64
+	err := q.QueryRow(SQL_GET, sc.namespace, name).Scan(&value, &encoding, &expiresAt)
+	if err != nil {
+		if err == sql.ErrNoRows {
+			return nil, nil
+		} else {
+			return nil, err
+		}
+	}
+	if now := time.Now().UnixMilli(); expiresAt.Valid && expiresAt.Int64 <= now {
+		return nil, expire(q, sc, name, now)
+	}
+	return deserializeData(encoding, value)
+}
+
+// expire deletes the value when it has expired, and records the expiration in
+// the history when the store records history.
+func expire(q querier, sc scope, name string, now int64) error {
+	var value []byte
+	var encoding string
+	var expiresAt int64
+	err := q.QueryRow(SQL_EXPIRE, sc.namespace, name, now).Scan(&value, &encoding, &expiresAt)
+	if err == sql.ErrNoRows {
+		return nil
+	}
+	if err != nil || !sc.history {
+		return err
+	}
+	if encoding != ENCODING_JSON_V1 {
+		value = nil
+	}
+	_, err = q.Exec(SQL_HISTORY_INSERT, sc.namespace, name, nil, value, "", expiresAt)
+	return err
+}
+
+// deleteExpired deletes every expired value, and records the expirations in the
+// history when the store records history.
+func deleteExpired(q querier, sc scope, now int64) (int64, error) {
+	if sc.history {
+		if _, err := q.Exec(SQL_HISTORY_EXPIRED, now, ENCODING_JSON_V1); err != nil {
+			return 0, err
+		}
+	}
+	res, err := q.Exec(SQL_DELETE_EXPIRED, now)
+	if err != nil {
+		return 0, err
+	}
+	return res.RowsAffected()
+}
+
+func put(q querier, sc scope, name string, value interface{}, ttl time.Duration) error {
+	if err := checkName(name); err != nil {
+		return err
+	}
+	var expiresAt sql.NullInt64
+	if ttl > 0 {
+		expiresAt = sql.NullInt64{Int64: time.Now().Add(ttl).UnixMilli(), Valid: true}
+	}
+	serialized, typeHint, err := serializeData(value)
+	if err != nil {
+		return err
+	}
+	size := int64(len(serialized))
+	if err := checkLimits(q, sc, name, size); err != nil {
+		return err
+	}
+	return record(q, sc, name, func() ([]byte, bool, error) {
+		_, err := q.Exec(SQL_UPSERT, sc.namespace, name, serialized, ENCODING_JSON_V1, typeHint, size, expiresAt)
+		return serialized, true, err
+	})
+}
+
+// record runs the write f and records the change in the history when the store
+// records history. f returns the serialized value, which is nil for deletion,
+// and whether it changed the value.
+func record(q querier, sc scope, name string, f func() ([]byte, bool, error)) error {
+	if !sc.history {
+		_, _, err := f()
+		return err
+	}
+	// an expired value is recorded as deleted before it is replaced
+	now := time.Now().UnixMilli()
+	if err := expire(q, sc, name, now); err != nil {
+		return err
+	}
+	var previous []byte
+	err := q.QueryRow(SQL_PREVIOUS, sc.namespace, name, ENCODING_JSON_V1, now).Scan(&previous)
+	if err != nil && err != sql.ErrNoRows {
+		return err
+	}
+	value, changed, err := f()
+	if err != nil || !changed || (value == nil && previous == nil) {
+		return err
+	}
+	_, err = q.Exec(SQL_HISTORY_INSERT, sc.namespace, name, value, previous, sc.script, time.Now().UnixMilli())
+	return err
+}
+
+// decodeChange decodes a value of the history, which is nil when missing.
+func decodeChange(value []byte) (interface{}, error) {
+	if value == nil {
+		return nil, nil
+	}
+	return deserializeData(ENCODING_JSON_V1, value)
+}
+
+// getAt returns the previous value of the first change after at, or the
+// current value when nothing changed since, which may have expired after at.
+func getAt(q querier, sc scope, name string, at time.Time) (interface{}, error) {
+	if err := sc.checkHistory(at); err != nil {
+		return nil, err
+	}
+	var previous []byte
+	err := q.QueryRow(SQL_CHANGED_AFTER, sc.namespace, name, at.UnixMilli()).Scan(&previous)
+	if err == nil {
+		return decodeChange(previous)
+	}
+	if err != sql.ErrNoRows {
+		return nil, err
+	}
+
+	var value []byte
+	var encoding string
+	var expiresAt sql.NullInt64
+	err = q.QueryRow(SQL_GET, sc.namespace, name).Scan(&value, &encoding, &expiresAt)
+	if err == sql.ErrNoRows || (err == nil && expiresAt.Valid && expiresAt.Int64 <= at.UnixMilli()) {
+		return nil, nil
+	}
+	if err != nil {
+		return nil, err
+	}
+	return deserializeData(encoding, value)
+}
+
+func history(q querier, sc scope, name string, limit int) ([]Change, error) {
+	rows, err := q.Query(SQL_HISTORY, sc.namespace, name, limit)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	changes := make([]Change, 0)
+	for rows.Next() {
+		var change Change
+		var value, previous []byte
+		var changedAt int64
+		if err := rows.Scan(&value, &previous, &change.Script, &changedAt); err != nil {
+			return nil, err
+		}
+		change.ChangedAt = time.UnixMilli(changedAt)
+		if change.Value, err = decodeChange(value); err != nil {
+			return nil, err
+		}
+		if change.Previous, err = decodeChange(previous); err != nil {
+			return nil, err
+		}
+		changes = append(changes, change)
+	}
+	return changes, rows.Err()
+}
+
+func checkLimits(q querier, sc scope, name string, size int64) error {
+	if err := sc.checkValueSize(name, size); err != nil {
+		return err
+	}
+	if sc.maxTotalSize <= 0 {
+		return nil
+	}
+	var total int64
+	if err := q.QueryRow(SQL_TOTAL_SIZE, sc.namespace, name).Scan(&total); err != nil {
+		return err
+	}
+	if total+size > sc.maxTotalSize {
+		// expired values still occupy space until they are swept
+		if _, err := deleteExpired(q, sc, time.Now().UnixMilli()); err != nil {
+			return err
+		}
+		if err := q.QueryRow(SQL_TOTAL_SIZE, sc.namespace, name).Scan(&total); err != nil {
+			return err
+		}
+	}
+	return sc.checkTotalSize(name, total, size)
+}
+
+func incr(q querier, sc scope, name string, delta int64) (int64, error) {
+	if err := checkName(name); err != nil {
+		return 0, err
+	}
+	// an integer takes at most 20 bytes, which only matters for the total size
+	unlimited := sc
+	unlimited.maxValueSize = 0
+	if err := checkLimits(q, unlimited, name, 20); err != nil {
+		return 0, err
+	}
+	var n int64
+	err := record(q, sc, name, func() ([]byte, bool, error) {
+		now := time.Now().UnixMilli()
+		err := q.QueryRow(SQL_INCR, name, delta, ENCODING_JSON_V1, TYPE_HINT_INTEGER, now, sc.namespace).Scan(&n)
+		if err == sql.ErrNoRows {
+			var integer bool
+			if err := q.QueryRow(SQL_IS_INTEGER, sc.namespace, name, ENCODING_JSON_V1, TYPE_HINT_INTEGER, now).Scan(&integer); err != nil {
+				return nil, false, err
+			}
+			if integer {
+				return nil, false, fmt.Errorf("%w: %s", ErrOverflow, name)
+			}
+			return nil, false, fmt.Errorf("%w: %s", ErrNotInteger, name)
+		}
+		return []byte(strconv.FormatInt(n, 10)), true, err
+	})
+	return n, err
+}
+
+func compareAndSwap(q querier, sc scope, name string, expected, value interface{}) (swapped bool, err error) {
+	if value != nil {
+		if err := checkName(name); err != nil {
+			return false, err
+		}
+	}
+	err = record(q, sc, name, func() ([]byte, bool, error) {
+		var serialized []byte
+		serialized, swapped, err = swap(q, sc, name, expected, value)
+		return serialized, swapped, err
+	})
+	return swapped, err
+}
+
+// swap is compareAndSwap without history. It returns the serialized value.
+func swap(q querier, sc scope, name string, expected, value interface{}) ([]byte, bool, error) {
+	now := time.Now().UnixMilli()
+	var serializedExpected []byte
+	if expected != nil {
+		var err error
+		if serializedExpected, _, err = serializeData(expected); err != nil {
+			return nil, false, err
+		}
+	}
+
+	if value == nil {
+		if expected == nil {
+			exists, err := has(q, sc, name)
+			return nil, !exists, err
+		}
+		res, err := q.Exec(SQL_CAS_DELETE, sc.namespace, name, serializedExpected, ENCODING_JSON_V1, now)
+		swapped, err := affected(res, err)
+		return nil, swapped, err
+	}
+
+	serialized, typeHint, err := serializeData(value)
+	if err != nil {
+		return nil, false, err
+	}
+	size := int64(len(serialized))
+	if err := checkLimits(q, sc, name, size); err != nil {
+		return nil, false, err
+	}
+	var res sql.Result
+	if expected == nil {
+		res, err = q.Exec(SQL_CAS_INSERT, sc.namespace, name, serialized, ENCODING_JSON_V1, typeHint, size, now)
+	} else {
+		res, err = q.Exec(SQL_CAS_UPDATE, serialized, ENCODING_JSON_V1, typeHint, size, sc.namespace, name, serializedExpected, ENCODING_JSON_V1, now)
+	}
+	swapped, err := affected(res, err)
+	return serialized, swapped, err
+}
+
+func affected(res sql.Result, err error) (bool, error) {
+	if err != nil {
+		return false, err
+	}
+	n, err := res.RowsAffected()
+	return n > 0, err
+}
+
+func del(q querier, sc scope, name string) error {
+	return record(q, sc, name, func() ([]byte, bool, error) {
+		res, err := q.Exec(SQL_DELETE, sc.namespace, name)
+		deleted, err := affected(res, err)
+		return nil, deleted, err
+	})
+}
+
+func has(q querier, sc scope, name string) (bool, error) {
+	var exists bool
+	err := q.QueryRow(SQL_HAS, sc.namespace, name, time.Now().UnixMilli()).Scan(&exists)
+	if err != nil {
+		return false, err
+	}
+	return exists, nil
+}
+
+func keys(q querier, sc scope, prefix string) ([]string, error) {
+	rows, err := q.Query(SQL_KEYS, prefix, time.Now().UnixMilli(), sc.namespace)
+	if err != nil {
+		return nil, err
+	}
+	return scanStrings(rows)
+}
+
+func scan(q querier, sc scope, prefix, after string, limit int) ([]Entry, error) {
+	rows, err := q.Query(SQL_SCAN, prefix, after, time.Now().UnixMilli(), limit, sc.namespace)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	entries := make([]Entry, 0, limit)
+	for rows.Next() {
+		var entry Entry
+		var value []byte
+		var encoding string
+		var expiresAt sql.NullInt64
+		if err := rows.Scan(&entry.Name, &value, &encoding, &expiresAt); err != nil {
+			return nil, err
+		}
+		if expiresAt.Valid {
+			entry.ExpiresAt = time.UnixMilli(expiresAt.Int64)
+		}
+		deserialized, err := deserializeData(encoding, value)
+		if err != nil {
+			return nil, err
+		}
+		entry.Value = deserialized
+		entries = append(entries, entry)
+	}
+	return entries, rows.Err()
+}
+
+func (s *SQLiteStore) Get(name string) (interface{}, error) {
+	return get(s.db, s.scope, name)
+}
+
+func (s *SQLiteStore) Put(name string, value interface{}) error {
+	return s.put(name, value, 0)
+}
+
+// PutWithTTL stores the value like Put, but the value expires after ttl.
+func (s *SQLiteStore) PutWithTTL(name string, value interface{}, ttl time.Duration) error {
+	if ttl <= 0 {
+		return ErrInvalidTTL
+	}
+	return s.put(name, value, ttl)
+}
+
+func (s *SQLiteStore) put(name string, value interface{}, ttl time.Duration) error {
+	err := s.write(func(q querier) error {
+		return put(q, s.scope, name, value, ttl)
+	})
+	if err == nil {
+		s.changed(name)
+	}
+	return err
+}
+
+// write runs f in a transaction when it reads before writing, so that the total
+// size is checked and the history is recorded atomically.
+func (s *SQLiteStore) write(f func(q querier) error) error {
+	if s.maxTotalSize <= 0 && !s.history {
+		return f(s.db)
+	}
+	tx, err := s.db.Begin()
+	if err != nil {
+		return err
+	}
+	defer tx.Rollback()
+	if err := f(tx); err != nil {
+		return err
+	}
+	return tx.Commit()
+}
+
+// Incr adds delta to an integer and returns the result. A missing value counts
+// as zero, and the TTL of an existing value is kept.
+func (s *SQLiteStore) Incr(name string, delta int64) (n int64, err error) {
+	err = s.write(func(q querier) error {
+		n, err = incr(q, s.scope, name, delta)
+		return err
+	})
+	if err == nil {
+		s.changed(name)
+	}
+	return n, err
+}
+
+// CompareAndSwap replaces the value with value only when it equals expected,
+// and reports whether it did. A nil expected matches a missing value, and a nil
+// value deletes.
+func (s *SQLiteStore) CompareAndSwap(name string, expected, value interface{}) (swapped bool, err error) {
+	err = s.write(func(q querier) error {
+		swapped, err = compareAndSwap(q, s.scope, name, expected, value)
+		return err
+	})
+	if err == nil && swapped {
+		s.changed(name)
+	}
+	return swapped, err
+}
+
+func (s *SQLiteStore) Delete(name string) error {
+	err := s.write(func(q querier) error {
+		return del(q, s.scope, name)
+	})
+	if err == nil {
+		s.changed(name)
+	}
+	return err
+}
+
+func (s *SQLiteStore) Has(name string) (bool, error) {
+	return has(s.db, s.scope, name)
+}
+
+// Keys returns the names starting with prefix in lexical order.
+func (s *SQLiteStore) Keys(prefix string) ([]string, error) {
+	return keys(s.db, s.scope, prefix)
+}
+
+// Scan returns at most limit entries starting with prefix whose names sort after
+// the given name. Pass the name of the last entry as after to fetch the next page.
+func (s *SQLiteStore) Scan(prefix, after string, limit int) ([]Entry, error) {
+	return scan(s.db, s.scope, prefix, after, limit)
+}
+
+func (s *SQLiteStore) History(name string, limit int) ([]Change, error) {
+	return history(s.db, s.scope, name, limit)
+}
+
+func (s *SQLiteStore) GetAt(name string, at time.Time) (interface{}, error) {
+	return getAt(s.db, s.scope, name, at)
+}
+
+// pruneHistory removes changes older than the retention of the history.
+func (s *SQLiteStore) pruneHistory(now time.Time) error {
+	if !s.history || s.historyRetention <= 0 {
+		return nil
+	}
+	_, err := s.db.Exec(SQL_PRUNE, now.Add(-s.historyRetention).UnixMilli())
+	return err
+}
+
+// DeleteExpired removes every expired value and returns the number of removed
+// rows. Changes older than the retention of the history are removed as well.
+func (s *SQLiteStore) DeleteExpired() (int64, error) {
+	now := time.Now()
+	if err := s.pruneHistory(now); err != nil {
+		return 0, err
+	}
+	var n int64
+	err := s.write(func(q querier) (err error) {
+		n, err = deleteExpired(q, s.scope, now.UnixMilli())
+		return err
+	})
+	return n, err
+}
+
+func (s *SQLiteStore) Begin() (Tx, error) {
+	tx, err := s.db.Begin()
+	if err != nil {
+		return nil, err
+	}
+	return &SQLiteTx{tx: tx, scope: s.scope, watchers: s.watchers, events: new([]event)}, nil
+}
+
+type SQLiteTx struct {
+	tx *sql.Tx
+	scope
+	// depth is the number of enclosing transactions. Nested transactions are
+	// savepoints named after their depths, and track whether they are done since
+	// the sql.Tx cannot.
+	depth int
+	done  *bool
+	// events are notified to watchers when the top-level transaction commits.
+	// marker is the number of events when a nested transaction begins.
+	watchers *watchers
+	events   *[]event
+	marker   int
+}
+
+func (st *SQLiteTx) Namespace(namespace string) Accessor {
+	view := *st
+	view.namespace = namespace
+	return &view
+}
+
+// Begin starts a nested transaction with a savepoint.
+func (st *SQLiteTx) Begin() (Tx, error) {
+	if err := st.check(); err != nil {
+		return nil, err
+	}
+	nested := &SQLiteTx{
+		tx:       st.tx,
+		scope:    st.scope,
+		depth:    st.depth + 1,
+		done:     new(bool),
+		watchers: st.watchers,
+		events:   st.events,
+		marker:   len(*st.events),
+	}
+	if _, err := st.tx.Exec("SAVEPOINT " + nested.savepoint()); err != nil {
+		return nil, err
+	}
+	return nested, nil
+}
+
+func (st *SQLiteTx) savepoint() string {
+	return fmt.Sprintf("sp%d", st.depth)
+}
+
+func (st *SQLiteTx) check() error {
+	if st.done != nil && *st.done {
+		return ErrTxDone
+	}
+	return nil
+}
+
+func (st *SQLiteTx) Rollback() error {
+	if st.depth == 0 {
+		return st.tx.Rollback()
+	}
+	if err := st.check(); err != nil {
+		return err
+	}
+	*st.done = true
+	*st.events = (*st.events)[:st.marker]
+	if _, err := st.tx.Exec("ROLLBACK TO SAVEPOINT " + st.savepoint()); err != nil {
+		return err
+	}
+	_, err := st.tx.Exec("RELEASE SAVEPOINT " + st.savepoint())
+	return err
+}
+
+func (st *SQLiteTx) Commit() error {
+	if st.depth == 0 {
+		if err := st.tx.Commit(); err != nil {
+			return err
+		}
+		st.watchers.notify(*st.events...)
+		return nil
+	}
+	if err := st.check(); err != nil {
+		return err
+	}
+	*st.done = true
+	_, err := st.tx.Exec("RELEASE SAVEPOINT " + st.savepoint())
+	return err
+}
+
+func (st *SQLiteTx) Get(name string) (interface{}, error) {
+	if err := st.check(); err != nil {
+		return nil, err
+	}
+	return get(st.tx, st.scope, name)
+}
+
+func (st *SQLiteTx) Put(name string, value interface{}) error {
+	return st.put(name, value, 0)
+}
+
+func (st *SQLiteTx) PutWithTTL(name string, value interface{}, ttl time.Duration) error {
+	if ttl <= 0 {
+		return ErrInvalidTTL
+	}
+	return st.put(name, value, ttl)
+}
+
+func (st *SQLiteTx) put(name string, value interface{}, ttl time.Duration) error {
+	if err := st.check(); err != nil {
+		return err
+	}
+	if err := put(st.tx, st.scope, name, value, ttl); err != nil {
+		return err
+	}
+	st.changed(name)
+	return nil
+}
+
+func (st *SQLiteTx) changed(name string) {
+	*st.events = append(*st.events, event{st.namespace, name})
+}
+
+func (st *SQLiteTx) Delete(name string) error {
+	if err := st.check(); err != nil {
+		return err
+	}
+	if err := del(st.tx, st.scope, name); err != nil {
+		return err
+	}
+	st.changed(name)
+	return nil
+}
+
+func (st *SQLiteTx) Has(name string) (bool, error) {
+	if err := st.check(); err != nil {
+		return false, err
+	}
+	return has(st.tx, st.scope, name)
+}
+
+func (st *SQLiteTx) Keys(prefix string) ([]string, error) {
+	if err := st.check(); err != nil {
+		return nil, err
+	}
+	return keys(st.tx, st.scope, prefix)
+}
+
+func (st *SQLiteTx) Scan(prefix, after string, limit int) ([]Entry, error) {
+	if err := st.check(); err != nil {
+		return nil, err
+	}
+	return scan(st.tx, st.scope, prefix, after, limit)
+}
+
+func (st *SQLiteTx) Incr(name string, delta int64) (int64, error) {
+	if err := st.check(); err != nil {
+		return 0, err
+	}
+	n, err := incr(st.tx, st.scope, name, delta)
+	if err != nil {
+		return 0, err
+	}
+	st.changed(name)
+	return n, nil
+}
+
+func (st *SQLiteTx) CompareAndSwap(name string, expected, value interface{}) (bool, error) {
+	if err := st.check(); err != nil {
+		return false, err
+	}
+	swapped, err := compareAndSwap(st.tx, st.scope, name, expected, value)
+	if err == nil && swapped {
+		st.changed(name)
+	}
+	return swapped, err
+}
+
+func (st *SQLiteTx) History(name string, limit int) ([]Change, error) {
+	if err := st.check(); err != nil {
+		return nil, err
+	}
+	return history(st.tx, st.scope, name, limit)
+}
+
+func (st *SQLiteTx) GetAt(name string, at time.Time) (interface{}, error) {
+	if err := st.check(); err != nil {
+		return nil, err
+	}
+	return getAt(st.tx, st.scope, name, at)
+}
@@ -1,186 +1,240 @@
 package store
 
 import (
-	"bytes"
 	"database/sql"
-	"encoding/gob"
-	"reflect"
-	"unsafe"
-
-	"github.com/golang-migrate/migrate/v4"
-	"github.com/golang-migrate/migrate/v4/database/sqlite3"
-	_ "github.com/golang-migrate/migrate/v4/source/file"
-	"github.com/golang-migrate/migrate/v4/source/iofs"
-	"github.com/henry40408/lmb/migrations"
-	_ "github.com/mattn/go-sqlite3"
+	"errors"
+	"fmt"
+	"strings"
+	"time"
 )
 
-const (
-	SQL_GET    = `SELECT value FROM store WHERE name = ?`
-	SQL_UPSERT = `INSERT OR REPLACE INTO store (name, value, type_hint, size) VALUES (?, ?, ?, ?)`
+// DefaultNamespace is the namespace of stores returned by NewStore,
+// NewMemoryStore and Open, and of values written before namespaces existed.
+const DefaultNamespace = "default"
+
+var (
+	// ErrEmptyName is returned when a value is written under the empty name,
+	// which Scan could not return since it pages by the name of the last entry.
+	ErrEmptyName  = errors.New("name must not be empty")
+	ErrInvalidTTL = errors.New("ttl must be positive")
+	ErrNotInteger = errors.New("value is not an integer")
+	ErrOverflow   = errors.New("integer overflow")
+	// ErrNoHistory is returned by GetAt when the history cannot tell the value.
+	ErrNoHistory     = errors.New("history is not available")
+	ErrQuotaExceeded = errors.New("store quota exceeded")
+	ErrValueTooLarge = errors.New("value too large")
+	// ErrTxDone is returned when a finished transaction is used.
+	ErrTxDone = sql.ErrTxDone
 )
 
-type Store struct {
-	db *sql.DB
+// Entry is a key-value pair returned by Scan. ExpiresAt is zero for entries
+// without a TTL.
+type Entry struct {
+	Name      string
+	Value     interface{}
+	ExpiresAt time.Time
 }
 
-func migrateDB(db *sql.DB) error {
-	d, err := iofs.New(migrations.MigrationFiles, ".")
-	if err != nil {
-		return err
-	}
-	defer d.Close()
-
-	driver, err := sqlite3.WithInstance(db, &sqlite3.Config{})
-	if err != nil {
-		return err
-	}
-	// defer driver.Close() // database is closed
-
-	m, err := migrate.NewWithInstance("iofs", d, "sqlite", driver)
-	if err != nil {
-		return err
-	}
-	// defer m.Close() // database is closed
+// limits are enforced on every write. Zero means unlimited.
+type limits struct {
+	maxValueSize int64
+	maxTotalSize int64
+}
 
-	if err := m.Up(); err != nil && err != migrate.ErrNoChange {
-		return err
+func checkName(name string) error {
+	if name == "" {
+		return ErrEmptyName
 	}
 	return nil
 }
 
-func NewStore(dsn string) (*Store, error) {
-	db, err := sql.Open("sqlite3", dsn)
-	if err != nil {
-		return nil, err
-	}
-
-	// https://github.com/mattn/go-sqlite3/issues/274#issuecomment-191597862
-	db.SetMaxOpenConns(1)
-
-	// https://github.com/dani-garcia/vaultwarden/blob/3dbfc484a54c41d1759646444b439da06445060b/src/db/mod.rs#L234
-	// https://github.com/dani-garcia/vaultwarden/blob/3dbfc484a54c41d1759646444b439da06445060b/src/db/mod.rs#L447
-	_, err = db.Exec(`
-    PRAGMA busy_timeout = 5000;
-    PRAGMA foreign_keys = OFF;
-    PRAGMA journal_mode = wal;
-    PRAGMA synchronous = NORMAL;
-  `)
-	if err != nil {
-		return nil, err
+func (l limits) checkValueSize(name string, size int64) error {
+	if l.maxValueSize > 0 && size > l.maxValueSize {
+		return fmt.Errorf("%w: %s is %d bytes, the limit is %d bytes", ErrValueTooLarge, name, size, l.maxValueSize)
 	}
+	return nil
+}
 
-	err = migrateDB(db)
-	if err != nil {
-		return nil, err
+// checkTotalSize checks the size of a value against the size of the other values.
+func (l limits) checkTotalSize(name string, total, size int64) error {
+	if l.maxTotalSize > 0 && total+size > l.maxTotalSize {
+		return fmt.Errorf("%w: writing %s needs %d bytes, the limit is %d bytes", ErrQuotaExceeded, name, total+size, l.maxTotalSize)
 	}
-
-	return &Store{db}, nil
+	return nil
 }
 
-func (s *Store) Close() error {
-	return s.db.Close()
+// config is shared by a store and its views.
+type config struct {
+	limits
+	// history records every change of values. Changes older than
+	// historyRetention are pruned by DeleteExpired unless it is zero.
+	history          bool
+	historyRetention time.Duration
 }
 
-func deserializeData(value []byte, target interface{}) error {
-	decoder := gob.NewDecoder(bytes.NewBuffer(value))
-	return decoder.Decode(target)
+// scope is what a view of a store reads and writes with.
+type scope struct {
+	config
+	namespace string
+	// script is recorded in the history as the author of changes.
+	script string
 }
 
-func (s *Store) Get(name string) (interface{}, error) {
-	stmt, err := s.db.Prepare(SQL_GET)
-	if err != nil {
-		return nil, err
-	}
-	var value []byte
-	err = stmt.QueryRow(&name).Scan(&value)
-	if err != nil {
-		if err == sql.ErrNoRows {
-			return nil, nil
-		} else {
-			return nil, err
-		}
+// Option configures a store.
+type Option func(*config)
+
+// WithMaxValueSize limits the serialized size of a single value in bytes.
+func WithMaxValueSize(size int64) Option {
+	return func(c *config) {
+		c.maxValueSize = size
 	}
-	var deserialized interface{}
-	err = deserializeData(value, &deserialized)
-	if err != nil {
-		return nil, err
+}
+
+// WithMaxTotalSize limits the serialized size of all values in bytes.
+func WithMaxTotalSize(size int64) Option {
+	return func(c *config) {
+		c.maxTotalSize = size
 	}
-	return deserialized, nil
 }
 
-func serializeData(data interface{}) []byte {
-	var buffer bytes.Buffer
-	encoder := gob.NewEncoder(&buffer)
-	encoder.Encode(data)
-	return buffer.Bytes()
+// WithHistory records every change of values, which History returns. Changes
+// older than retention are pruned by DeleteExpired, and zero keeps them forever.
+func WithHistory(retention time.Duration) Option {
+	return func(c *config) {
+		c.history = true
+		c.historyRetention = retention
+	}
 }
 
-func (s *Store) Put(name string, value interface{}) error {
-	stmt, err := s.db.Prepare(SQL_UPSERT)
-	if err != nil {
-		return err
+// checkHistory reports whether every change after at is recorded, so that the
+// value as of at can be told.
+func (c config) checkHistory(at time.Time) error {
+	if !c.history {
+		return fmt.Errorf("%w: the store does not record history", ErrNoHistory)
 	}
-	serialized := serializeData(&value)
-	_, err = stmt.Exec(&name, serialized, reflect.TypeOf(value).Name(), int64(unsafe.Sizeof(value)))
-	if err != nil {
-		return err
+	if c.historyRetention > 0 && at.Before(time.Now().Add(-c.historyRetention)) {
+		return fmt.Errorf("%w: changes older than %s are pruned", ErrNoHistory, c.historyRetention)
 	}
 	return nil
 }
 
-func (s *Store) Begin() (*StoreTx, error) {
-	tx, err := s.db.Begin()
-	if err != nil {
-		return nil, err
-	}
-	return &StoreTx{tx}, nil
+// Change is a change of a value recorded in the history. Value is nil when the
+// value was deleted, and Previous is nil when the value was missing. Expired
+// values are recorded as deleted without a script when they are removed, at the
+// time they expired.
+type Change struct {
+	Value     interface{}
+	Previous  interface{}
+	Script    string
+	ChangedAt time.Time
 }
 
-type StoreTx struct {
-	tx *sql.Tx
+// Accessor reads and writes values. It is implemented by both stores and
+// transactions. Get returns nil for missing and expired values, and Put with a
+// nil value is rejected, as are writes under the empty name.
+type Accessor interface {
+	Get(name string) (interface{}, error)
+	Put(name string, value interface{}) error
+	// PutWithTTL stores the value like Put, but the value expires after ttl.
+	PutWithTTL(name string, value interface{}, ttl time.Duration) error
+	Delete(name string) error
+	Has(name string) (bool, error)
+	// Keys returns the names starting with prefix in lexical order.
+	Keys(prefix string) ([]string, error)
+	// Scan returns at most limit entries starting with prefix whose names sort
+	// after the given name. Pass the name of the last entry as after to fetch the
+	// next page.
+	Scan(prefix, after string, limit int) ([]Entry, error)
+	// Incr adds delta to an integer and returns the result. A missing value
+	// counts as zero, and the TTL of an existing value is kept. It fails with
+	// ErrOverflow instead of wrapping around.
+	Incr(name string, delta int64) (int64, error)
+	// CompareAndSwap replaces the value with value only when it equals expected,
+	// and reports whether it did. A nil expected matches a missing value, and a
+	// nil value deletes. Swapped values no longer expire.
+	CompareAndSwap(name string, expected, value interface{}) (bool, error)
+	// History returns at most limit changes of the value from the newest to the
+	// oldest. It is empty unless the store records history.
+	History(name string, limit int) ([]Change, error)
+	// GetAt returns the value as it was at the given time according to the
+	// history, which is the previous value of the first change after at, or the
+	// current value when it has not changed since. It fails with ErrNoHistory
+	// unless the store records history and keeps changes since at.
+	GetAt(name string, at time.Time) (interface{}, error)
 }
 
-func (st *StoreTx) Rollback() error {
-	return st.tx.Rollback()
+// Store is a key-value store backend. Values live in namespaces, so that the
+// same name in different namespaces refers to different values. Limits apply
+// to all namespaces together.
+type Store interface {
+	Accessor
+	Begin() (Tx, error)
+	// Namespace returns a view of the same store which reads and writes values in
+	// namespace. Closing a view closes the store.
+	Namespace(namespace string) Store
+	// Script returns a view of the same store which records script as the author
+	// of changes in the history.
+	Script(script string) Store
+	// Watch returns a channel receiving the names of values in the namespace of
+	// the view starting with prefix whenever they are written or deleted, after
+	// the change is committed. Names are dropped instead of blocking writers when
+	// the channel is full. cancel, or closing the store, closes the channel. Only
+	// changes made through the store in this process are notified.
+	Watch(prefix string) (names <-chan string, cancel func())
+	// Namespaces returns the namespaces holding values in lexical order.
+	Namespaces() ([]string, error)
+	// SharedNamespace returns the namespace which scripts share unless told
+	// otherwise, or an empty string when each script has its own. Databases
+	// holding values before namespaces existed share DefaultNamespace.
+	SharedNamespace() string
+	// DeleteExpired removes every expired value in every namespace and returns
+	// the number of removed values. It prunes the history as well.
+	DeleteExpired() (int64, error)
+	Close() error
 }
 
-func (st *StoreTx) Commit() error {
-	return st.tx.Commit()
+// Tx is a transaction of a Store.
+type Tx interface {
+	Accessor
+	// Namespace returns a view of the same transaction which reads and writes
+	// values in namespace.
+	Namespace(namespace string) Accessor
+	// Begin starts a nested transaction. Committing it keeps its writes in this
+	// transaction, while rolling it back undoes them. Writes through this
+	// transaction before the nested one finishes belong to the nested one.
+	Begin() (Tx, error)
+	Commit() error
+	Rollback() error
 }
 
-func (st *StoreTx) Get(name string) (interface{}, error) {
-	stmt, err := st.tx.Prepare(SQL_GET)
-	if err != nil {
-		return nil, err
-	}
-	var value []byte
-	err = stmt.QueryRow(&name).Scan(&value)
-	if err != nil {
-		if err == sql.ErrNoRows {
-			return nil, nil
-		} else {
-			return nil, err
-		}
-	}
-	var deserialized interface{}
-	err = deserializeData(value, &deserialized)
-	if err != nil {
-		return nil, err
-	}
-	return deserialized, nil
+// Opener opens a store from the part of a URL after "scheme://".
+type Opener func(dsn string, options ...Option) (Store, error)
 
+var openers = map[string]Opener{
+	"memory": func(dsn string, options ...Option) (Store, error) {
+		return NewMemoryStore(options...), nil
+	},
+	"sqlite": func(dsn string, options ...Option) (Store, error) {
+		return NewStore(dsn, options...)
+	},
 }
 
-func (st *StoreTx) Put(name string, value interface{}) error {
-	stmt, err := st.tx.Prepare(SQL_UPSERT)
-	if err != nil {
-		return err
+// Register makes a backend available to Open under scheme. It is meant to be
+// called during initialization.
+func Register(scheme string, opener Opener) {
+	openers[scheme] = opener
+}
+
+// Open opens a store from a URL, e.g. sqlite://db.sqlite3, sqlite:///var/lib/lmb.sqlite3
+// or memory://.
+func Open(url string, options ...Option) (Store, error) {
+	scheme, dsn, ok := strings.Cut(url, "://")
+	if !ok {
+		return nil, fmt.Errorf("invalid store URL %q, expect scheme://", url)
 	}
-	serialized := serializeData(&value)
-	_, err = stmt.Exec(&name, serialized, reflect.TypeOf(value).Name(), int64(unsafe.Sizeof(value)))
-	if err != nil {
-		return err
+	opener, ok := openers[scheme]
+	if !ok {
+		return nil, fmt.Errorf("unsupported store URL %q", url)
 	}
-	return nil
+	return opener(dsn, options...)
 }
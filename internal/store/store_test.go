@@ -0,0 +1,320 @@
+package store
+
+import (
+	"bytes"
+	"database/sql"
+	"encoding/gob"
+	"fmt"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"github.com/golang-migrate/migrate/v4"
+	"github.com/golang-migrate/migrate/v4/database/sqlite3"
+	"github.com/golang-migrate/migrate/v4/source/iofs"
+	"github.com/henry40408/lmb/migrations"
+	"github.com/rs/zerolog"
+	"github.com/rs/zerolog/log"
+	"github.com/stretchr/testify/assert"
+)
+
+func TestPutWithTTL(t *testing.T) {
+	s, err := NewStore(":memory:")
+	assert.NoError(t, err)
+	defer s.Close()
+
+	assert.ErrorIs(t, s.PutWithTTL("a", int64(1), 0), ErrInvalidTTL)
+
+	assert.NoError(t, s.PutWithTTL("a", int64(1), 50*time.Millisecond))
+	assert.NoError(t, s.PutWithTTL("b", int64(2), time.Hour))
+	assert.NoError(t, s.Put("c", int64(3)))
+
+	entries, err := s.Scan("", "", 10)
+	assert.NoError(t, err)
+	assert.Len(t, entries, 3)
+	assert.False(t, entries[1].ExpiresAt.IsZero())
+	assert.True(t, entries[2].ExpiresAt.IsZero())
+
+	time.Sleep(100 * time.Millisecond)
+
+	value, err := s.Get("a")
+	assert.NoError(t, err)
+	assert.Nil(t, value)
+
+	// putting without TTL clears the previous expiration
+	assert.NoError(t, s.Put("b", int64(2)))
+	entries, err = s.Scan("b", "", 10)
+	assert.NoError(t, err)
+	assert.True(t, entries[0].ExpiresAt.IsZero())
+}
+
+func TestDeleteExpired(t *testing.T) {
+	s, err := NewStore(":memory:")
+	assert.NoError(t, err)
+	defer s.Close()
+
+	assert.NoError(t, s.PutWithTTL("a", int64(1), 50*time.Millisecond))
+	assert.NoError(t, s.PutWithTTL("b", int64(2), 50*time.Millisecond))
+	assert.NoError(t, s.Put("c", int64(3)))
+
+	time.Sleep(100 * time.Millisecond)
+
+	n, err := s.DeleteExpired()
+	assert.NoError(t, err)
+	assert.Equal(t, int64(2), n)
+
+	var count int
+	assert.NoError(t, s.db.QueryRow(`SELECT COUNT(*) FROM store`).Scan(&count))
+	assert.Equal(t, 1, count)
+}
+
+func TestEncoding(t *testing.T) {
+	s, err := NewStore(":memory:")
+	assert.NoError(t, err)
+	defer s.Close()
+
+	values := map[string]interface{}{
+		"array":   []interface{}{int64(1), "a"},
+		"boolean": true,
+		"integer": int64(1),
+		"number":  1.5,
+		"string":  "a",
+		"table":   map[string]interface{}{"a": int64(1), "b": []interface{}{2.5}},
+	}
+	for name, value := range values {
+		assert.NoError(t, s.Put(name, value))
+
+		actual, err := s.Get(name)
+		assert.NoError(t, err)
+		assert.Equal(t, value, actual)
+
+		var encoding, typeHint string
+		assert.NoError(t, s.db.QueryRow(`SELECT encoding, type_hint FROM store WHERE name = ?`, name).Scan(&encoding, &typeHint))
+		assert.Equal(t, ENCODING_JSON_V1, encoding)
+		assert.Equal(t, name, typeHint)
+	}
+
+	assert.Error(t, s.Put("nil", nil))
+}
+
+func TestUpgradeLegacyRows(t *testing.T) {
+	s, err := NewStore(":memory:")
+	assert.NoError(t, err)
+	defer s.Close()
+
+	var value interface{} = map[string]interface{}{"a": int64(1)}
+	var buf bytes.Buffer
+	assert.NoError(t, gob.NewEncoder(&buf).Encode(&value))
+	_, err = s.db.Exec(`INSERT INTO store (name, value, encoding, type_hint, size) VALUES ('a', ?, 'gob', '', 0)`, buf.Bytes())
+	assert.NoError(t, err)
+
+	// legacy rows are readable before they are upgraded
+	actual, err := s.Get("a")
+	assert.NoError(t, err)
+	assert.Equal(t, value, actual)
+
+	assert.NoError(t, upgradeLegacyRows(s.db))
+
+	var encoding, typeHint string
+	var serialized []byte
+	assert.NoError(t, s.db.QueryRow(`SELECT value, encoding, type_hint FROM store WHERE name = 'a'`).Scan(&serialized, &encoding, &typeHint))
+	assert.Equal(t, ENCODING_JSON_V1, encoding)
+	assert.Equal(t, TYPE_HINT_TABLE, typeHint)
+	assert.Equal(t, `{"a":1}`, string(serialized))
+
+	actual, err = s.Get("a")
+	assert.NoError(t, err)
+	assert.Equal(t, value, actual)
+}
+
+func TestUpgradeLegacyRowsInvalid(t *testing.T) {
+	var buf bytes.Buffer
+	logger := log.Logger
+	log.Logger = zerolog.New(&buf)
+	defer func() { log.Logger = logger }()
+
+	s, err := NewStore(":memory:")
+	assert.NoError(t, err)
+	defer s.Close()
+	res, err := s.db.Exec(`INSERT INTO store (name, value, encoding, type_hint, size) VALUES ('a', X'00', 'gob', '', 0)`)
+	assert.NoError(t, err)
+	id, err := res.LastInsertId()
+	assert.NoError(t, err)
+
+	// invalid rows are logged and left untouched
+	assert.NoError(t, upgradeLegacyRows(s.db))
+	assert.Contains(t, buf.String(), fmt.Sprintf(`"id":%d`, id))
+	assert.Contains(t, buf.String(), "cannot decode legacy value")
+	var encoding string
+	assert.NoError(t, s.db.QueryRow(`SELECT encoding FROM store WHERE name = 'a'`).Scan(&encoding))
+	assert.Equal(t, ENCODING_GOB, encoding)
+}
+
+func TestSize(t *testing.T) {
+	s, err := NewStore(":memory:")
+	assert.NoError(t, err)
+	defer s.Close()
+
+	assert.NoError(t, s.Put("a", "hello"))
+
+	var size int64
+	assert.NoError(t, s.db.QueryRow(`SELECT size FROM store WHERE name = 'a'`).Scan(&size))
+	assert.Equal(t, int64(len(`"hello"`)), size)
+}
+
+func TestMaxValueSize(t *testing.T) {
+	s, err := NewStore(":memory:", WithMaxValueSize(8))
+	assert.NoError(t, err)
+	defer s.Close()
+
+	assert.NoError(t, s.Put("a", "123456"))
+	assert.ErrorIs(t, s.Put("a", "1234567"), ErrValueTooLarge)
+
+	tx, err := s.Begin()
+	assert.NoError(t, err)
+	defer tx.Rollback()
+	assert.ErrorIs(t, tx.Put("b", "1234567"), ErrValueTooLarge)
+}
+
+func TestMaxTotalSize(t *testing.T) {
+	s, err := NewStore(":memory:", WithMaxTotalSize(10))
+	assert.NoError(t, err)
+	defer s.Close()
+
+	assert.NoError(t, s.Put("a", "123")) // 5 bytes
+	assert.NoError(t, s.Put("b", "123")) // 5 bytes
+	assert.NoError(t, s.Put("b", "1"))   // replacing a value frees its size
+	assert.ErrorIs(t, s.Put("c", "1234"), ErrQuotaExceeded)
+	assert.NoError(t, s.Put("c", ""))
+
+	tx, err := s.Begin()
+	assert.NoError(t, err)
+	defer tx.Rollback()
+	assert.ErrorIs(t, tx.Put("d", "1"), ErrQuotaExceeded)
+	assert.NoError(t, tx.Delete("a"))
+	assert.NoError(t, tx.Put("d", "1"))
+	assert.NoError(t, tx.Commit())
+}
+
+func TestMaxTotalSizeWithExpiredValues(t *testing.T) {
+	s, err := NewStore(":memory:", WithMaxTotalSize(10))
+	assert.NoError(t, err)
+	defer s.Close()
+
+	assert.NoError(t, s.PutWithTTL("a", "123", 50*time.Millisecond))
+	assert.NoError(t, s.Put("b", "123"))
+	time.Sleep(100 * time.Millisecond)
+
+	// expired values are removed to make room
+	assert.NoError(t, s.Put("c", "123"))
+}
+
+// newMigrate returns a migrator of the database at dsn.
+func newMigrate(t *testing.T, dsn string) (*migrate.Migrate, *sql.DB) {
+	db, err := sql.Open("sqlite3", dsn)
+	assert.NoError(t, err)
+	d, err := iofs.New(migrations.MigrationFiles, ".")
+	assert.NoError(t, err)
+	driver, err := sqlite3.WithInstance(db, &sqlite3.Config{})
+	assert.NoError(t, err)
+	m, err := migrate.NewWithInstance("iofs", d, "sqlite", driver)
+	assert.NoError(t, err)
+	return m, db
+}
+
+func TestMigrateNamespace(t *testing.T) {
+	dsn := filepath.Join(t.TempDir(), "db.sqlite3")
+	m, db := newMigrate(t, dsn)
+	assert.NoError(t, m.Migrate(4))
+	_, err := db.Exec(`INSERT INTO store (name, value, encoding, type_hint, size) VALUES ('a', X'31', 'json-v1', 'integer', 1)`)
+	assert.NoError(t, err)
+	assert.NoError(t, db.Close())
+
+	s, err := NewStore(dsn)
+	assert.NoError(t, err)
+	defer s.Close()
+	value, err := s.Namespace(DefaultNamespace).Get("a")
+	assert.NoError(t, err)
+	assert.Equal(t, int64(1), value)
+	assert.NoError(t, s.Namespace("other").Put("a", int64(2)))
+	value, err = s.Get("a")
+	assert.NoError(t, err)
+	assert.Equal(t, int64(1), value)
+	// scripts keep sharing the default namespace
+	assert.Equal(t, DefaultNamespace, s.SharedNamespace())
+}
+
+func TestSharedNamespace(t *testing.T) {
+	dsn := filepath.Join(t.TempDir(), "db.sqlite3")
+	m, db := newMigrate(t, dsn)
+	assert.NoError(t, m.Migrate(4))
+	assert.NoError(t, db.Close())
+
+	// databases without values before namespaces existed do not share
+	s, err := NewStore(dsn)
+	assert.NoError(t, err)
+	defer s.Close()
+	assert.Empty(t, s.SharedNamespace())
+	assert.Empty(t, NewMemoryStore().SharedNamespace())
+}
+
+func TestMigrateNamespaceDown(t *testing.T) {
+	dsn := filepath.Join(t.TempDir(), "db.sqlite3")
+	s, err := NewStore(dsn)
+	assert.NoError(t, err)
+	assert.NoError(t, s.Put("a", int64(1)))
+	assert.NoError(t, s.Namespace("other").Put("a", int64(2)))
+	assert.NoError(t, s.Close())
+
+	m, db := newMigrate(t, dsn)
+	defer db.Close()
+	// values of other namespaces are not dropped
+	assert.ErrorContains(t, m.Migrate(4), "values_of_other_namespaces_must_be_deleted")
+	var count int
+	assert.NoError(t, db.QueryRow(`SELECT COUNT(*) FROM store`).Scan(&count))
+	assert.Equal(t, 2, count)
+
+	_, err = db.Exec(`DELETE FROM store WHERE namespace <> 'default'`)
+	assert.NoError(t, err)
+	// the failed migration leaves the database dirty at the schema of 0005
+	assert.NoError(t, m.Force(5))
+	assert.NoError(t, m.Migrate(4))
+	var name string
+	assert.NoError(t, db.QueryRow(`SELECT name FROM store`).Scan(&name))
+	assert.Equal(t, "a", name)
+}
+
+func TestMigrateEncodingDown(t *testing.T) {
+	dsn := filepath.Join(t.TempDir(), "db.sqlite3")
+	s, err := NewStore(dsn)
+	assert.NoError(t, err)
+	assert.NoError(t, s.Put("a", int64(1)))
+	assert.NoError(t, s.Close())
+
+	m, db := newMigrate(t, dsn)
+	defer db.Close()
+	// older binaries would decode JSON values as gob
+	assert.ErrorContains(t, m.Migrate(2), "json_values_must_be_deleted")
+
+	_, err = db.Exec(`DELETE FROM store`)
+	assert.NoError(t, err)
+	// the failed migration leaves the database dirty at the schema of 0003
+	assert.NoError(t, m.Force(3))
+	assert.NoError(t, m.Migrate(2))
+}
+
+func TestHistoryPrunedOnOpen(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "db.sqlite3")
+	s, err := NewStore(path, WithHistory(0))
+	assert.NoError(t, err)
+	assert.NoError(t, s.Put("a", int64(1)))
+	assert.NoError(t, s.Close())
+
+	time.Sleep(50 * time.Millisecond)
+	s, err = NewStore(path, WithHistory(10*time.Millisecond))
+	assert.NoError(t, err)
+	defer s.Close()
+	changes, err := s.History("a", 10)
+	assert.NoError(t, err)
+	assert.Empty(t, changes)
+}
@@ -0,0 +1,82 @@
+package store
+
+import (
+	"strings"
+	"sync"
+)
+
+// watchBuffer is the number of names a watcher holds before dropping more.
+const watchBuffer = 16
+
+// event is a committed change of a value.
+type event struct {
+	namespace, name string
+}
+
+type watcher struct {
+	namespace, prefix string
+	names             chan string
+}
+
+// watchers notifies watchers of committed changes. It is shared by a store and
+// its views.
+type watchers struct {
+	mu     sync.Mutex
+	set    map[*watcher]struct{}
+	closed bool
+}
+
+func newWatchers() *watchers {
+	return &watchers{set: make(map[*watcher]struct{})}
+}
+
+func (ws *watchers) watch(namespace, prefix string) (<-chan string, func()) {
+	w := &watcher{namespace: namespace, prefix: prefix, names: make(chan string, watchBuffer)}
+	ws.mu.Lock()
+	defer ws.mu.Unlock()
+	if ws.closed {
+		close(w.names)
+		return w.names, func() {}
+	}
+	ws.set[w] = struct{}{}
+	return w.names, func() {
+		ws.mu.Lock()
+		defer ws.mu.Unlock()
+		if _, ok := ws.set[w]; ok {
+			delete(ws.set, w)
+			close(w.names)
+		}
+	}
+}
+
+// notify sends the names of changed values to matching watchers without
+// blocking. Watchers which are full miss the names.
+func (ws *watchers) notify(events ...event) {
+	if len(events) == 0 {
+		return
+	}
+	ws.mu.Lock()
+	defer ws.mu.Unlock()
+	for w := range ws.set {
+		for _, e := range events {
+			if e.namespace != w.namespace || !strings.HasPrefix(e.name, w.prefix) {
+				continue
+			}
+			select {
+			case w.names <- e.name:
+			default:
+			}
+		}
+	}
+}
+
+// close closes the channels of every watcher, and of watchers started later.
+func (ws *watchers) close() {
+	ws.mu.Lock()
+	defer ws.mu.Unlock()
+	ws.closed = true
+	for w := range ws.set {
+		close(w.names)
+	}
+	clear(ws.set)
+}
@@ -1,3 +1,4 @@
+local io = require("io")
 local json = require("json")
 
 local m = require("@lmb")
@@ -10,6 +11,22 @@ for key, values in pairs(m.state.request["headers"]) do
 	end
 end
 
+print(string.format("raw query = %s", m.state.request["raw_query"]))
+for key, values in pairs(m.state.request["query"]) do
+	for _, value in pairs(values) do
+		print(string.format("query %s = %s", key, value))
+	end
+end
+
+for name, value in pairs(m.state.request["params"]) do
+	print(string.format("param %s = %s", name, value))
+end
+
+local body = io.read("*a")
+if body then
+	print(string.format("body = %s", body))
+end
+
 m.state.status_code = 418
 m.state.headers = {
 	["content-type"] = "application/json",
@@ -0,0 +1,14 @@
+-- run with: lmb serve --stream --file lua-examples/09-server-sent-events.lua
+local io = require("io")
+
+local m = require("@lmb")
+
+m.state.headers = {
+	["cache-control"] = "no-cache",
+	["content-type"] = "text/event-stream",
+}
+
+for i = 1, 3 do
+	io.write(string.format("id: %d\ndata: event %d\n\n", i, i))
+	m.response:flush()
+end
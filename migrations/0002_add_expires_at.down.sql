@@ -0,0 +1,2 @@
+DROP INDEX store_expires_at;
+ALTER TABLE store DROP COLUMN expires_at;
@@ -0,0 +1,2 @@
+ALTER TABLE store ADD COLUMN expires_at INTEGER;
+CREATE INDEX store_expires_at ON store (expires_at);
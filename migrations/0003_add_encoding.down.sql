@@ -0,0 +1,12 @@
+-- Binaries before this migration decode every value as gob, so the migration
+-- fails instead of leaving JSON values they cannot read. Since the store
+-- rewrites values as JSON when it opens the database, only an empty store can
+-- be downgraded. To downgrade anyway, export values with lmb store export and
+-- delete them first. The export can be imported with lmb store import after
+-- upgrading again.
+CREATE TEMP TABLE downgrade_guard (
+  json_values INTEGER NOT NULL CONSTRAINT json_values_must_be_deleted CHECK (json_values = 0)
+);
+INSERT INTO downgrade_guard SELECT COUNT(*) FROM store WHERE encoding <> 'gob';
+DROP TABLE downgrade_guard;
+ALTER TABLE store DROP COLUMN encoding;
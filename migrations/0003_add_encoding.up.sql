@@ -0,0 +1,3 @@
+-- Rows written before this migration are gob-encoded. They are rewritten as
+-- JSON by the store when it opens the database.
+ALTER TABLE store ADD COLUMN encoding TEXT NOT NULL DEFAULT 'gob';
@@ -0,0 +1,2 @@
+-- The previous sizes were meaningless, so there is nothing to restore.
+SELECT 1;
@@ -0,0 +1,2 @@
+-- Sizes used to be the size of an interface header rather than of the value.
+UPDATE store SET size = length(value);
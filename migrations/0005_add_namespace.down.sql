@@ -0,0 +1,25 @@
+-- Names of other namespaces may collide with names of the default namespace,
+-- so the migration fails instead of dropping their values. Delete values of
+-- other namespaces first, e.g. after exporting them with lmb store export.
+CREATE TEMP TABLE downgrade_guard (
+  other_namespaces INTEGER NOT NULL CONSTRAINT values_of_other_namespaces_must_be_deleted CHECK (other_namespaces = 0)
+);
+INSERT INTO downgrade_guard SELECT COUNT(*) FROM store WHERE namespace <> 'default';
+DROP TABLE downgrade_guard;
+CREATE TABLE store_old (
+  id INTEGER NOT NULL PRIMARY KEY AUTOINCREMENT,
+  name TEXT NOT NULL UNIQUE,
+  value BLOB NOT NULL,
+  size INTEGER NOT NULL,
+  type_hint TEXT NOT NULL,
+  created_at TEXT NOT NULL DEFAULT CURRENT_TIMESTAMP,
+  updated_at TEXT NOT NULL DEFAULT CURRENT_TIMESTAMP,
+  expires_at INTEGER,
+  encoding TEXT NOT NULL DEFAULT 'gob'
+) STRICT;
+INSERT INTO store_old (id, name, value, size, type_hint, created_at, updated_at, expires_at, encoding)
+  SELECT id, name, value, size, type_hint, created_at, updated_at, expires_at, encoding FROM store WHERE namespace = 'default';
+DROP TABLE store;
+ALTER TABLE store_old RENAME TO store;
+CREATE INDEX store_expires_at ON store (expires_at);
+DROP TABLE store_settings;
@@ -0,0 +1,27 @@
+-- Names are unique per namespace. Existing values belong to the default namespace.
+-- SQLite cannot drop the unique constraint of name, so the table is rebuilt.
+CREATE TABLE store_new (
+  id INTEGER NOT NULL PRIMARY KEY AUTOINCREMENT,
+  namespace TEXT NOT NULL DEFAULT 'default',
+  name TEXT NOT NULL,
+  value BLOB NOT NULL,
+  size INTEGER NOT NULL,
+  type_hint TEXT NOT NULL,
+  created_at TEXT NOT NULL DEFAULT CURRENT_TIMESTAMP,
+  updated_at TEXT NOT NULL DEFAULT CURRENT_TIMESTAMP,
+  expires_at INTEGER,
+  encoding TEXT NOT NULL DEFAULT 'gob',
+  UNIQUE (namespace, name)
+) STRICT;
+INSERT INTO store_new (id, name, value, size, type_hint, created_at, updated_at, expires_at, encoding)
+  SELECT id, name, value, size, type_hint, created_at, updated_at, expires_at, encoding FROM store;
+DROP TABLE store;
+ALTER TABLE store_new RENAME TO store;
+CREATE INDEX store_expires_at ON store (expires_at);
+-- Scripts of databases holding values before namespaces existed keep sharing
+-- the default namespace, so that upgrading does not hide their values.
+CREATE TABLE store_settings (
+  name TEXT NOT NULL PRIMARY KEY,
+  value TEXT NOT NULL
+) STRICT;
+INSERT INTO store_settings (name, value) SELECT 'shared_namespace', 'default' WHERE EXISTS (SELECT 1 FROM store);
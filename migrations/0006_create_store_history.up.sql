@@ -0,0 +1,12 @@
+-- Values are JSON-encoded, and NULL when the value was missing or deleted.
+CREATE TABLE store_history (
+  id INTEGER NOT NULL PRIMARY KEY AUTOINCREMENT,
+  namespace TEXT NOT NULL,
+  name TEXT NOT NULL,
+  value BLOB,
+  previous BLOB,
+  script TEXT NOT NULL,
+  created_at INTEGER NOT NULL
+) STRICT;
+CREATE INDEX store_history_name ON store_history (namespace, name, id);
+CREATE INDEX store_history_created_at ON store_history (created_at);
@@ -0,0 +1,257 @@
+// Package lmb embeds the Lua runtime of lmb in Go programs.
+//
+//	runtime, err := lmb.NewRuntime()
+//	if err != nil {
+//		return err
+//	}
+//	defer runtime.Close()
+//
+//	script, err := runtime.Compile(strings.NewReader("return 1 + 1"), "add.lua")
+//	if err != nil {
+//		return err
+//	}
+//	result, err := runtime.Eval(ctx, script, lmb.Input{})
+package lmb
+
+import (
+	"context"
+	"io"
+	"net/http"
+	"sync"
+
+	"github.com/henry40408/lmb/internal/eval_context"
+	"github.com/henry40408/lmb/internal/http_policy"
+	"github.com/henry40408/lmb/internal/store"
+	lua "github.com/yuin/gopher-lua"
+)
+
+type (
+	// Store is a key-value store backend available to scripts as m.store.
+	Store    = store.Store
+	Tx       = store.Tx
+	Accessor = store.Accessor
+	Entry    = store.Entry
+	Change   = store.Change
+
+	// EvalError is returned by Compile and Eval when a script fails.
+	EvalError = eval_context.EvalError
+	ErrorKind = eval_context.ErrorKind
+	// LimitError is wrapped by EvalError when a script exceeds a limit.
+	LimitError = eval_context.LimitError
+)
+
+const (
+	ErrorKindSyntax        = eval_context.ErrorKindSyntax
+	ErrorKindRuntime       = eval_context.ErrorKindRuntime
+	ErrorKindTimeout       = eval_context.ErrorKindTimeout
+	ErrorKindCanceled      = eval_context.ErrorKindCanceled
+	ErrorKindResourceLimit = eval_context.ErrorKindResourceLimit
+)
+
+var (
+	ErrInstructionLimit = eval_context.ErrInstructionLimit
+	ErrMemoryLimit      = eval_context.ErrMemoryLimit
+	ErrStackLimit       = eval_context.ErrStackLimit
+)
+
+// OpenStore opens a store from a URL, e.g. sqlite://db.sqlite3 or memory://.
+func OpenStore(url string) (Store, error) {
+	return store.Open(url)
+}
+
+type config struct {
+	store      Store
+	httpClient *http.Client
+	httpAllow  []string
+	httpDeny   []string
+	options    []eval_context.Option
+}
+
+type Option func(*config)
+
+// WithStore sets the store of scripts. The runtime does not close it. Without
+// this option, scripts use an in-memory store owned by the runtime.
+func WithStore(s Store) Option {
+	return func(c *config) {
+		c.store = s
+	}
+}
+
+// WithStoreNamespaces allows scripts to open other namespaces of the store with
+// m.store:namespace(name). "*" allows every namespace. Scripts use the
+// namespace of the store given to WithStore, see Store.Namespace.
+func WithStoreNamespaces(namespaces ...string) Option {
+	return func(c *config) {
+		c.options = append(c.options, eval_context.WithStoreNamespaces(namespaces...))
+	}
+}
+
+// WithStoreWatchContext ends every m.store:watch when ctx is done as if nothing
+// changed, e.g. when a server embedding the runtime shuts down.
+func WithStoreWatchContext(ctx context.Context) Option {
+	return func(c *config) {
+		c.options = append(c.options, eval_context.WithStoreWatchContext(ctx))
+	}
+}
+
+// WithHTTPClient sets the client used by the http module. Requests are still
+// checked by the policy, see WithHTTPPolicy: an *http.Transport is cloned to
+// connect only to checked addresses and without its proxy, while other
+// transports only get host names resolved and checked before each request.
+func WithHTTPClient(client *http.Client) Option {
+	return func(c *config) {
+		c.httpClient = client
+	}
+}
+
+// WithHTTPPolicy restricts the hosts that the http module can connect to. The
+// patterns are host names, wildcard host names e.g. *.example.com, IPs and
+// CIDRs. Loopback, link-local and cloud metadata addresses are refused unless
+// allowed explicitly, with or without this option.
+func WithHTTPPolicy(allow, deny []string) Option {
+	return func(c *config) {
+		c.httpAllow = allow
+		c.httpDeny = deny
+	}
+}
+
+// WithMaxInstructions limits the number of Lua instructions an evaluation can
+// execute.
+func WithMaxInstructions(n int64) Option {
+	return func(c *config) {
+		c.options = append(c.options, eval_context.WithMaxInstructions(n))
+	}
+}
+
+// WithMaxMemory limits the estimated size of the Lua values an evaluation holds
+// in bytes. Evaluations running concurrently do not count towards each other.
+func WithMaxMemory(size int64) Option {
+	return func(c *config) {
+		c.options = append(c.options, eval_context.WithMaxMemory(size))
+	}
+}
+
+// WithMaxStackSize limits the number of values on the Lua stack of an
+// evaluation, which grows on demand up to size.
+func WithMaxStackSize(size int) Option {
+	return func(c *config) {
+		c.options = append(c.options, eval_context.WithMaxStackSize(size))
+	}
+}
+
+// WithPoolSize sets how many idle Lua states are kept for reuse. Zero disables
+// pooling.
+func WithPoolSize(size int) Option {
+	return func(c *config) {
+		c.options = append(c.options, eval_context.WithPoolSize(size))
+	}
+}
+
+// WithModule makes a Go module available to scripts with require(name).
+func WithModule(name string, loader lua.LGFunction) Option {
+	return func(c *config) {
+		c.options = append(c.options, eval_context.WithModule(name, loader))
+	}
+}
+
+// Runtime compiles and evaluates scripts. It is safe for concurrent use.
+type Runtime struct {
+	e        *eval_context.EvalContext
+	store    Store
+	ownStore bool
+}
+
+func NewRuntime(options ...Option) (*Runtime, error) {
+	c := &config{}
+	for _, option := range options {
+		option(c)
+	}
+
+	policy, err := http_policy.NewPolicy(c.httpAllow, c.httpDeny)
+	if err != nil {
+		return nil, err
+	}
+
+	r := &Runtime{store: c.store}
+	if r.store == nil {
+		r.store, r.ownStore = store.NewMemoryStore(), true
+	}
+	evalOptions := append(c.options, eval_context.WithHttpPolicy(policy))
+	r.e = eval_context.NewEvalContext(r.store, c.httpClient, evalOptions...)
+	return r, nil
+}
+
+// Close releases the runtime, and closes the store unless it was set with
+// WithStore.
+func (r *Runtime) Close() error {
+	r.e.Close()
+	if r.ownStore {
+		return r.store.Close()
+	}
+	return nil
+}
+
+// Store returns the store of scripts.
+func (r *Runtime) Store() Store {
+	return r.store
+}
+
+// Script is a compiled script, which can be evaluated many times concurrently.
+type Script struct {
+	Name  string
+	proto *lua.FunctionProto
+}
+
+// Compile compiles the script. The name appears in errors and tracebacks.
+func (r *Runtime) Compile(reader io.Reader, name string) (*Script, error) {
+	proto, err := r.e.Compile(reader, name)
+	if err != nil {
+		return nil, err
+	}
+	return &Script{name, proto}, nil
+}
+
+// Input is what an evaluation receives.
+type Input struct {
+	// State is available to the script as m.state. It is not modified.
+	State map[string]interface{}
+	// Reader is read by io.read. A nil reader behaves like an empty one.
+	Reader io.Reader
+	// Writer is written by io.write. Output is discarded when it is nil.
+	Writer io.Writer
+}
+
+// Result is what an evaluation produces. Lua values are converted to nil, bool,
+// int64, float64, string, []interface{} and map[string]interface{}.
+type Result struct {
+	// Value is the value returned by the script.
+	Value interface{}
+	// State is m.state after the evaluation.
+	State map[string]interface{}
+}
+
+// Eval evaluates the script. It stops when ctx is done.
+func (r *Runtime) Eval(ctx context.Context, script *Script, input Input) (*Result, error) {
+	var state sync.Map
+	for key, value := range input.State {
+		state.Store(key, value)
+	}
+	writer := input.Writer
+	if writer == nil {
+		writer = io.Discard
+	}
+
+	value, err := r.e.Eval(ctx, script.proto, &state, input.Reader, writer)
+	if err != nil {
+		return nil, err
+	}
+
+	result := &Result{Value: value, State: make(map[string]interface{})}
+	state.Range(func(key, value any) bool {
+		if name, ok := key.(string); ok {
+			result.State[name] = value
+		}
+		return true
+	})
+	return result, nil
+}
@@ -0,0 +1,106 @@
+package lmb
+
+import (
+	"bytes"
+	"context"
+	"errors"
+	"strings"
+	"testing"
+
+	"github.com/henry40408/lmb/internal/store"
+	"github.com/stretchr/testify/assert"
+	lua "github.com/yuin/gopher-lua"
+)
+
+func TestEval(t *testing.T) {
+	r, err := NewRuntime()
+	assert.NoError(t, err)
+	defer r.Close()
+
+	script, err := r.Compile(strings.NewReader(`
+  local io = require('io')
+  local m = require('@lmb')
+  io.write(io.read('*a'))
+  m.state.greeting = 'hello, ' .. m.state.name
+  return { n = m.state.n + 1 }
+  `), "greet.lua")
+	assert.NoError(t, err)
+	assert.Equal(t, "greet.lua", script.Name)
+
+	var w bytes.Buffer
+	input := Input{
+		State:  map[string]interface{}{"name": "world", "n": 1},
+		Reader: strings.NewReader("input"),
+		Writer: &w,
+	}
+	result, err := r.Eval(context.Background(), script, input)
+	assert.NoError(t, err)
+	assert.Equal(t, map[string]interface{}{"n": int64(2)}, result.Value)
+	assert.Equal(t, "hello, world", result.State["greeting"])
+	assert.Equal(t, "input", w.String())
+	assert.NotContains(t, input.State, "greeting")
+}
+
+func TestEvalError(t *testing.T) {
+	r, err := NewRuntime(WithMaxInstructions(1000))
+	assert.NoError(t, err)
+	defer r.Close()
+
+	_, err = r.Compile(strings.NewReader("ret 1"), "syntax.lua")
+	var evalErr *EvalError
+	assert.ErrorAs(t, err, &evalErr)
+	assert.Equal(t, ErrorKindSyntax, evalErr.Kind)
+
+	script, err := r.Compile(strings.NewReader("while true do end"), "loop.lua")
+	assert.NoError(t, err)
+	_, err = r.Eval(context.Background(), script, Input{})
+	assert.ErrorAs(t, err, &evalErr)
+	assert.Equal(t, ErrorKindResourceLimit, evalErr.Kind)
+	assert.True(t, errors.Is(err, ErrInstructionLimit))
+}
+
+func TestWithModule(t *testing.T) {
+	r, err := NewRuntime(WithModule("greeter", func(L *lua.LState) int {
+		mod := L.NewTable()
+		L.SetField(mod, "greet", L.NewFunction(func(L *lua.LState) int {
+			L.Push(lua.LString("hello, " + L.CheckString(1)))
+			return 1
+		}))
+		L.Push(mod)
+		return 1
+	}))
+	assert.NoError(t, err)
+	defer r.Close()
+
+	script, err := r.Compile(strings.NewReader("return require('greeter').greet('world')"), "module.lua")
+	assert.NoError(t, err)
+	result, err := r.Eval(context.Background(), script, Input{})
+	assert.NoError(t, err)
+	assert.Equal(t, "hello, world", result.Value)
+}
+
+func TestWithStore(t *testing.T) {
+	s, err := store.NewStore(":memory:")
+	assert.NoError(t, err)
+	defer s.Close()
+
+	r, err := NewRuntime(WithStore(s))
+	assert.NoError(t, err)
+	script, err := r.Compile(strings.NewReader(`
+  local m = require('@lmb')
+  m.store.counter = (m.store.counter or 0) + 1
+  return m.store.counter
+  `), "store.lua")
+	assert.NoError(t, err)
+	for i := 1; i <= 2; i++ {
+		result, err := r.Eval(context.Background(), script, Input{})
+		assert.NoError(t, err)
+		assert.Equal(t, int64(i), result.Value)
+	}
+	assert.NoError(t, r.Close())
+
+	// the store is still usable after the runtime is closed
+	value, err := s.Get("counter")
+	assert.NoError(t, err)
+	assert.Equal(t, int64(2), value)
+}